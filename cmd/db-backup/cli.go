@@ -0,0 +1,132 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/cockroachdb/errors"
+)
+
+const (
+	backupCommand         = "backup"
+	listCommand           = "list"
+	pruneCommand          = "prune"
+	restoreCommand        = "restore"
+	validateConfigCommand = "validate-config"
+
+	textOutput = "text"
+	jsonOutput = "json"
+)
+
+const usageHeader = `usage: db-backup [command] [flags]
+
+commands:
+  backup           dump, upload and apply retention (default)
+  list             show remote backups of each database
+  prune            apply retention to existing backups
+  restore          download backup and restore it into database
+  validate-config  check configuration, with --connect also database and storage access
+  archive-wal      postgres archive_command: archive-wal [flags] %p %f [source]
+  restore-wal      postgres restore_command: restore-wal [flags] %f %p [source]
+`
+
+// cliOptions are parsed command line arguments.
+type cliOptions struct {
+	command     string
+	configFiles []string
+	sources     []string
+	dbs         []string
+	output      string
+	dryRun      bool
+	connect     bool
+	restore     RestoreOptions
+	args        []string // positional arguments
+}
+
+// stringsFlag collects values of repeated flag.
+type stringsFlag []string
+
+func (f *stringsFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *stringsFlag) Set(value string) error {
+	*f = append(*f, value)
+
+	return nil
+}
+
+// parseArgs parses command line without program name. Command is optional, backup is used by default.
+func parseArgs(args []string, output io.Writer) (cliOptions, error) {
+	opts := cliOptions{
+		command: backupCommand,
+	}
+
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		opts.command = args[0]
+		args = args[1:]
+	}
+
+	fs := flag.NewFlagSet(opts.command, flag.ContinueOnError)
+	fs.SetOutput(output)
+	fs.Usage = func() {
+		_, _ = fmt.Fprintf(output, "%v\nflags of %v:\n", usageHeader, opts.command)
+		fs.PrintDefaults()
+	}
+
+	fs.Var((*stringsFlag)(&opts.configFiles), "config",
+		"configuration file, can be repeated (default ./config.yaml and ./config.local.yaml)")
+	fs.StringVar(&opts.output, "output", textOutput, "output format: text or json")
+
+	switch opts.command {
+	case backupCommand, pruneCommand:
+		fs.Var((*stringsFlag)(&opts.sources), "source", "process only specified source, can be repeated")
+		fs.Var((*stringsFlag)(&opts.dbs), "db", "process only matching databases (name, glob or re:regex), can be repeated")
+		fs.BoolVar(&opts.dryRun, "dry-run", false, "print plan without dump, upload and removal")
+	case listCommand:
+		fs.Var((*stringsFlag)(&opts.sources), "source", "list only specified source, can be repeated")
+		fs.Var((*stringsFlag)(&opts.dbs), "db", "list only matching databases (name, glob or re:regex), can be repeated")
+	case restoreCommand:
+		fs.Var((*stringsFlag)(&opts.sources), "source", "source of the backup (first source by default)")
+		fs.StringVar(&opts.restore.Database, "db", "", "database name of the backup (required)")
+		fs.StringVar(&opts.restore.File, "file", "", "storage key of the backup (latest backup by default)")
+		fs.StringVar(&opts.restore.TargetDatabase, "target-db", "", "existing database to restore into (same as --db by default)")
+		fs.StringVar(&opts.restore.DownloadPath, "download", "", "only download backup into specified path")
+	case validateConfigCommand:
+		fs.BoolVar(&opts.connect, "connect", false, "also check access to databases and storages")
+	case archiveWalCommand, restoreWalCommand:
+	default:
+		return opts, errors.New(fmt.Sprintf("unknown command %v, see db-backup --help", opts.command))
+	}
+
+	if err := fs.Parse(args); err != nil {
+		return opts, err
+	}
+
+	opts.args = fs.Args()
+
+	if opts.output != textOutput && opts.output != jsonOutput {
+		return opts, errors.New(fmt.Sprintf("unsupported output format %v", opts.output))
+	}
+
+	switch opts.command {
+	case archiveWalCommand, restoreWalCommand:
+		return opts, nil
+	case restoreCommand:
+		if len(opts.restore.Database) == 0 {
+			return opts, errors.New("--db is required for restore")
+		}
+
+		if len(opts.sources) > 1 {
+			return opts, errors.New("restore supports only one --source")
+		}
+	}
+
+	if len(opts.args) > 0 {
+		return opts, errors.New(fmt.Sprintf("unexpected arguments %v", opts.args))
+	}
+
+	return opts, nil
+}
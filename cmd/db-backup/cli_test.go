@@ -0,0 +1,52 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseArgsDefaultsToBackup(t *testing.T) {
+	opts, err := parseArgs([]string{"--dry-run", "--db", "config", "--db", "tenant_*"}, io.Discard)
+	assert.NoError(t, err)
+	assert.Equal(t, backupCommand, opts.command)
+	assert.True(t, opts.dryRun)
+	assert.Equal(t, []string{"config", "tenant_*"}, opts.dbs)
+	assert.Equal(t, textOutput, opts.output)
+}
+
+func TestParseArgsCommands(t *testing.T) {
+	opts, err := parseArgs([]string{"list", "--config", "a.yaml", "--config", "b.yaml", "--output", "json"}, io.Discard)
+	assert.NoError(t, err)
+	assert.Equal(t, listCommand, opts.command)
+	assert.Equal(t, []string{"a.yaml", "b.yaml"}, opts.configFiles)
+	assert.Equal(t, jsonOutput, opts.output)
+
+	opts, err = parseArgs([]string{"restore", "--db", "config", "--target-db", "config_copy"}, io.Discard)
+	assert.NoError(t, err)
+	assert.Equal(t, "config", opts.restore.Database)
+	assert.Equal(t, "config_copy", opts.restore.TargetDatabase)
+
+	opts, err = parseArgs([]string{"archive-wal", "pg_wal/0001", "0001", "cluster-a"}, io.Discard)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"pg_wal/0001", "0001", "cluster-a"}, opts.args)
+}
+
+func TestParseArgsErrors(t *testing.T) {
+	_, err := parseArgs([]string{"unknown"}, io.Discard)
+	assert.ErrorContains(t, err, "unknown command")
+
+	_, err = parseArgs([]string{"restore"}, io.Discard)
+	assert.ErrorContains(t, err, "--db is required")
+
+	_, err = parseArgs([]string{"list", "--output", "xml"}, io.Discard)
+	assert.ErrorContains(t, err, "unsupported output format")
+
+	_, err = parseArgs([]string{"list", "--dry-run"}, io.Discard)
+	assert.Error(t, err)
+
+	_, err = parseArgs([]string{"--help"}, io.Discard)
+	assert.ErrorIs(t, err, flag.ErrHelp)
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"github.com/samber/lo"
+
+	"github.com/skynet2/db-backup/pkg/common"
+)
+
+// Process exit codes, so schedulers (ex. kubernetes CronJob) can distinguish failures.
+const (
+	exitOk                  = 0
+	exitTotalFailure        = 1 // all databases failed or run failed before any job
+	exitPartialFailure      = 2 // some databases failed
+	exitConfigError         = 3 // invalid flags or configuration
+	exitNotificationFailure = 4 // all databases succeeded, but notification was not sent
+	exitLockHeld            = 5 // run lock is held by another run (lock.on_contention fail or wait timeout)
+)
+
+// getExitCode returns exit code for job results and notification error.
+func getExitCode(jobs []common.Job, notifyErr error) int {
+	failed := lo.CountBy(jobs, func(j common.Job) bool {
+		return j.Error != nil
+	})
+
+	switch {
+	case len(jobs) == 0 || failed == len(jobs):
+		return exitTotalFailure
+	case failed > 0:
+		return exitPartialFailure
+	case notifyErr != nil:
+		return exitNotificationFailure
+	default:
+		return exitOk
+	}
+}
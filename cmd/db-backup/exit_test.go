@@ -0,0 +1,22 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/cockroachdb/errors"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/skynet2/db-backup/pkg/common"
+)
+
+func TestGetExitCode(t *testing.T) {
+	ok := common.Job{DatabaseName: "config"}
+	failed := common.Job{DatabaseName: "stats", Error: errors.New("pg_dump failed")}
+	notifyErr := errors.New("discord is down")
+
+	assert.Equal(t, exitOk, getExitCode([]common.Job{ok, ok}, nil))
+	assert.Equal(t, exitNotificationFailure, getExitCode([]common.Job{ok}, notifyErr))
+	assert.Equal(t, exitPartialFailure, getExitCode([]common.Job{ok, failed}, notifyErr))
+	assert.Equal(t, exitTotalFailure, getExitCode([]common.Job{failed, failed}, nil))
+	assert.Equal(t, exitTotalFailure, getExitCode(nil, nil))
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/cockroachdb/errors"
+)
+
+const regexPatternPrefix = "re:"
+
+// dbPattern matches database names against a single include_dbs / exclude_dbs entry.
+// Supported formats:
+//   - exact name (config)
+//   - glob (tenant_*), see path.Match for syntax
+//   - regex with "re:" prefix (re:^tenant_\d+$)
+type dbPattern struct {
+	raw   string
+	regex *regexp.Regexp
+	glob  bool
+}
+
+func newDbPattern(raw string) (*dbPattern, error) {
+	p := &dbPattern{
+		raw: strings.TrimSpace(raw),
+	}
+
+	if strings.HasPrefix(p.raw, regexPatternPrefix) {
+		compiled, err := regexp.Compile(strings.TrimPrefix(p.raw, regexPatternPrefix))
+
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid regex pattern %v", p.raw)
+		}
+
+		p.regex = compiled
+
+		return p, nil
+	}
+
+	if strings.ContainsAny(p.raw, "*?[") {
+		if _, err := path.Match(p.raw, ""); err != nil {
+			return nil, errors.Wrapf(err, "invalid glob pattern %v", p.raw)
+		}
+
+		p.glob = true
+	}
+
+	return p, nil
+}
+
+func (p *dbPattern) Match(dbName string) bool {
+	switch {
+	case p.regex != nil:
+		return p.regex.MatchString(dbName)
+	case p.glob:
+		matched, _ := path.Match(p.raw, dbName)
+
+		return matched
+	default:
+		return p.raw == dbName
+	}
+}
+
+func (p *dbPattern) String() string {
+	return p.raw
+}
+
+func newDbPatterns(raw []string) ([]*dbPattern, error) {
+	var patterns []*dbPattern
+
+	for _, r := range raw {
+		if len(strings.TrimSpace(r)) == 0 {
+			continue
+		}
+
+		p, err := newDbPattern(r)
+
+		if err != nil {
+			return nil, err
+		}
+
+		patterns = append(patterns, p)
+	}
+
+	return patterns, nil
+}
+
+func matchAnyPattern(patterns []*dbPattern, dbName string) bool {
+	for _, p := range patterns {
+		if p.Match(dbName) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/cockroachdb/errors"
+	"github.com/samber/lo"
+
+	"github.com/skynet2/db-backup/pkg/configuration"
+	"github.com/skynet2/db-backup/pkg/storage"
+)
+
+// listDbPlaceholder replaces database name in dir_template to find the storage directory shared by all databases.
+const listDbPlaceholder = "__db_backup_database__"
+
+// backupNameRegex matches backup file name (db-<database>-<time>...) and database manifest (manifest-<database>.json).
+var backupNameRegex = regexp.MustCompile(`^(?:db-(.+)-\d{4}_\d{2}_\d{2}-\d{2}_\d{2}_\d{2}|manifest-(.+)\.json$)`)
+
+// BackupList contains remote backups of a single database, oldest first.
+type BackupList struct {
+	Source   string
+	Database string
+	Files    []storage.File
+	Error    error
+}
+
+// ListBackups returns remote backups of each database found in the storage, oldest first.
+// Database server is not queried, so backups of dropped databases are listed as well.
+func (s *Service) ListBackups(ctx context.Context) ([]BackupList, error) {
+	dbs, err := s.findStoredDatabases(ctx)
+
+	if err != nil {
+		return nil, err
+	}
+
+	selected, err := newDbPatterns(s.cfg.SelectedDbs)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid --db filter")
+	}
+
+	if len(selected) > 0 {
+		dbs = lo.Filter(dbs, func(db string, _ int) bool {
+			return matchAnyPattern(selected, db)
+		})
+	}
+
+	var lists []BackupList
+
+	for _, db := range dbs {
+		list := BackupList{
+			Source:   s.cfg.Db.Name,
+			Database: db,
+		}
+
+		list.Files, list.Error = s.listDatabaseBackups(ctx, db)
+
+		if list.Error == nil && len(list.Files) == 0 {
+			continue // name of database override or a file from another directory layout
+		}
+
+		lists = append(lists, list)
+	}
+
+	return lists, nil
+}
+
+// findStoredDatabases returns names of databases with backups or manifests in the storage and destinations,
+// plus names of database overrides which can have their own dir_template.
+func (s *Service) findStoredDatabases(ctx context.Context) ([]string, error) {
+	type root struct {
+		provider storage.Provider
+		storage  configuration.StorageConfiguration
+	}
+
+	roots := []root{{provider: s.storageProvider, storage: s.cfg.Storage}}
+
+	for name, provider := range s.destinations {
+		roots = append(roots, root{provider: provider, storage: s.cfg.Destinations[name]})
+	}
+
+	found := map[string]struct{}{}
+
+	for _, r := range roots {
+		dir, err := s.templateDir(r.storage.DirTemplate, listDbPlaceholder, r.storage.Prefix)
+
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+
+		// everything after the first database name can differ between databases
+		prefix, _, _ := strings.Cut(dir, listDbPlaceholder)
+
+		files, err := r.provider.List(ctx, prefix)
+
+		if err != nil {
+			return nil, err
+		}
+
+		for _, f := range files {
+			if match := backupNameRegex.FindStringSubmatch(path.Base(f.AbsolutePath)); match != nil {
+				found[match[1]+match[2]] = struct{}{}
+			}
+		}
+	}
+
+	for key := range s.cfg.Databases {
+		source, db, ok := strings.Cut(key, "/")
+
+		if !ok {
+			db = key
+		} else if source != s.cfg.Db.Name {
+			continue
+		}
+
+		found[db] = struct{}{}
+	}
+
+	dbs := lo.Keys(found)
+	sort.Strings(dbs)
+
+	return dbs, nil
+}
+
+func (s *Service) listDatabaseBackups(ctx context.Context, dbName string) ([]storage.File, error) {
+	settings, err := s.getDatabaseSettings(dbName)
+
+	if err != nil {
+		return nil, err
+	}
+
+	prefix, err := s.getRemotePrefix(settings, dbName)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return settings.storageProvider.List(ctx, prefix)
+}
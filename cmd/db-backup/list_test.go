@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/samber/lo"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/skynet2/db-backup/pkg/configuration"
+)
+
+func TestListBackupsFromStorage(t *testing.T) {
+	store := newMemoryStorage()
+	createdAt := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	store.put("main/config/db-config-2024_01_01-00_00_00.sql.gzip", []byte("dump"), createdAt)
+	store.put("main/config/db-config-2024_01_02-00_00_00.sql.gzip", []byte("dump"), createdAt.Add(24*time.Hour))
+	store.put("main/dropped-db/db-dropped-db-2024_01_01-00_00_00.sql.gzip", []byte("dump"), createdAt)
+	store.put("main/tenant_0001/manifest-tenant_0001.json", []byte("{}"), createdAt)
+	store.put("main/tenant_0001/db-tenant_0001-2024_01_01-00_00_00.sql.gzip", []byte("dump"), createdAt)
+	store.put("main/wal/000000010000000000000001.gz", []byte("wal"), createdAt)
+
+	cfg := configuration.Configuration{
+		Db: configuration.DbConfiguration{
+			Name: "main",
+		},
+		Storage: configuration.StorageConfiguration{
+			DirTemplate: "{{.Source}}/{{.DbName}}",
+		},
+	}
+
+	// no database provider, list must not connect to the server
+	lists, err := NewService(nil, store, nil, cfg).ListBackups(context.TODO())
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"config", "dropped-db", "tenant_0001"}, lo.Map(lists, func(l BackupList, _ int) string {
+		return l.Database
+	}))
+	assert.Len(t, lists[0].Files, 2)
+	assert.Len(t, lists[2].Files, 1)
+
+	cfg.SelectedDbs = []string{"tenant_*"}
+
+	lists, err = NewService(nil, store, nil, cfg).ListBackups(context.TODO())
+	assert.NoError(t, err)
+	assert.Len(t, lists, 1)
+	assert.Equal(t, "tenant_0001", lists[0].Database)
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"time"
+
+	"github.com/cockroachdb/errors"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+
+	"github.com/skynet2/db-backup/pkg/configuration"
+	"github.com/skynet2/db-backup/pkg/storage"
+)
+
+const (
+	lockOnContentionWait = "wait"
+	lockOnContentionSkip = "skip"
+	lockOnContentionFail = "fail"
+
+	maxLockWaitInterval = 30 * time.Second
+)
+
+// runLocked executes run while holding the run lock in the default storage.
+// Run context is cancelled if the lock is lost, ex. taken over after heartbeat failures.
+func runLocked(
+	ctx context.Context,
+	cfg configuration.Configuration,
+	services []*Service,
+	run func(ctx context.Context) int,
+) int {
+	if !cfg.Lock.Enabled || cfg.DryRun {
+		return run(ctx)
+	}
+
+	if err := validateLockConfiguration(cfg.Lock); err != nil {
+		log.Err(err).Send()
+		return exitConfigError
+	}
+
+	runCtx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	lock, err := acquireRunLock(runCtx, cfg, services[0].storageProvider, func(err error) {
+		zerolog.Ctx(ctx).Err(err).Msg("run lock is lost, stopping the run")
+		cancel(err)
+	})
+
+	if errors.Is(err, storage.ErrLockHeld) && cfg.Lock.OnContention == lockOnContentionSkip {
+		zerolog.Ctx(ctx).Info().Err(err).Msg("another run is in progress, skipping")
+		return exitOk
+	}
+
+	if err != nil {
+		zerolog.Ctx(ctx).Err(err).Send()
+
+		if errors.Is(err, storage.ErrLockHeld) {
+			return exitLockHeld
+		}
+
+		return exitTotalFailure
+	}
+
+	defer func() {
+		if releaseErr := lock.Release(context.WithoutCancel(ctx)); releaseErr != nil {
+			zerolog.Ctx(ctx).Err(releaseErr).Msg("can not release run lock")
+		}
+	}()
+
+	return run(runCtx)
+}
+
+// acquireRunLock acquires the lock according to lock.on_contention, with wait it retries until wait_timeout.
+func acquireRunLock(
+	ctx context.Context,
+	cfg configuration.Configuration,
+	provider storage.Provider,
+	onLost func(err error),
+) (*storage.Lock, error) {
+	opts := storage.LockOptions{
+		Key:     getLockKey(cfg),
+		RunId:   cfg.RunId,
+		Lease:   cfg.Lock.Lease,
+		TempDir: cfg.Db.DumpDir,
+		OnLost:  onLost,
+	}
+
+	if opts.Lease <= 0 {
+		opts.Lease = storage.DefaultLockLease
+	}
+
+	waitInterval := min(opts.Lease/3, maxLockWaitInterval)
+
+	var deadline <-chan time.Time
+
+	if cfg.Lock.WaitTimeout > 0 {
+		timer := time.NewTimer(cfg.Lock.WaitTimeout)
+		defer timer.Stop()
+
+		deadline = timer.C
+	}
+
+	for {
+		lock, err := storage.AcquireLock(ctx, provider, opts)
+
+		if err == nil || !errors.Is(err, storage.ErrLockHeld) {
+			return lock, err
+		}
+
+		if cfg.Lock.OnContention != "" && cfg.Lock.OnContention != lockOnContentionWait {
+			return nil, err
+		}
+
+		zerolog.Ctx(ctx).Info().Err(err).Msgf("run lock is held, retrying in %v", waitInterval)
+
+		select {
+		case <-time.After(waitInterval):
+		case <-deadline:
+			return nil, errors.Wrapf(err, "lock was not acquired within %v", cfg.Lock.WaitTimeout)
+		case <-ctx.Done():
+			return nil, errors.WithStack(ctx.Err())
+		}
+	}
+}
+
+// getLockKey returns lock.key, by default the lock is stored under storage.prefix,
+// so deployments sharing a bucket with different prefixes do not block each other.
+func getLockKey(cfg configuration.Configuration) string {
+	if len(cfg.Lock.Key) > 0 {
+		return cfg.Lock.Key
+	}
+
+	return path.Join(cfg.Storage.Prefix, storage.DefaultLockKey)
+}
+
+func validateLockConfiguration(cfg configuration.LockConfiguration) error {
+	switch cfg.OnContention {
+	case "", lockOnContentionWait, lockOnContentionSkip, lockOnContentionFail:
+	default:
+		return errors.New(fmt.Sprintf("invalid lock.on_contention %v, expected %v, %v or %v", cfg.OnContention,
+			lockOnContentionWait, lockOnContentionSkip, lockOnContentionFail))
+	}
+
+	if cfg.Lease < 0 || cfg.WaitTimeout < 0 {
+		return errors.New("lock.lease and lock.wait_timeout should not be negative")
+	}
+
+	return nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/skynet2/db-backup/pkg/configuration"
+	"github.com/skynet2/db-backup/pkg/storage"
+)
+
+func TestRunLockedContention(t *testing.T) {
+	cases := []struct {
+		name     string
+		lock     configuration.LockConfiguration
+		exitCode int
+	}{
+		{name: "skip", lock: configuration.LockConfiguration{OnContention: "skip"}, exitCode: exitOk},
+		{name: "fail", lock: configuration.LockConfiguration{OnContention: "fail"}, exitCode: exitLockHeld},
+		{name: "wait timeout", lock: configuration.LockConfiguration{
+			Lease:       30 * time.Millisecond,
+			WaitTimeout: 50 * time.Millisecond,
+		}, exitCode: exitLockHeld},
+		{name: "invalid", lock: configuration.LockConfiguration{OnContention: "retry"}, exitCode: exitConfigError},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			memory := newMemoryStorage()
+
+			data, err := json.Marshal(storage.LockInfo{RunId: "other", ExpiresAt: time.Now().Add(time.Hour)})
+			assert.NoError(t, err)
+			memory.put(storage.DefaultLockKey, data, time.Now())
+
+			c.lock.Enabled = true
+			cfg := configuration.Configuration{RunId: "run-1", Lock: c.lock}
+			services := []*Service{NewService(nil, memory, nil, cfg)}
+
+			called := false
+			exitCode := runLocked(context.TODO(), cfg, services, func(_ context.Context) int {
+				called = true
+				return exitOk
+			})
+
+			assert.Equal(t, c.exitCode, exitCode)
+			assert.False(t, called)
+		})
+	}
+}
+
+func TestRunLockedDisabled(t *testing.T) {
+	called := false
+	exitCode := runLocked(context.TODO(), configuration.Configuration{}, nil, func(_ context.Context) int {
+		called = true
+		return exitPartialFailure
+	})
+
+	assert.Equal(t, exitPartialFailure, exitCode)
+	assert.True(t, called)
+}
+
+func TestGetLockKey(t *testing.T) {
+	cfg := configuration.Configuration{}
+	assert.Equal(t, storage.DefaultLockKey, getLockKey(cfg))
+
+	cfg.Storage.Prefix = "team-a"
+	assert.Equal(t, "team-a/"+storage.DefaultLockKey, getLockKey(cfg))
+
+	cfg.Lock.Key = "locks/backup.lock"
+	assert.Equal(t, "locks/backup.lock", getLockKey(cfg))
+}
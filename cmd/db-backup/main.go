@@ -2,20 +2,26 @@ package main
 
 import (
 	"context"
+	"flag"
 	"fmt"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/cockroachdb/errors"
 	"github.com/cristalhq/aconfig"
 	"github.com/cristalhq/aconfig/aconfigdotenv"
 	"github.com/cristalhq/aconfig/aconfigyaml"
 	"github.com/davecgh/go-spew/spew"
+	"github.com/hashicorp/go-multierror"
 	"github.com/rs/zerolog/log"
+	"github.com/samber/lo"
 
+	"github.com/skynet2/db-backup/pkg/common"
 	"github.com/skynet2/db-backup/pkg/configuration"
 	"github.com/skynet2/db-backup/pkg/database"
 	"github.com/skynet2/db-backup/pkg/notifier"
+	"github.com/skynet2/db-backup/pkg/report"
 	"github.com/skynet2/db-backup/pkg/storage"
 )
 
@@ -24,20 +30,95 @@ func main() {
 	setupZeroLog()
 	registerMetrics()
 
+	os.Exit(run())
+}
+
+// run executes command and returns exit code. Deferred functions of commands are executed before exit.
+func run() int {
+	opts, err := parseArgs(os.Args[1:], os.Stderr)
+
+	if errors.Is(err, flag.ErrHelp) {
+		return exitOk
+	}
+
+	if err != nil {
+		log.Err(err).Send()
+		return exitConfigError
+	}
+
+	cfg, err := loadConfiguration(opts)
+
+	if err != nil {
+		log.Err(err).Send()
+		return exitConfigError
+	}
+
+	services, err := newServices(cfg, opts.sources)
+
+	if err != nil {
+		log.Err(err).Send()
+		return exitConfigError
+	}
+
+	ctx := log.Logger.WithContext(context.Background())
+
+	switch opts.command {
+	case archiveWalCommand, restoreWalCommand:
+		err = runWalCommand(ctx, services, append([]string{opts.command}, opts.args...))
+	case listCommand:
+		err = runList(ctx, services, opts)
+	case pruneCommand:
+		return runLocked(ctx, cfg, services, func(ctx context.Context) int {
+			return runPrune(ctx, services, opts)
+		})
+	case restoreCommand:
+		err = runRestore(ctx, services, opts)
+	case validateConfigCommand:
+		if err = runValidateConfig(ctx, services, opts); err != nil {
+			log.Err(err).Send()
+			return exitConfigError
+		}
+	default:
+		return runLocked(ctx, cfg, services, func(ctx context.Context) int {
+			return runBackup(ctx, cfg, services, opts)
+		})
+	}
+
+	if err != nil {
+		log.Err(err).Send()
+		return exitTotalFailure
+	}
+
+	return exitOk
+}
+
+// loadConfiguration loads configuration files and environment and applies command line flags.
+func loadConfiguration(opts cliOptions) (configuration.Configuration, error) {
 	cfg := configuration.Configuration{}
 
-	configFiles := []string{
-		"./config.yaml",
-		"./config.local.yaml",
+	configFiles := opts.configFiles
+
+	for _, f := range configFiles {
+		if _, err := os.Stat(f); err != nil { // explicitly requested file should exist
+			return cfg, errors.Wrap(err, "invalid --config")
+		}
+	}
+
+	if len(configFiles) == 0 {
+		configFiles = []string{
+			"./config.yaml",
+			"./config.local.yaml",
+		}
 	}
 
 	if v := os.Getenv("ADDITIONAL_CONFIGS"); v != "" {
 		configFiles = append(configFiles, strings.Split(v, ",")...)
 	}
 
-	log.Info().Msgf("using additional configuration files: %v", spew.Sdump(configFiles))
+	log.Info().Msgf("using configuration files: %v", spew.Sdump(configFiles))
 
 	if err := aconfig.LoaderFor(&cfg, aconfig.Config{
+		SkipFlags:          true, // flags are parsed by parseArgs
 		Files:              configFiles,
 		MergeFiles:         true,
 		AllowUnknownFields: true,
@@ -47,10 +128,74 @@ func main() {
 			".env":  aconfigdotenv.New(),
 		},
 	}).Load(); err != nil {
-		log.Fatal().Err(err).Send()
+		return cfg, errors.WithStack(err)
 	}
 
+	if err := cfg.Prepare(); err != nil {
+		return cfg, err
+	}
+
+	cfg.SelectedDbs = opts.dbs
+	cfg.RunId = common.NewRunId(time.Now().UTC())
+
+	if opts.dryRun {
+		cfg.DryRun = true
+	}
+
+	return cfg, nil
+}
+
+// newServices creates service for each configured source. Empty names -> all sources.
+func newServices(cfg configuration.Configuration, names []string) ([]*Service, error) {
+	storageProvider, err := getStorageProvider(cfg.Storage)
+
+	if err != nil {
+		return nil, err
+	}
+
+	destinations := map[string]storage.Provider{}
+
+	for name, destinationCfg := range cfg.Destinations {
+		destination, destinationErr := getStorageProvider(destinationCfg)
+
+		if destinationErr != nil {
+			return nil, errors.Wrapf(destinationErr, "destination %v", name)
+		}
+
+		destinations[name] = destination
+	}
+
+	var services []*Service
+
+	for _, source := range cfg.GetSources() {
+		if len(names) > 0 && !lo.Contains(names, source.Name) {
+			continue
+		}
+
+		sourceCfg := cfg.ForSource(source)
+
+		dbProvider, dbErr := getDbProvider(sourceCfg.Db)
+
+		if dbErr != nil {
+			return nil, errors.Wrapf(dbErr, "source %v", source.Name)
+		}
+
+		services = append(services, NewService(dbProvider, storageProvider, destinations, sourceCfg))
+	}
+
+	if len(services) < len(names) || len(services) == 0 {
+		return nil, errors.New(fmt.Sprintf("unknown source in %v", names))
+	}
+
+	return services, nil
+}
+
+func runBackup(ctx context.Context, cfg configuration.Configuration, services []*Service, opts cliOptions) int {
 	defer func() {
+		if cfg.DryRun {
+			return
+		}
+
 		if pushErr := pushMetrics(cfg.Metrics.PrometheusPushGatewayUrl, cfg.Metrics.PrometheusJobName); pushErr != nil {
 			log.Err(pushErr).Send()
 		}
@@ -59,33 +204,64 @@ func main() {
 	notifyService, err := notifier.NewDefaultService(cfg.Notifications)
 
 	if err != nil {
-		log.Fatal().Err(err).Send()
+		log.Err(err).Send()
+		return exitConfigError
 	}
 
-	storageProvider, err := getStorageProvider(cfg.Storage)
+	runStartedAt := time.Now().UTC()
+	runFailed := false
 
-	if err != nil {
-		log.Fatal().Err(err).Send()
-	}
+	var jobs []common.Job
 
-	dbProvider, err := getDbProvider(cfg.Db)
+	for _, service := range services {
+		startedAt := time.Now().UTC()
+		sourceJobs, processErr := service.Process(ctx)
 
-	if err != nil {
-		log.Fatal().Err(err).Send()
-	}
+		if processErr != nil && len(services) == 1 {
+			if innerErr := notifyService.SendError(ctx, processErr); innerErr != nil {
+				log.Err(innerErr).Send()
+			}
 
-	service := NewService(dbProvider, storageProvider, cfg)
+			runFailed = true
+		}
 
-	ctx := log.Logger.WithContext(context.Background())
+		if processErr != nil { // report failed source as a job in combined report
+			processErr = errors.Wrapf(processErr, "source %v", service.cfg.Db.Name)
+			log.Err(processErr).Send()
 
-	jobs, err := service.Process(ctx)
+			sourceJobs = append(sourceJobs, common.Job{
+				SourceName: service.cfg.Db.Name,
+				StartedAt:  startedAt,
+				EndAt:      time.Now().UTC(),
+				Error:      processErr,
+			})
+		}
 
-	if err != nil {
-		if innerErr := notifyService.SendError(ctx, err); innerErr != nil {
+		jobs = append(jobs, sourceJobs...)
+	}
+
+	runReport := report.New(backupCommand, cfg.DryRun, runStartedAt, jobs)
+
+	if opts.output == jsonOutput {
+		if err = writeJSON(os.Stdout, runReport); err != nil {
 			log.Err(err).Send()
 		}
+	} else if cfg.DryRun {
+		printPlan(os.Stdout, jobs)
+	}
 
-		log.Fatal().Err(err).Send()
+	if cfg.DryRun {
+		return getExitCode(jobs, nil)
+	}
+
+	reportErr := writeReport(ctx, cfg, services[0].storageProvider, runReport)
+
+	if reportErr != nil {
+		log.Err(reportErr).Send()
+	}
+
+	if runFailed {
+		return exitTotalFailure
 	}
 
 	if err = notifyService.SendResults(ctx, jobs); err != nil {
@@ -95,6 +271,119 @@ func main() {
 
 		log.Err(err).Send()
 	}
+
+	if reportErr != nil {
+		err = multierror.Append(err, reportErr)
+	}
+
+	return getExitCode(jobs, err)
+}
+
+func runList(ctx context.Context, services []*Service, opts cliOptions) error {
+	var lists []BackupList
+
+	for _, service := range services {
+		sourceLists, err := service.ListBackups(ctx)
+
+		if err != nil {
+			return errors.Wrapf(err, "source %v", service.cfg.Db.Name)
+		}
+
+		lists = append(lists, sourceLists...)
+	}
+
+	if opts.output == jsonOutput {
+		return writeJSON(os.Stdout, toBackupListOutputs(lists))
+	}
+
+	return printBackupLists(os.Stdout, lists)
+}
+
+func runPrune(ctx context.Context, services []*Service, opts cliOptions) int {
+	runStartedAt := time.Now().UTC()
+
+	var jobs []common.Job
+
+	for _, service := range services {
+		startedAt := time.Now().UTC()
+		sourceJobs, err := service.Prune(ctx)
+
+		if err != nil {
+			err = errors.Wrapf(err, "source %v", service.cfg.Db.Name)
+			log.Err(err).Send()
+
+			sourceJobs = append(sourceJobs, common.Job{
+				SourceName: service.cfg.Db.Name,
+				StartedAt:  startedAt,
+				EndAt:      time.Now().UTC(),
+				Error:      err,
+			})
+		}
+
+		jobs = append(jobs, sourceJobs...)
+	}
+
+	if opts.output == jsonOutput {
+		if err := writeJSON(os.Stdout, report.New(pruneCommand, services[0].cfg.DryRun, runStartedAt, jobs)); err != nil {
+			log.Err(err).Send()
+		}
+	} else {
+		printPrune(os.Stdout, jobs)
+	}
+
+	return getExitCode(jobs, nil)
+}
+
+func runRestore(ctx context.Context, services []*Service, opts cliOptions) error {
+	job := services[0].Restore(ctx, opts.restore)
+
+	if opts.output == jsonOutput {
+		if err := writeJSON(os.Stdout, report.New(restoreCommand, false, job.StartedAt, []common.Job{job})); err != nil {
+			return err
+		}
+	}
+
+	if job.Error != nil {
+		return errors.Wrap(job.Error, job.Output)
+	}
+
+	log.Info().Msgf("%v restored in %v", job.StorageFileLocation, job.EndAt.Sub(job.StartedAt))
+
+	return nil
+}
+
+func runValidateConfig(ctx context.Context, services []*Service, opts cliOptions) error {
+	var finalErr error
+
+	for _, service := range services {
+		err := service.ValidateConfiguration()
+
+		if err == nil && opts.connect {
+			err = service.validate(ctx)
+		}
+
+		if err != nil {
+			finalErr = multierror.Append(finalErr, errors.Wrapf(err, "source %v", service.cfg.Db.Name))
+		}
+	}
+
+	if opts.output == jsonOutput {
+		result := map[string]any{
+			"valid": finalErr == nil,
+		}
+
+		if finalErr != nil {
+			result["error"] = finalErr.Error()
+		}
+
+		if err := writeJSON(os.Stdout, result); err != nil {
+			return err
+		}
+	} else if finalErr == nil {
+		_, _ = fmt.Fprintln(os.Stdout, "configuration is valid")
+	}
+
+	return finalErr
 }
 
 func getDbProvider(cfg configuration.DbConfiguration) (database.Provider, error) {
@@ -103,6 +392,8 @@ func getDbProvider(cfg configuration.DbConfiguration) (database.Provider, error)
 	switch provider {
 	case "postgres":
 		return database.NewPostgresProvider(cfg.Postgres), nil
+	case "postgres-physical":
+		return database.NewPostgresPhysicalProvider(cfg.Postgres), nil
 	default:
 		return nil, errors.New(fmt.Sprintf("no implementation for database provider %v", provider))
 	}
@@ -111,10 +402,20 @@ func getDbProvider(cfg configuration.DbConfiguration) (database.Provider, error)
 func getStorageProvider(cfg configuration.StorageConfiguration) (storage.Provider, error) {
 	provider := strings.TrimSpace(strings.ToLower(cfg.Provider))
 
+	var final storage.Provider
+
 	switch provider {
 	case "s3":
-		return storage.NewS3Provider(cfg.S3), nil
+		final = storage.NewS3Provider(cfg.S3)
 	default:
 		return nil, errors.New(fmt.Sprintf("no implementation for storage provider %v", provider))
 	}
+
+	final, err := storage.NewThrottledProvider(final, cfg)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return storage.NewVolumeProvider(final, cfg)
 }
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/cockroachdb/errors"
+
+	"github.com/skynet2/db-backup/pkg/common"
+	"github.com/skynet2/db-backup/pkg/manifest"
+)
+
+const checksumAlgorithm = "sha256"
+
+// updateManifest adds uploaded backup of the job to the database manifest and drops removed files.
+func (s *Service) updateManifest(ctx context.Context, settings databaseSettings, job *common.Job) error {
+	if s.cfg.DryRun || (job.UploadEndedAt == nil && len(job.RemovedFiles) == 0) {
+		return nil
+	}
+
+	key, err := s.getManifestKey(settings, job.DatabaseName)
+
+	if err != nil {
+		return err
+	}
+
+	m, err := manifest.Load(ctx, settings.storageProvider, key)
+
+	if err != nil {
+		return err
+	}
+
+	m.Source = s.cfg.Db.Name
+	m.Database = job.DatabaseName
+
+	if job.UploadEndedAt != nil {
+		format := s.dbProvider.GetBackupFormat(settings.backupOptions)
+
+		m.Add(manifest.Entry{
+			Key:               job.StorageFileLocation,
+			CreatedAt:         job.DatabaseBackupStartedAt,
+			Size:              job.FileSize,
+			Checksum:          job.Checksum,
+			ChecksumAlgorithm: checksumAlgorithm,
+			Format:            format.Format,
+			Compression:       format.Compression,
+			CompressionLevel:  format.CompressionLevel,
+			SourceHost:        job.DatabaseHost,
+			ToolVersion:       common.Version,
+		})
+	}
+
+	m.Remove(job.RemovedFiles...)
+
+	return manifest.Save(ctx, settings.storageProvider, key, s.cfg.Db.DumpDir, m)
+}
+
+// getManifestKey returns storage key of the database manifest, it is not matched by backup file prefix.
+func (s *Service) getManifestKey(settings databaseSettings, dbName string) (string, error) {
+	templatedDirRemoteDir, err := s.templateDir(settings.storage.DirTemplate, dbName, settings.storage.Prefix)
+
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+
+	return fmt.Sprintf("%v/manifest-%v.json", templatedDirRemoteDir, dbName), nil
+}
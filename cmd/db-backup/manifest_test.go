@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/errors"
+	"github.com/samber/lo"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/skynet2/db-backup/pkg/common"
+	"github.com/skynet2/db-backup/pkg/configuration"
+	"github.com/skynet2/db-backup/pkg/manifest"
+	"github.com/skynet2/db-backup/pkg/storage"
+)
+
+func TestUpdateManifest(t *testing.T) {
+	store := newMemoryStorage()
+	srv := NewService(&fakeDbProvider{}, store, nil, configuration.Configuration{
+		Db: configuration.DbConfiguration{
+			Name:    "cluster-a",
+			DumpDir: t.TempDir(),
+		},
+		Storage: configuration.StorageConfiguration{
+			DirTemplate: "{{.Source}}/{{.DbName}}",
+		},
+	})
+
+	settings, err := srv.getDatabaseSettings("config")
+	assert.NoError(t, err)
+
+	uploadedAt := time.Now().UTC()
+
+	for _, key := range []string{"cluster-a/config/db-config-1.sql.gzip", "cluster-a/config/db-config-2.sql.gzip"} {
+		assert.NoError(t, srv.updateManifest(context.TODO(), settings, &common.Job{
+			DatabaseName:        "config",
+			DatabaseHost:        "replica.local",
+			StorageFileLocation: key,
+			UploadEndedAt:       &uploadedAt,
+			FileSize:            10,
+			Checksum:            "abc",
+		}))
+	}
+
+	assert.NoError(t, srv.updateManifest(context.TODO(), settings, &common.Job{
+		DatabaseName: "config",
+		RemovedFiles: []string{"cluster-a/config/db-config-1.sql.gzip"},
+	}))
+
+	m, err := manifest.Load(context.TODO(), store, "cluster-a/config/manifest-config.json")
+	assert.NoError(t, err)
+	assert.Equal(t, "cluster-a", m.Source)
+	assert.Len(t, m.Backups, 1)
+	assert.Equal(t, "cluster-a/config/db-config-2.sql.gzip", m.Backups[0].Key)
+	assert.Equal(t, "abc", m.Backups[0].Checksum)
+	assert.Equal(t, "gzip", m.Backups[0].Compression)
+	assert.Equal(t, "replica.local", m.Backups[0].SourceHost)
+}
+
+type failingRemoveStorage struct {
+	*memoryStorage
+	failed map[string]bool
+}
+
+func (f *failingRemoveStorage) Remove(ctx context.Context, absolutePath string) error {
+	if f.failed[absolutePath] {
+		return errors.New("access denied")
+	}
+
+	return f.memoryStorage.Remove(ctx, absolutePath)
+}
+
+func TestUpdateManifestKeepsBackupWhichWasNotRemoved(t *testing.T) {
+	store := &failingRemoveStorage{
+		memoryStorage: newMemoryStorage(),
+		failed:        map[string]bool{"cluster-a/config/db-config-2.sql.gzip": true},
+	}
+
+	srv := NewService(&fakeDbProvider{}, store, nil, configuration.Configuration{
+		Db: configuration.DbConfiguration{
+			Name:    "cluster-a",
+			DumpDir: t.TempDir(),
+		},
+		Storage: configuration.StorageConfiguration{
+			DirTemplate: "{{.Source}}/{{.DbName}}",
+			MaxFiles:    1,
+		},
+	})
+
+	settings, err := srv.getDatabaseSettings("config")
+	assert.NoError(t, err)
+
+	uploadedAt := time.Now().UTC()
+	createdAt := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	var files []storage.File
+
+	for i := 1; i <= 3; i++ {
+		key := fmt.Sprintf("cluster-a/config/db-config-%v.sql.gzip", i)
+		store.put(key, []byte("dump"), createdAt.Add(time.Duration(i)*time.Hour))
+		files = append(files, storage.File{AbsolutePath: key, CreatedAt: createdAt.Add(time.Duration(i) * time.Hour)})
+
+		assert.NoError(t, srv.updateManifest(context.TODO(), settings, &common.Job{
+			DatabaseName:        "config",
+			StorageFileLocation: key,
+			UploadEndedAt:       &uploadedAt,
+		}))
+	}
+
+	job := &common.Job{DatabaseName: "config"}
+	assert.Error(t, srv.applyRetention(context.TODO(), job, settings, files))
+	assert.Equal(t, []string{"cluster-a/config/db-config-1.sql.gzip"}, job.RemovedFiles)
+
+	assert.NoError(t, srv.updateManifest(context.TODO(), settings, job))
+
+	m, err := manifest.Load(context.TODO(), store, "cluster-a/config/manifest-config.json")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		"cluster-a/config/db-config-2.sql.gzip",
+		"cluster-a/config/db-config-3.sql.gzip",
+	}, lo.Map(m.Backups, func(e manifest.Entry, _ int) string {
+		return e.Key
+	}))
+}
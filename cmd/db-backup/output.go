@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"text/tabwriter"
+	"time"
+
+	"github.com/cockroachdb/errors"
+
+	"github.com/skynet2/db-backup/pkg/common"
+)
+
+type backupFileOutput struct {
+	Key       string    `json:"key"`
+	CreatedAt time.Time `json:"created_at"`
+	Size      int64     `json:"size"`
+}
+
+type backupListOutput struct {
+	Source   string             `json:"source"`
+	Database string             `json:"database"`
+	Backups  []backupFileOutput `json:"backups"`
+	Error    string             `json:"error,omitempty"`
+}
+
+func writeJSON(w io.Writer, value any) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+
+	return errors.WithStack(encoder.Encode(value))
+}
+
+func toBackupListOutputs(lists []BackupList) []backupListOutput {
+	outputs := make([]backupListOutput, 0, len(lists))
+
+	for _, l := range lists {
+		o := backupListOutput{
+			Source:   l.Source,
+			Database: l.Database,
+			Backups:  []backupFileOutput{},
+		}
+
+		for _, f := range l.Files {
+			o.Backups = append(o.Backups, backupFileOutput{
+				Key:       f.AbsolutePath,
+				CreatedAt: f.CreatedAt,
+				Size:      f.Size,
+			})
+		}
+
+		if l.Error != nil {
+			o.Error = l.Error.Error()
+		}
+
+		outputs = append(outputs, o)
+	}
+
+	return outputs
+}
+
+func printBackupLists(w io.Writer, lists []BackupList) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	now := time.Now().UTC()
+
+	_, _ = fmt.Fprintln(tw, "SOURCE\tDATABASE\tKEY\tSIZE\tAGE")
+
+	for _, l := range lists {
+		if l.Error != nil {
+			_, _ = fmt.Fprintf(tw, "%v\t%v\terror: %v\t\t\n", l.Source, l.Database, l.Error)
+			continue
+		}
+
+		for _, f := range l.Files {
+			_, _ = fmt.Fprintf(tw, "%v\t%v\t%v\t%v\t%v\n", l.Source, l.Database, f.AbsolutePath,
+				common.ByteCountSI(f.Size), now.Sub(f.CreatedAt).Truncate(time.Minute))
+		}
+	}
+
+	return errors.WithStack(tw.Flush())
+}
+
+func printPrune(w io.Writer, jobs []common.Job) {
+	for _, j := range jobs {
+		_, _ = fmt.Fprintf(w, "[%v] %v\n", j.SourceName, j.DatabaseName)
+
+		for _, f := range j.RemovedFiles {
+			_, _ = fmt.Fprintf(w, "  remove %v\n", f)
+		}
+
+		for _, f := range j.LockedFiles {
+			_, _ = fmt.Fprintf(w, "  locked %v\n", f)
+		}
+
+		if j.Error != nil {
+			_, _ = fmt.Fprintf(w, "  error: %v\n", j.Error)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/cockroachdb/errors"
+	"github.com/rs/zerolog"
+
+	"github.com/skynet2/db-backup/pkg/common"
+	"github.com/skynet2/db-backup/pkg/storage"
+)
+
+// plan resolves what the backup run would do for each database without dump, upload and removal.
+// RemovedFiles of returned jobs contain files which would be removed by retention.
+func (s *Service) plan(ctx context.Context, dbs []string) []common.Job {
+	var jobs []common.Job
+
+	for _, db := range dbs {
+		job := common.Job{
+			SourceName:   s.cfg.Db.Name,
+			DatabaseName: db,
+			StartedAt:    time.Now().UTC(),
+		}
+
+		job.Error = s.planJob(ctx, &job)
+		job.EndAt = time.Now().UTC()
+
+		jobs = append(jobs, job)
+	}
+
+	return jobs
+}
+
+func (s *Service) planJob(ctx context.Context, job *common.Job) error {
+	settings, err := s.getDatabaseSettings(job.DatabaseName)
+
+	if err != nil {
+		return err
+	}
+
+	host, err := s.dbProvider.SelectHost(ctx)
+
+	if err != nil {
+		return err
+	}
+
+	job.DatabaseHost = host
+
+	if err = s.collectDatabaseStats(ctx, job); err != nil {
+		if s.cfg.Db.DiskSpaceRatio > 0 {
+			return errors.Wrap(err, "can not estimate database size")
+		}
+
+		zerolog.Ctx(ctx).Warn().Err(err).Msg("can not collect database statistics")
+	}
+
+	if err = s.checkDiskSpace(ctx, *job); err != nil {
+		return err
+	}
+
+	filePrefixName, fileName, absolutePath := s.getFinalFilename(job.DatabaseName,
+		s.dbProvider.GetFileExtension(settings.backupOptions))
+
+	job.FileLocation = absolutePath
+	job.StorageProviderType = settings.storageProvider.GetType()
+
+	templatedDirRemoteDir, err := s.templateDir(settings.storage.DirTemplate, job.DatabaseName, settings.storage.Prefix)
+
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	job.StorageFileLocation = fmt.Sprintf("%v/%v", templatedDirRemoteDir, fileName)
+
+	files, err := settings.storageProvider.List(ctx, fmt.Sprintf("%v/%v", templatedDirRemoteDir, filePrefixName))
+
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	files = append(files, storage.File{ // backup which would be uploaded
+		AbsolutePath: job.StorageFileLocation,
+		CreatedAt:    time.Now().UTC(),
+	})
+
+	return s.applyRetention(ctx, job, settings, files) // only reports files in dry run
+}
+
+func printPlan(w io.Writer, jobs []common.Job) {
+	for _, j := range jobs {
+		_, _ = fmt.Fprintf(w, "[%v] %v\n", j.SourceName, j.DatabaseName)
+
+		if j.Error != nil {
+			_, _ = fmt.Fprintf(w, "  error: %v\n", j.Error)
+			continue
+		}
+
+		_, _ = fmt.Fprintf(w, "  dump from %v to %v\n", j.DatabaseHost, j.FileLocation)
+		_, _ = fmt.Fprintf(w, "  upload to %v: %v\n", j.StorageProviderType, j.StorageFileLocation)
+
+		for _, f := range j.RemovedFiles {
+			_, _ = fmt.Fprintf(w, "  remove %v\n", f)
+		}
+	}
+}
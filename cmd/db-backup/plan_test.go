@@ -0,0 +1,47 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/skynet2/db-backup/pkg/configuration"
+)
+
+func TestPlanDoesNotChangeStorage(t *testing.T) {
+	store := newMemoryStorage()
+	now := time.Now().UTC()
+
+	store.put("cluster-a/config/db-config-2024_05_08-12_00_00.sql.gzip", nil, now.Add(-48*time.Hour))
+	store.put("cluster-a/config/db-config-2024_05_09-12_00_00.sql.gzip", nil, now.Add(-24*time.Hour))
+
+	provider := &fakeDbProvider{}
+	srv := NewService(provider, store, nil, configuration.Configuration{
+		DryRun: true,
+		Db: configuration.DbConfiguration{
+			Name:    "cluster-a",
+			DumpDir: "/tmp",
+		},
+		Storage: configuration.StorageConfiguration{
+			DirTemplate: "{{.Source}}/{{.DbName}}",
+			MaxFiles:    2,
+		},
+	})
+
+	jobs := srv.plan(context.TODO(), []string{"config"})
+	assert.Len(t, jobs, 1)
+	assert.NoError(t, jobs[0].Error)
+	assert.Equal(t, "replica.local", jobs[0].DatabaseHost)
+	assert.Equal(t, []string{"cluster-a/config/db-config-2024_05_08-12_00_00.sql.gzip"}, jobs[0].RemovedFiles)
+	assert.Contains(t, jobs[0].StorageFileLocation, "cluster-a/config/db-config-")
+
+	assert.Equal(t, 0, provider.calls)
+	assert.Len(t, store.files, 2)
+
+	var out bytes.Buffer
+	printPlan(&out, jobs)
+	assert.Contains(t, out.String(), "remove cluster-a/config/db-config-2024_05_08-12_00_00.sql.gzip")
+}
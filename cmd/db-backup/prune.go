@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/cockroachdb/errors"
+	"github.com/hashicorp/go-multierror"
+
+	"github.com/skynet2/db-backup/pkg/common"
+)
+
+// Prune applies retention to existing backups of each selected database without creating new ones.
+func (s *Service) Prune(ctx context.Context) ([]common.Job, error) {
+	if err := s.validate(ctx); err != nil {
+		return nil, err
+	}
+
+	dbs, err := s.resolveDatabases(ctx)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var jobs []common.Job
+
+	for _, db := range dbs {
+		job := common.Job{
+			SourceName:   s.cfg.Db.Name,
+			DatabaseName: db,
+			StartedAt:    time.Now().UTC(),
+		}
+
+		job.Error = s.pruneDatabase(ctx, &job)
+		job.EndAt = time.Now().UTC()
+
+		jobs = append(jobs, job)
+	}
+
+	return jobs, nil
+}
+
+func (s *Service) pruneDatabase(ctx context.Context, job *common.Job) error {
+	settings, err := s.getDatabaseSettings(job.DatabaseName)
+
+	if err != nil {
+		return err
+	}
+
+	job.StorageProviderType = settings.storageProvider.GetType()
+
+	prefix, err := s.getRemotePrefix(settings, job.DatabaseName)
+
+	if err != nil {
+		return err
+	}
+
+	files, err := settings.storageProvider.List(ctx, prefix)
+
+	if err != nil {
+		return err
+	}
+
+	retentionErr := s.applyRetention(ctx, job, settings, files)
+
+	if err = s.updateManifest(ctx, settings, job); err != nil {
+		retentionErr = multierror.Append(retentionErr, errors.Wrap(err, "can not update manifest"))
+	}
+
+	return retentionErr
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/skynet2/db-backup/pkg/common"
+	"github.com/skynet2/db-backup/pkg/configuration"
+)
+
+func TestPruneDatabase(t *testing.T) {
+	store := newMemoryStorage()
+	now := time.Now().UTC()
+
+	store.put("cluster-a/config/db-config-2024_05_08-12_00_00.sql.gzip", nil, now.Add(-3*time.Hour))
+	store.put("cluster-a/config/db-config-2024_05_09-12_00_00.sql.gzip", nil, now.Add(-2*time.Hour))
+	store.put("cluster-a/config/db-config-2024_05_10-12_00_00.sql.gzip", nil, now.Add(-1*time.Hour))
+
+	cfg := configuration.Configuration{
+		DryRun: true,
+		Db: configuration.DbConfiguration{
+			Name: "cluster-a",
+		},
+		Storage: configuration.StorageConfiguration{
+			DirTemplate: "{{.Source}}/{{.DbName}}",
+			MaxFiles:    2,
+		},
+	}
+
+	job := common.Job{DatabaseName: "config"}
+	assert.NoError(t, NewService(nil, store, nil, cfg).pruneDatabase(context.TODO(), &job))
+	assert.Equal(t, []string{"cluster-a/config/db-config-2024_05_08-12_00_00.sql.gzip"}, job.RemovedFiles)
+	assert.Len(t, store.files, 3)
+
+	cfg.DryRun = false
+
+	job = common.Job{DatabaseName: "config"}
+	assert.NoError(t, NewService(nil, store, nil, cfg).pruneDatabase(context.TODO(), &job))
+	assert.Equal(t, []string{"cluster-a/config/db-config-2024_05_08-12_00_00.sql.gzip"}, job.RemovedFiles)
+	assert.Len(t, store.files, 3) // 2 backups + manifest
+	assert.Contains(t, store.files, "cluster-a/config/manifest-config.json")
+}
+
+func TestPruneDatabaseSkipsLockedFiles(t *testing.T) {
+	store := newMemoryStorage()
+	now := time.Now().UTC()
+
+	store.put("cluster-a/config/db-config-2024_05_08-12_00_00.sql.gzip", nil, now.Add(-3*time.Hour))
+	store.put("cluster-a/config/db-config-2024_05_09-12_00_00.sql.gzip", nil, now.Add(-2*time.Hour))
+	store.put("cluster-a/config/db-config-2024_05_10-12_00_00.sql.gzip", nil, now.Add(-1*time.Hour))
+	store.locked = map[string]bool{"cluster-a/config/db-config-2024_05_08-12_00_00.sql.gzip": true}
+
+	cfg := configuration.Configuration{
+		Db: configuration.DbConfiguration{
+			Name: "cluster-a",
+		},
+		Storage: configuration.StorageConfiguration{
+			DirTemplate: "{{.Source}}/{{.DbName}}",
+			MaxFiles:    1,
+		},
+	}
+
+	job := common.Job{DatabaseName: "config"}
+	assert.NoError(t, NewService(nil, store, nil, cfg).pruneDatabase(context.TODO(), &job))
+	assert.Equal(t, []string{"cluster-a/config/db-config-2024_05_09-12_00_00.sql.gzip"}, job.RemovedFiles)
+	assert.Equal(t, []string{"cluster-a/config/db-config-2024_05_08-12_00_00.sql.gzip"}, job.LockedFiles)
+	assert.Contains(t, store.files, "cluster-a/config/db-config-2024_05_08-12_00_00.sql.gzip")
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+
+	"github.com/cockroachdb/errors"
+	"github.com/hashicorp/go-multierror"
+	"github.com/rs/zerolog"
+
+	"github.com/skynet2/db-backup/pkg/configuration"
+	"github.com/skynet2/db-backup/pkg/report"
+	"github.com/skynet2/db-backup/pkg/storage"
+)
+
+const defaultReportUploadDir = "reports"
+
+// writeReport writes run report to the configured file (or stdout) and uploads it to the storage.
+func writeReport(
+	ctx context.Context,
+	cfg configuration.Configuration,
+	storageProvider storage.Provider,
+	runReport report.Report,
+) error {
+	data, err := json.MarshalIndent(runReport, "", "  ")
+
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	data = append(data, '\n')
+
+	var finalErr error
+
+	switch cfg.Report.Path {
+	case "":
+	case "-":
+		if _, err = os.Stdout.Write(data); err != nil {
+			finalErr = multierror.Append(finalErr, errors.WithStack(err))
+		}
+	default:
+		if err = os.WriteFile(cfg.Report.Path, data, 0644); err != nil {
+			finalErr = multierror.Append(finalErr, errors.Wrap(err, "can not write report"))
+		}
+	}
+
+	if cfg.Report.Upload {
+		if err = uploadReport(ctx, cfg, storageProvider, runReport, data); err != nil {
+			finalErr = multierror.Append(finalErr, errors.Wrap(err, "can not upload report"))
+		}
+	}
+
+	return finalErr
+}
+
+func uploadReport(
+	ctx context.Context,
+	cfg configuration.Configuration,
+	storageProvider storage.Provider,
+	runReport report.Report,
+	data []byte,
+) error {
+	key := path.Join(getReportUploadDir(cfg), fmt.Sprintf("report-%v.json", runReport.StartedAt.Format(backupTimeFormat)))
+
+	zerolog.Ctx(ctx).Info().Msgf("uploading report to %v", key)
+
+	return storage.UploadBytes(ctx, storageProvider, key, data, cfg.Db.DumpDir, storage.UploadOptions{})
+}
+
+// getReportUploadDir returns report.upload_dir, by default reports are stored under storage.prefix
+// the same way as the lock.
+func getReportUploadDir(cfg configuration.Configuration) string {
+	if len(cfg.Report.UploadDir) > 0 {
+		return cfg.Report.UploadDir
+	}
+
+	return path.Join(cfg.Storage.Prefix, defaultReportUploadDir)
+}
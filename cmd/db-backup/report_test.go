@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/skynet2/db-backup/pkg/common"
+	"github.com/skynet2/db-backup/pkg/configuration"
+	"github.com/skynet2/db-backup/pkg/report"
+)
+
+func TestWriteReport(t *testing.T) {
+	dir := t.TempDir()
+	store := newMemoryStorage()
+	startedAt := time.Date(2024, 5, 10, 12, 0, 0, 0, time.UTC)
+
+	runReport := report.New(backupCommand, false, startedAt, []common.Job{
+		{SourceName: "cluster-a", DatabaseName: "config"},
+	})
+
+	assert.NoError(t, writeReport(context.TODO(), configuration.Configuration{
+		Db: configuration.DbConfiguration{
+			DumpDir: dir,
+		},
+		Report: configuration.ReportConfiguration{
+			Path:   filepath.Join(dir, "report.json"),
+			Upload: true,
+		},
+	}, store, runReport))
+
+	data, err := os.ReadFile(filepath.Join(dir, "report.json"))
+	assert.NoError(t, err)
+
+	var decoded report.Report
+	assert.NoError(t, json.Unmarshal(data, &decoded))
+	assert.Equal(t, report.StatusSuccess, decoded.Status)
+	assert.Equal(t, "config", decoded.Jobs[0].Database)
+
+	assert.Equal(t, data, store.files["reports/report-2024_05_10-12_00_00.json"])
+}
+
+func TestWriteReportUploadsUnderPrefix(t *testing.T) {
+	store := newMemoryStorage()
+	startedAt := time.Date(2024, 5, 10, 12, 0, 0, 0, time.UTC)
+
+	runReport := report.New(backupCommand, false, startedAt, []common.Job{
+		{SourceName: "cluster-a", DatabaseName: "config"},
+	})
+
+	assert.NoError(t, writeReport(context.TODO(), configuration.Configuration{
+		Db: configuration.DbConfiguration{
+			DumpDir: t.TempDir(),
+		},
+		Storage: configuration.StorageConfiguration{
+			Prefix: "team-a",
+		},
+		Report: configuration.ReportConfiguration{
+			Upload: true,
+		},
+	}, store, runReport))
+
+	assert.Contains(t, store.files, "team-a/reports/report-2024_05_10-12_00_00.json")
+}
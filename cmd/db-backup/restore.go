@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	"github.com/cockroachdb/errors"
+	"github.com/rs/zerolog"
+
+	"github.com/skynet2/db-backup/pkg/common"
+	"github.com/skynet2/db-backup/pkg/manifest"
+)
+
+// RestoreOptions describes which backup should be restored and where.
+type RestoreOptions struct {
+	Database       string // database name used in backup file names
+	File           string // storage key, latest backup of Database if empty
+	TargetDatabase string // Database if empty
+	DownloadPath   string // only download backup into this path
+}
+
+// Restore downloads backup from the storage and restores it into the target database.
+func (s *Service) Restore(ctx context.Context, opts RestoreOptions) common.Job {
+	job := common.Job{
+		SourceName:   s.cfg.Db.Name,
+		DatabaseName: opts.Database,
+		StartedAt:    time.Now().UTC(),
+	}
+
+	job.Error = s.restore(ctx, &job, opts)
+	job.EndAt = time.Now().UTC()
+
+	return job
+}
+
+func (s *Service) restore(ctx context.Context, job *common.Job, opts RestoreOptions) error {
+	if len(opts.Database) == 0 {
+		return errors.New("database is required for restore")
+	}
+
+	settings, err := s.getDatabaseSettings(opts.Database)
+
+	if err != nil {
+		return err
+	}
+
+	job.StorageProviderType = settings.storageProvider.GetType()
+	job.StorageFileLocation = opts.File
+
+	if len(job.StorageFileLocation) == 0 {
+		files, listErr := s.listDatabaseBackups(ctx, opts.Database)
+
+		if listErr != nil {
+			return listErr
+		}
+
+		if len(files) == 0 {
+			return errors.New(fmt.Sprintf("no backups found for database %v", opts.Database))
+		}
+
+		job.StorageFileLocation = files[len(files)-1].AbsolutePath
+	}
+
+	job.FileLocation = opts.DownloadPath
+
+	if len(job.FileLocation) == 0 {
+		job.FileLocation = filepath.Join(s.cfg.Db.DumpDir, path.Base(job.StorageFileLocation))
+	}
+
+	expectedChecksum, err := s.getBackupChecksum(ctx, settings, opts.Database, job.StorageFileLocation)
+
+	if err != nil {
+		return err
+	}
+
+	zerolog.Ctx(ctx).Info().Msgf("downloading %v to %v", job.StorageFileLocation, job.FileLocation)
+
+	if err = s.download(ctx, settings, job); err != nil {
+		return err
+	}
+
+	if len(expectedChecksum) == 0 {
+		zerolog.Ctx(ctx).Warn().Msgf("no checksum of %v in the manifest, downloaded file is not verified",
+			job.StorageFileLocation)
+	} else if job.Checksum != expectedChecksum {
+		_ = os.Remove(job.FileLocation)
+
+		return errors.New(fmt.Sprintf("downloaded backup %v has checksum %v, expected %v",
+			job.StorageFileLocation, job.Checksum, expectedChecksum))
+	}
+
+	if len(opts.DownloadPath) > 0 {
+		return nil
+	}
+
+	defer func() {
+		_ = os.Remove(job.FileLocation)
+	}()
+
+	targetDatabase := opts.TargetDatabase
+
+	if len(targetDatabase) == 0 {
+		targetDatabase = opts.Database
+	}
+
+	zerolog.Ctx(ctx).Info().Msgf("restoring %v into database %v", job.StorageFileLocation, targetDatabase)
+
+	job.DatabaseBackupStartedAt = time.Now().UTC()
+	job.Output, err = s.dbProvider.RestoreDatabase(ctx, targetDatabase, job.FileLocation)
+	job.DatabaseBackupEndedAt = time.Now().UTC()
+
+	return err
+}
+
+// getBackupChecksum returns sha256 of the backup recorded in the database manifest, empty if it is not recorded.
+func (s *Service) getBackupChecksum(
+	ctx context.Context,
+	settings databaseSettings,
+	dbName string,
+	key string,
+) (string, error) {
+	manifestKey, err := s.getManifestKey(settings, dbName)
+
+	if err != nil {
+		return "", err
+	}
+
+	m, err := manifest.Load(ctx, settings.storageProvider, manifestKey)
+
+	if err != nil {
+		return "", err
+	}
+
+	for _, entry := range m.Backups {
+		if entry.Key == key && entry.ChecksumAlgorithm == checksumAlgorithm {
+			return entry.Checksum, nil
+		}
+	}
+
+	return "", nil
+}
+
+// download writes backup into job.FileLocation and calculates its sha256 while writing.
+func (s *Service) download(ctx context.Context, settings databaseSettings, job *common.Job) error {
+	file, err := os.Create(job.FileLocation)
+
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	checksum := sha256.New()
+
+	if err = settings.storageProvider.Download(ctx, job.StorageFileLocation, io.MultiWriter(file, checksum)); err != nil {
+		_ = file.Close()
+		_ = os.Remove(job.FileLocation)
+
+		return err
+	}
+
+	if info, statErr := file.Stat(); statErr == nil {
+		job.FileSize = info.Size()
+	}
+
+	job.Checksum = hex.EncodeToString(checksum.Sum(nil))
+
+	return errors.WithStack(file.Close())
+}
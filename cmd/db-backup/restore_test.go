@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/skynet2/db-backup/pkg/configuration"
+	"github.com/skynet2/db-backup/pkg/manifest"
+)
+
+func TestRestoreDownloadsLatestBackup(t *testing.T) {
+	store := newMemoryStorage()
+	now := time.Now().UTC()
+
+	store.put("cluster-a/config/db-config-2024_05_09-12_00_00.sql.gzip", []byte("old"), now.Add(-2*time.Hour))
+	store.put("cluster-a/config/db-config-2024_05_10-12_00_00.sql.gzip", []byte("latest"), now.Add(-1*time.Hour))
+
+	srv := NewService(nil, store, nil, configuration.Configuration{
+		Db: configuration.DbConfiguration{
+			Name: "cluster-a",
+		},
+		Storage: configuration.StorageConfiguration{
+			DirTemplate: "{{.Source}}/{{.DbName}}",
+		},
+	})
+
+	target := filepath.Join(t.TempDir(), "backup.sql.gzip")
+
+	job := srv.Restore(context.TODO(), RestoreOptions{
+		Database:     "config",
+		DownloadPath: target,
+	})
+	assert.NoError(t, job.Error)
+	assert.Equal(t, "cluster-a/config/db-config-2024_05_10-12_00_00.sql.gzip", job.StorageFileLocation)
+	assert.EqualValues(t, 6, job.FileSize)
+
+	data, err := os.ReadFile(target)
+	assert.NoError(t, err)
+	assert.Equal(t, "latest", string(data))
+
+	job = srv.Restore(context.TODO(), RestoreOptions{
+		Database:     "missing",
+		DownloadPath: target,
+	})
+	assert.ErrorContains(t, job.Error, "no backups found")
+}
+
+func TestRestoreVerifiesChecksum(t *testing.T) {
+	store := newMemoryStorage()
+	now := time.Now().UTC()
+	key := "cluster-a/config/db-config-2024_05_10-12_00_00.sql.gzip"
+
+	store.put(key, []byte("latest"), now.Add(-1*time.Hour))
+
+	srv := NewService(nil, store, nil, configuration.Configuration{
+		Db: configuration.DbConfiguration{
+			Name:    "cluster-a",
+			DumpDir: t.TempDir(),
+		},
+		Storage: configuration.StorageConfiguration{
+			DirTemplate: "{{.Source}}/{{.DbName}}",
+		},
+	})
+
+	sum := sha256.Sum256([]byte("latest"))
+	m := manifest.Manifest{Backups: []manifest.Entry{{
+		Key:               key,
+		Checksum:          hex.EncodeToString(sum[:]),
+		ChecksumAlgorithm: checksumAlgorithm,
+	}}}
+	assert.NoError(t, manifest.Save(context.TODO(), store, "cluster-a/config/manifest-config.json", t.TempDir(), m))
+
+	target := filepath.Join(t.TempDir(), "backup.sql.gzip")
+
+	job := srv.Restore(context.TODO(), RestoreOptions{
+		Database:     "config",
+		DownloadPath: target,
+	})
+	assert.NoError(t, job.Error)
+	assert.Equal(t, hex.EncodeToString(sum[:]), job.Checksum)
+
+	store.put(key, []byte("corrupted"), now.Add(-1*time.Hour))
+
+	job = srv.Restore(context.TODO(), RestoreOptions{
+		Database:     "config",
+		DownloadPath: target,
+	})
+	assert.ErrorContains(t, job.Error, "checksum")
+	assert.NoFileExists(t, target)
+}
@@ -7,72 +7,161 @@ import (
 	"html/template"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 
+	"github.com/avast/retry-go"
 	"github.com/cockroachdb/errors"
 	"github.com/hashicorp/go-multierror"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
+	"github.com/samber/lo"
 	"golang.org/x/exp/slices"
 
 	"github.com/skynet2/db-backup/pkg/common"
 	"github.com/skynet2/db-backup/pkg/configuration"
 	"github.com/skynet2/db-backup/pkg/database"
+	"github.com/skynet2/db-backup/pkg/hooks"
 	"github.com/skynet2/db-backup/pkg/storage"
 )
 
+const backupTimeFormat = "2006_01_02-15_04_05"
+
+const (
+	onInsufficientSpaceSkip = "skip"
+	onInsufficientSpaceFail = "fail"
+)
+
+// errInsufficientSpace marks databases which do not fit into free space of dump_dir.
+var errInsufficientSpace = errors.New("insufficient disk space")
+
+// errSuspiciousDump marks dumps which are much smaller than the database or the previous backup.
+var errSuspiciousDump = errors.New("suspiciously small dump")
+
 type Service struct {
 	dbProvider      database.Provider
 	storageProvider storage.Provider
+	destinations    map[string]storage.Provider
+	hooks           hooks.Service
 	cfg             configuration.Configuration
+	freeSpace       func(dir string) (int64, error)
+}
+
+// databaseSettings is the effective configuration for a single database (global configuration + overrides)
+type databaseSettings struct {
+	storageProvider storage.Provider
+	storage         configuration.StorageConfiguration
+	backupOptions   database.BackupOptions
+	timeout         time.Duration
+	dumpTimeout     time.Duration
+	dumpRetries     int
+	dumpRetryDelay  time.Duration
 }
 
 func NewService(
 	dbProvider database.Provider,
 	storageProvider storage.Provider,
+	destinations map[string]storage.Provider,
 	cfg configuration.Configuration,
 ) *Service {
+	hooksCfg := cfg.Hooks
+
+	if cfg.DryRun { // hooks have side effects
+		hooksCfg = configuration.HooksConfiguration{}
+	}
+
 	return &Service{
 		dbProvider:      dbProvider,
 		storageProvider: storageProvider,
+		destinations:    destinations,
+		hooks:           hooks.NewDefaultService(hooksCfg),
 		cfg:             cfg,
+		freeSpace:       common.FreeSpace,
 	}
 }
 
 func (s *Service) Process(ctx context.Context) ([]common.Job, error) {
-	if err := s.validate(ctx); err != nil {
-		return nil, err
+	runData := hooks.Data{
+		Source: s.cfg.Db.Name,
 	}
 
-	dbs, err := s.dbProvider.ListDatabase(ctx)
+	hookCtx := context.WithoutCancel(ctx) // hooks have own timeout and should run even if the run was cancelled
 
-	zerolog.Ctx(ctx).Info().Msgf("found databases: %v", dbs)
+	defer func() { // always executed, so the hook can revert changes of before_run
+		if hookErr := s.hooks.Run(hookCtx, hooks.EventAfterRun, runData); hookErr != nil {
+			zerolog.Ctx(ctx).Err(hookErr).Send()
+		}
+	}()
+
+	jobs, err := s.process(ctx)
+
+	runData.Status = s.getRunStatus(jobs, err)
 
 	if err != nil {
+		runData.Error = err
+
+		if hookErr := s.hooks.Run(hookCtx, hooks.EventOnFailure, runData); hookErr != nil {
+			zerolog.Ctx(ctx).Err(hookErr).Send()
+		}
+
 		return nil, err
 	}
 
-	dbs = s.getDbsToBackup(dbs)
+	return jobs, nil
+}
 
-	if len(dbs) == 0 {
-		return nil, errors.New("no databases to backup")
+func (s *Service) process(ctx context.Context) ([]common.Job, error) {
+	if err := s.hooks.Run(ctx, hooks.EventBeforeRun, hooks.Data{Source: s.cfg.Db.Name}); err != nil {
+		return nil, err
+	}
+
+	if err := s.validate(ctx); err != nil {
+		return nil, err
+	}
+
+	dbs, err := s.resolveDatabases(ctx)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if s.cfg.DryRun {
+		return s.plan(ctx, dbs), nil
 	}
 
 	var finalErrors error
 	var jobs []common.Job
 
+	var stopReason error
+
 	jobName := "todo"
 	for _, db := range dbs {
+		if stopReason != nil {
+			jobs = append(jobs, common.Job{
+				SourceName:   s.cfg.Db.Name,
+				DatabaseName: db,
+				StartedAt:    time.Now().UTC(),
+				EndAt:        time.Now().UTC(),
+				Error:        errors.Wrap(stopReason, "run stopped"),
+			})
+
+			continue
+		}
+
 		func() {
 			job := common.Job{
+				SourceName:   s.cfg.Db.Name,
 				DatabaseName: db,
 				StartedAt:    time.Now().UTC(),
 				Error:        nil,
 				FileLocation: "",
 			}
 
-			innerLogger := zerolog.Ctx(ctx).With().Str("db_name", db).Logger()
-			innerCtx, cancel := context.WithCancel(ctx)
+			settings, settingsErr := s.getDatabaseSettings(db)
+
+			innerLogger := zerolog.Ctx(ctx).With().Str("source", s.cfg.Db.Name).Str("db_name", db).Logger()
+			innerCtx, cancel := s.newJobContext(ctx, settings.timeout)
+
 			innerCtx = innerLogger.WithContext(innerCtx)
 
 			defer func() {
@@ -81,6 +170,13 @@ func (s *Service) Process(ctx context.Context) ([]common.Job, error) {
 				job.EndAt = time.Now().UTC()
 
 				if job.Error != nil {
+					// job context is already done if the job failed on timeout
+					hookCtx := context.WithoutCancel(innerCtx)
+
+					if hookErr := s.hooks.Run(hookCtx, hooks.EventOnFailure, s.getHookData(job)); hookErr != nil {
+						zerolog.Ctx(innerCtx).Err(hookErr).Send()
+					}
+
 					zerolog.Ctx(innerCtx).Err(job.Error).Send()
 					failTotalCounter.WithLabelValues(jobName).Inc()
 					failPerDbCounter.WithLabelValues(jobName, db).Inc()
@@ -92,7 +188,35 @@ func (s *Service) Process(ctx context.Context) ([]common.Job, error) {
 				jobs = append(jobs, job)
 			}()
 
-			filePrefixName, fileName, absolutePath := s.getFinalFilename(db)
+			if settingsErr != nil {
+				job.Error = settingsErr
+				return
+			}
+
+			if err := s.collectDatabaseStats(innerCtx, &job); err != nil {
+				if s.cfg.Db.DiskSpaceRatio > 0 {
+					job.Error = errors.Wrap(err, "can not estimate database size")
+					return
+				}
+
+				zerolog.Ctx(innerCtx).Warn().Err(err).Msg("can not collect database statistics")
+			}
+
+			extension := s.dbProvider.GetFileExtension(settings.backupOptions)
+			filePrefixName, fileName, absolutePath := s.getFinalFilename(db, extension)
+			interruptedDump, interruptedAt := s.findInterruptedDump(innerCtx, settings, filePrefixName, extension)
+
+			if len(interruptedDump) > 0 {
+				absolutePath, fileName = interruptedDump, filepath.Base(interruptedDump)
+			} else if err := s.checkDiskSpace(innerCtx, job); err != nil {
+				job.Error = err
+
+				if errors.Is(err, errInsufficientSpace) && s.cfg.Db.OnInsufficientSpace == onInsufficientSpaceFail {
+					stopReason = errors.Wrapf(err, "database %v", db)
+				}
+
+				return
+			}
 
 			zerolog.Ctx(innerCtx).Debug().Msgf("prefix: %v\nfileName: %v\nabsolutePath: %v",
 				filePrefixName, fileName, absolutePath)
@@ -102,21 +226,36 @@ func (s *Service) Process(ctx context.Context) ([]common.Job, error) {
 			zerolog.Ctx(innerCtx).Info().Msgf("backup for database [%v] => [%v]",
 				db, job.FileLocation)
 
-			job.DatabaseBackupStartedAt = time.Now().UTC()
+			if len(interruptedDump) > 0 {
+				zerolog.Ctx(innerCtx).Info().Msgf("continuing interrupted upload of %v, database is not dumped again",
+					interruptedDump)
 
-			if output, err := s.dbProvider.BackupDatabase(innerCtx, db, job.FileLocation); err != nil {
-				finalErrors = multierror.Append(finalErrors, err)
-				job.Error = err
-				job.Output = output
+				job.DatabaseBackupStartedAt = interruptedAt
+				job.DatabaseBackupEndedAt = interruptedAt
 
-				return // stop job
+				if info, statErr := os.Stat(interruptedDump); statErr == nil {
+					job.DatabaseBackupEndedAt = info.ModTime().UTC()
+				}
 			} else {
-				job.Output = output
+				if err := s.hooks.Run(innerCtx, hooks.EventBeforeDump, s.getHookData(job)); err != nil {
+					job.Error = err
+					return
+				}
+
+				job.DatabaseBackupStartedAt = time.Now().UTC()
+
+				if err := s.backupDatabase(innerCtx, &job, settings); err != nil {
+					finalErrors = multierror.Append(finalErrors, err)
+					job.Error = err
+
+					return // stop job
+				}
+
 				job.DatabaseBackupEndedAt = time.Now().UTC()
-			}
 
-			zerolog.Ctx(innerCtx).Info().Msgf("backup for database [%v] finished in %v", db,
-				job.DatabaseBackupEndedAt.Sub(job.DatabaseBackupStartedAt))
+				zerolog.Ctx(innerCtx).Info().Msgf("backup for database [%v] finished in %v", db,
+					job.DatabaseBackupEndedAt.Sub(job.DatabaseBackupStartedAt))
+			}
 
 			file, err := os.Open(job.FileLocation)
 
@@ -125,11 +264,24 @@ func (s *Service) Process(ctx context.Context) ([]common.Job, error) {
 				return
 			}
 
+			if info, _ := file.Stat(); info.Size() > 0 {
+				job.FileSize = info.Size()
+			}
+
+			keepDump := false
+
 			defer func() {
 				if closeErr := file.Close(); closeErr != nil {
 					job.Error = multierror.Append(job.Error, errors.WithStack(closeErr))
 				}
 
+				if keepDump {
+					zerolog.Ctx(innerCtx).Warn().Msgf("keeping local file %v, the next run continues its upload",
+						job.FileLocation)
+
+					return
+				}
+
 				zerolog.Ctx(innerCtx).Info().Msgf("removing local file copy at %v", job.FileLocation)
 
 				if delErr := os.Remove(job.FileLocation); delErr != nil {
@@ -138,10 +290,17 @@ func (s *Service) Process(ctx context.Context) ([]common.Job, error) {
 				}
 			}()
 
+			if len(interruptedDump) == 0 { // after_dump was run by the interrupted run
+				if err = s.hooks.Run(innerCtx, hooks.EventAfterDump, s.getHookData(job)); err != nil {
+					job.Error = err
+					return
+				}
+			}
+
 			n := time.Now().UTC()
-			job.StorageProviderType = s.storageProvider.GetType()
+			job.StorageProviderType = settings.storageProvider.GetType()
 			job.StorageProviderStartedAt = &n
-			templatedDirRemoteDir, err := s.templateDir(s.cfg.Storage.DirTemplate, db, s.cfg.Storage.Prefix)
+			templatedDirRemoteDir, err := s.templateDir(settings.storage.DirTemplate, db, settings.storage.Prefix)
 
 			if err != nil {
 				job.Error = errors.WithStack(err)
@@ -150,14 +309,25 @@ func (s *Service) Process(ctx context.Context) ([]common.Job, error) {
 
 			job.StorageFileLocation = fmt.Sprintf("%v/%v", templatedDirRemoteDir, fileName)
 
-			if info, _ := file.Stat(); info.Size() > 0 {
-				job.FileSize = info.Size()
+			tags, err := s.getUploadTags(settings, job)
+
+			if err != nil {
+				job.Error = err
+				return
 			}
 
 			zerolog.Ctx(innerCtx).Info().Msgf("starting upload to %v", job.StorageFileLocation)
 
-			if err = s.storageProvider.Upload(ctx, job.StorageFileLocation, file); err != nil {
+			// checksum is calculated while uploading instead of a separate read of the dump
+			if err = settings.storageProvider.Upload(innerCtx, job.StorageFileLocation, file, storage.UploadOptions{
+				Tags: tags,
+				Lock: true,
+				OnChecksum: func(checksum string) {
+					job.Checksum = checksum
+				},
+			}); err != nil {
 				job.Error = errors.WithStack(err)
+				keepDump = errors.Is(err, storage.ErrUploadInterrupted)
 
 				return
 			}
@@ -165,10 +335,15 @@ func (s *Service) Process(ctx context.Context) ([]common.Job, error) {
 			n = time.Now().UTC()
 			job.UploadEndedAt = &n
 
+			if err = s.hooks.Run(innerCtx, hooks.EventAfterUpload, s.getHookData(job)); err != nil {
+				job.Error = err
+				return
+			}
+
 			remoteKey := fmt.Sprintf("%v/%v", templatedDirRemoteDir, filePrefixName)
 			zerolog.Ctx(innerCtx).Info().Msgf("searching for files with key: %v", remoteKey)
 
-			files, err := s.storageProvider.List(ctx, remoteKey)
+			files, err := settings.storageProvider.List(innerCtx, remoteKey)
 
 			if err != nil {
 				job.Error = errors.WithStack(err)
@@ -176,19 +351,14 @@ func (s *Service) Process(ctx context.Context) ([]common.Job, error) {
 				return
 			}
 
-			filesForRemoving := s.getFilesForRemoving(innerCtx, files)
-
-			for _, toRemove := range filesForRemoving {
-				if toRemove.AbsolutePath == job.StorageFileLocation {
-					continue // should not happen
-				}
-
-				job.RemovedFiles = append(job.RemovedFiles, toRemove.AbsolutePath)
-				zerolog.Ctx(innerCtx).Info().Msgf("removing deprecated file from storage %v", toRemove.AbsolutePath)
+			if err = s.checkDumpSize(job, files); err != nil {
+				job.Error = err // previous backups are kept by retention
+			} else if err = s.applyRetention(innerCtx, &job, settings, files); err != nil {
+				job.Error = err
+			}
 
-				if err := s.storageProvider.Remove(innerCtx, toRemove.AbsolutePath); err != nil {
-					job.Error = multierror.Append(job.Error, errors.WithStack(err))
-				}
+			if err = s.updateManifest(innerCtx, settings, &job); err != nil {
+				job.Error = multierror.Append(job.Error, errors.Wrap(err, "can not update manifest"))
 			}
 		}()
 	}
@@ -204,38 +374,459 @@ func (s *Service) Process(ctx context.Context) ([]common.Job, error) {
 	return jobs, nil
 }
 
+// resolveDatabases returns databases of the source selected by include_dbs, exclude_dbs and --db filter.
+func (s *Service) resolveDatabases(ctx context.Context) ([]string, error) {
+	dbs, err := s.dbProvider.ListDatabase(ctx)
+
+	zerolog.Ctx(ctx).Info().Msgf("found databases: %v", dbs)
+
+	if err != nil {
+		return nil, err
+	}
+
+	dbs, err = s.getDbsToBackup(ctx, dbs)
+
+	if err != nil {
+		return nil, err
+	}
+
+	selected, err := newDbPatterns(s.cfg.SelectedDbs)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid --db filter")
+	}
+
+	if len(selected) > 0 {
+		dbs = lo.Filter(dbs, func(db string, _ int) bool {
+			return matchAnyPattern(selected, db)
+		})
+	}
+
+	if len(dbs) == 0 {
+		return nil, errors.New("no databases to backup")
+	}
+
+	return dbs, nil
+}
+
+// applyRetention removes backups above max_files and wal older than the oldest retained base backup.
+// In dry run mode files are only reported in job.RemovedFiles.
+func (s *Service) applyRetention(
+	ctx context.Context,
+	job *common.Job,
+	settings databaseSettings,
+	files []storage.File,
+) error {
+	var finalErr error
+
+	filesForRemoving := s.getFilesForRemoving(ctx, files, settings.storage.MaxFiles)
+	removed := map[string]bool{}
+
+	for _, toRemove := range filesForRemoving {
+		if toRemove.AbsolutePath == job.StorageFileLocation {
+			continue // should not happen
+		}
+
+		if s.cfg.DryRun {
+			job.RemovedFiles = append(job.RemovedFiles, toRemove.AbsolutePath)
+			removed[toRemove.AbsolutePath] = true
+			continue
+		}
+
+		zerolog.Ctx(ctx).Info().Msgf("removing deprecated file from storage %v", toRemove.AbsolutePath)
+
+		err := settings.storageProvider.Remove(ctx, toRemove.AbsolutePath)
+
+		if errors.Is(err, storage.ErrObjectLocked) {
+			zerolog.Ctx(ctx).Warn().Msgf("skipping removal of locked file %v", toRemove.AbsolutePath)
+			job.LockedFiles = append(job.LockedFiles, toRemove.AbsolutePath)
+
+			continue
+		}
+
+		if err != nil {
+			finalErr = multierror.Append(finalErr, errors.WithStack(err))
+			continue
+		}
+
+		job.RemovedFiles = append(job.RemovedFiles, toRemove.AbsolutePath)
+		removed[toRemove.AbsolutePath] = true
+	}
+
+	if job.DatabaseName == database.PhysicalBackupName && s.cfg.Wal.Prune {
+		retained := lo.Filter(files, func(f storage.File, _ int) bool {
+			return !removed[f.AbsolutePath]
+		})
+
+		removedWal, lockedWal, walErr := s.pruneWal(ctx, settings, retained)
+
+		job.RemovedFiles = append(job.RemovedFiles, removedWal...)
+		job.LockedFiles = append(job.LockedFiles, lockedWal...)
+
+		if walErr != nil {
+			finalErr = multierror.Append(finalErr, walErr)
+		}
+	}
+
+	if cleaner, ok := settings.storageProvider.(storage.UploadCleaner); ok && !s.cfg.DryRun {
+		s.cleanupIncompleteUploads(ctx, cleaner, settings, job.DatabaseName)
+	}
+
+	return finalErr
+}
+
+// cleanupIncompleteUploads aborts uploads left by crashed runs. Failures are only logged,
+// as they do not affect existing backups.
+func (s *Service) cleanupIncompleteUploads(
+	ctx context.Context,
+	cleaner storage.UploadCleaner,
+	settings databaseSettings,
+	dbName string,
+) {
+	prefix, err := s.getRemotePrefix(settings, dbName)
+
+	if err != nil {
+		zerolog.Ctx(ctx).Warn().Err(err).Msg("can not cleanup incomplete uploads")
+		return
+	}
+
+	aborted, err := cleaner.CleanupIncompleteUploads(ctx, prefix)
+
+	for _, key := range aborted {
+		zerolog.Ctx(ctx).Info().Msgf("aborted incomplete upload of %v", key)
+	}
+
+	if err != nil {
+		zerolog.Ctx(ctx).Warn().Err(err).Msg("can not cleanup incomplete uploads")
+	}
+}
+
+// getRemotePrefix returns storage key prefix of all backups of the database.
+func (s *Service) getRemotePrefix(settings databaseSettings, dbName string) (string, error) {
+	templatedDirRemoteDir, err := s.templateDir(settings.storage.DirTemplate, dbName, settings.storage.Prefix)
+
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+
+	filePrefixName, _, _ := s.getFinalFilename(dbName, "")
+
+	return fmt.Sprintf("%v/%v", templatedDirRemoteDir, filePrefixName), nil
+}
+
+// backupDatabase executes dump with dump_timeout per attempt and retries transient errors with backoff.
+// Database host is selected before each attempt.
+func (s *Service) backupDatabase(ctx context.Context, job *common.Job, settings databaseSettings) error {
+	return retry.Do(func() error {
+		job.DumpAttempts += 1
+
+		host, err := s.dbProvider.SelectHost(ctx) // replica health can change between attempts
+
+		if err != nil {
+			return err
+		}
+
+		job.DatabaseHost = host
+		opts := settings.backupOptions
+		opts.Host = host
+
+		zerolog.Ctx(ctx).Info().Msgf("using database host %v", host)
+
+		attemptCtx, cancel := s.newJobContext(ctx, settings.dumpTimeout)
+		defer cancel()
+
+		output, err := s.dbProvider.BackupDatabase(attemptCtx, job.DatabaseName, job.FileLocation, opts)
+		job.Output = output
+
+		if err != nil {
+			s.removePartialDump(ctx, job.FileLocation) // next attempt starts from scratch
+		}
+
+		return err
+	},
+		retry.Context(ctx),
+		retry.Attempts(uint(settings.dumpRetries+1)),
+		retry.Delay(settings.dumpRetryDelay),
+		retry.DelayType(retry.BackOffDelay),
+		retry.LastErrorOnly(true),
+		retry.RetryIf(func(err error) bool {
+			return errors.Is(err, database.ErrTransient)
+		}),
+		retry.OnRetry(func(n uint, err error) {
+			zerolog.Ctx(ctx).Warn().Err(err).Msgf("transient error on dump attempt %v, retrying", n+1)
+		}),
+	)
+}
+
+// findInterruptedDump returns the newest dump of the database which upload was interrupted by a previous run
+// (the dump and the upload state are kept, see storage.ErrUploadInterrupted) and the time the dump was started.
+// Its upload is continued instead of dumping the database again. Other kept dumps and dumps older than
+// abort_incomplete_uploads_after, which uploads are aborted by the cleanup, are removed.
+func (s *Service) findInterruptedDump(
+	ctx context.Context,
+	settings databaseSettings,
+	filePrefixName string,
+	extension string,
+) (string, time.Time) {
+	dumpDir := s.cfg.Db.DumpDir
+
+	if len(dumpDir) == 0 {
+		dumpDir = "." // dumps are created in the working directory, see getFinalFilename
+	}
+
+	entries, err := os.ReadDir(dumpDir)
+
+	if err != nil {
+		zerolog.Ctx(ctx).Warn().Err(err).Msg("can not search for dumps of interrupted uploads")
+		return "", time.Time{}
+	}
+
+	maxAge := settings.storage.S3.AbortIncompleteUploadsAfter
+
+	if maxAge == 0 {
+		maxAge = storage.DefaultAbortIncompleteUploadsAfter
+	}
+
+	found := ""
+	foundAt := time.Time{}
+
+	for _, e := range entries {
+		name := e.Name()
+
+		if e.IsDir() || !strings.HasPrefix(name, filePrefixName) || !strings.HasSuffix(name, extension) {
+			continue
+		}
+
+		// prefix of db "a" also matches dumps of db "a-b"
+		createdAt, parseErr := time.Parse(backupTimeFormat,
+			strings.TrimSuffix(strings.TrimPrefix(name, filePrefixName), extension))
+		fullPath := filepath.Join(s.cfg.Db.DumpDir, name)
+
+		if parseErr != nil || !storage.HasUploadState(fullPath) {
+			continue
+		}
+
+		if maxAge > 0 && time.Since(createdAt) > maxAge {
+			s.removeInterruptedDump(ctx, fullPath)
+			continue
+		}
+
+		if len(found) > 0 && createdAt.Before(foundAt) {
+			s.removeInterruptedDump(ctx, fullPath)
+			continue
+		}
+
+		if len(found) > 0 {
+			s.removeInterruptedDump(ctx, found)
+		}
+
+		found, foundAt = fullPath, createdAt
+	}
+
+	return found, foundAt
+}
+
+// removeInterruptedDump removes kept dump and its upload state, the upload is aborted by the cleanup.
+func (s *Service) removeInterruptedDump(ctx context.Context, fileLocation string) {
+	zerolog.Ctx(ctx).Info().Msgf("removing dump of interrupted upload %v", fileLocation)
+
+	if err := os.Remove(fileLocation); err != nil && !errors.Is(err, os.ErrNotExist) {
+		zerolog.Ctx(ctx).Warn().Err(err).Msgf("can not remove dump %v", fileLocation)
+	}
+
+	if err := storage.RemoveUploadState(fileLocation); err != nil {
+		zerolog.Ctx(ctx).Warn().Err(err).Msgf("can not remove upload state of %v", fileLocation)
+	}
+}
+
+// removePartialDump removes file left by failed dump, so it does not take space of the next databases.
+func (s *Service) removePartialDump(ctx context.Context, fileLocation string) {
+	if len(fileLocation) == 0 {
+		return
+	}
+
+	if err := os.Remove(fileLocation); err != nil && !errors.Is(err, os.ErrNotExist) {
+		zerolog.Ctx(ctx).Warn().Err(err).Msgf("can not remove partial dump %v", fileLocation)
+	}
+}
+
+// collectDatabaseStats sets size of the live database and, with collect_row_counts, approximate row counts.
+func (s *Service) collectDatabaseStats(ctx context.Context, job *common.Job) error {
+	size, err := s.dbProvider.GetDatabaseSize(ctx, job.DatabaseName)
+
+	if err != nil {
+		return err
+	}
+
+	job.DatabaseSize = size
+
+	if !s.cfg.Db.CollectRowCounts {
+		return nil
+	}
+
+	if job.TableRows, err = s.dbProvider.GetTableRowCounts(ctx, job.DatabaseName); err != nil {
+		return errors.Wrap(err, "can not get row counts")
+	}
+
+	return nil
+}
+
+// checkDiskSpace fails with errInsufficientSpace if free space of dump_dir is less than
+// database size multiplied by disk_space_ratio. Check is disabled if ratio is not configured.
+func (s *Service) checkDiskSpace(ctx context.Context, job common.Job) error {
+	ratio := s.cfg.Db.DiskSpaceRatio
+
+	if ratio <= 0 {
+		return nil
+	}
+
+	dumpDir := s.cfg.Db.DumpDir
+
+	if len(dumpDir) == 0 {
+		dumpDir = "."
+	}
+
+	free, err := s.freeSpace(dumpDir)
+
+	if err != nil {
+		return err
+	}
+
+	required := int64(float64(job.DatabaseSize) * ratio)
+
+	zerolog.Ctx(ctx).Debug().Msgf("database size %v, required %v, free in %v %v",
+		common.ByteCountSI(job.DatabaseSize), common.ByteCountSI(required), dumpDir, common.ByteCountSI(free))
+
+	if required <= free {
+		return nil
+	}
+
+	return errors.Mark(errors.New(fmt.Sprintf("database %v requires %v in %v (size %v, disk_space_ratio %v), "+
+		"only %v is free", job.DatabaseName, common.ByteCountSI(required), dumpDir,
+		common.ByteCountSI(job.DatabaseSize), ratio, common.ByteCountSI(free))), errInsufficientSpace)
+}
+
+// checkDumpSize fails with errSuspiciousDump if the dump is smaller than database size * min_dump_ratio
+// or than the previous backup * min_previous_dump_ratio, ex. pg_dump silently skipped data.
+func (s *Service) checkDumpSize(job common.Job, files []storage.File) error {
+	if ratio := s.cfg.Db.MinDumpRatio; ratio > 0 && job.DatabaseSize > 0 &&
+		float64(job.FileSize) < float64(job.DatabaseSize)*ratio {
+		return errors.Mark(errors.New(fmt.Sprintf("dump of %v is %v, less than %v of database size %v",
+			job.DatabaseName, common.ByteCountSI(job.FileSize), ratio, common.ByteCountSI(job.DatabaseSize))),
+			errSuspiciousDump)
+	}
+
+	previous := lo.Filter(files, func(f storage.File, _ int) bool {
+		return f.AbsolutePath != job.StorageFileLocation
+	})
+
+	if len(previous) == 0 {
+		return nil
+	}
+
+	latest := previous[len(previous)-1] // files are sorted by creation time
+
+	if ratio := s.cfg.Db.MinPreviousDumpRatio; ratio > 0 && float64(job.FileSize) < float64(latest.Size)*ratio {
+		return errors.Mark(errors.New(fmt.Sprintf("dump of %v is %v, less than %v of previous backup %v (%v)",
+			job.DatabaseName, common.ByteCountSI(job.FileSize), ratio, latest.AbsolutePath,
+			common.ByteCountSI(latest.Size))), errSuspiciousDump)
+	}
+
+	return nil
+}
+
+func (s *Service) getHookData(job common.Job) hooks.Data {
+	return hooks.Data{
+		Source:       job.SourceName,
+		DatabaseName: job.DatabaseName,
+		FileLocation: job.FileLocation,
+		StorageKey:   job.StorageFileLocation,
+		FileSize:     job.FileSize,
+		Checksum:     job.Checksum,
+		Error:        job.Error,
+	}
+}
+
+func (s *Service) getRunStatus(jobs []common.Job, err error) string {
+	if err != nil {
+		return "failure"
+	}
+
+	for _, j := range jobs {
+		if j.Error != nil {
+			return "failure"
+		}
+	}
+
+	return "success"
+}
+
 func (s *Service) templateDir(
 	dirTemplate string,
 	dbName string,
 	prefix string,
 ) (string, error) {
-	compiled, err := template.New("dir").Parse(dirTemplate)
+	return s.executeTemplate(dirTemplate, s.getTemplateValues(dbName, prefix))
+}
 
-	if err != nil {
-		return "", errors.WithStack(err)
+// getUploadTags returns object tags of the backup, tag values are templates.
+func (s *Service) getUploadTags(settings databaseSettings, job common.Job) (map[string]string, error) {
+	if len(settings.storage.S3.Tags) == 0 {
+		return nil, nil
 	}
 
-	var buf bytes.Buffer
+	values := s.getTemplateValues(job.DatabaseName, settings.storage.Prefix)
+	values["DbHost"] = job.DatabaseHost
+
+	tags := map[string]string{}
+
+	for key, valueTemplate := range settings.storage.S3.Tags {
+		value, err := s.executeTemplate(valueTemplate, values)
 
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid template of tag %v", key)
+		}
+
+		tags[key] = value
+	}
+
+	return tags, nil
+}
+
+func (s *Service) getTemplateValues(dbName string, prefix string) map[string]string {
 	hostName, _ := os.Hostname()
 
 	if len(hostName) == 0 {
 		hostName = "unk"
 	}
 
-	if err = compiled.Execute(&buf, map[string]string{
+	return map[string]string{
 		"Host":   hostName,
+		"Source": s.cfg.Db.Name,
 		"DbName": dbName,
 		"Prefix": prefix,
-	}); err != nil {
+		"RunId":  s.cfg.RunId,
+	}
+}
+
+func (s *Service) executeTemplate(text string, values map[string]string) (string, error) {
+	compiled, err := template.New("value").Parse(text)
+
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+
+	var buf bytes.Buffer
+
+	if err = compiled.Execute(&buf, values); err != nil {
 		return "", errors.WithStack(err)
 	}
 
 	return buf.String(), nil
 }
 
-func (s *Service) getFilesForRemoving(ctx context.Context, files []storage.File) []storage.File {
-	filesToStore := s.cfg.Storage.MaxFiles
+func (s *Service) getFilesForRemoving(ctx context.Context, files []storage.File, maxFiles int) []storage.File {
+	filesToStore := maxFiles
 
 	if filesToStore == 0 {
 		filesToStore = 5
@@ -248,40 +839,87 @@ func (s *Service) getFilesForRemoving(ctx context.Context, files []storage.File)
 	return files[:len(files)-filesToStore]
 }
 
-func (s *Service) getFinalFilename(dbName string) (string, string, string) {
+func (s *Service) getFinalFilename(dbName string, extension string) (string, string, string) {
 	prefix := fmt.Sprintf("db-%v-", dbName)
-	fileName := fmt.Sprintf("%v%v.sql.gzip", prefix,
-		time.Now().UTC().Format("2006_01_02-15_04_05"))
+	fileName := fmt.Sprintf("%v%v%v", prefix,
+		time.Now().UTC().Format(backupTimeFormat), extension)
 
 	fullPath := filepath.Join(s.cfg.Db.DumpDir, fileName)
 
 	return prefix, fileName, fullPath
 }
 
-func (s *Service) getDbsToBackup(existingDbs []string) []string {
+func (s *Service) getDbsToBackup(ctx context.Context, existingDbs []string) ([]string, error) {
+	includePatterns, err := newDbPatterns(s.cfg.IncludeDbs)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid include_dbs")
+	}
+
+	excludePatterns, err := newDbPatterns(s.cfg.ExcludeDbs)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid exclude_dbs")
+	}
+
 	var toBackup []string
 
-	if len(s.cfg.IncludeDbs) > 0 {
-		for _, dbName := range s.cfg.IncludeDbs {
-			if !slices.Contains(existingDbs, dbName) {
-				continue
+	if len(includePatterns) > 0 {
+		var unmatched []string
+		var excluded []string
+
+		for _, pattern := range includePatterns {
+			matched := false
+
+			for _, existing := range existingDbs {
+				if !pattern.Match(existing) {
+					continue
+				}
+
+				matched = true
+
+				if slices.Contains(toBackup, existing) || slices.Contains(excluded, existing) {
+					continue
+				}
+
+				if matchAnyPattern(excludePatterns, existing) {
+					excluded = append(excluded, existing)
+					continue
+				}
+
+				toBackup = append(toBackup, existing)
+			}
+
+			if !matched {
+				unmatched = append(unmatched, pattern.String())
+			}
+		}
+
+		if len(excluded) > 0 { // exclude_dbs had no effect together with include_dbs before
+			zerolog.Ctx(ctx).Warn().Msgf("databases matched by include_dbs are skipped by exclude_dbs: %v",
+				excluded)
+		}
+
+		if len(unmatched) > 0 {
+			if s.cfg.FailOnUnmatchedInclude {
+				return nil, errors.New(fmt.Sprintf("include_dbs entries did not match any database: %v", unmatched))
 			}
 
-			toBackup = append(toBackup, dbName)
+			zerolog.Ctx(ctx).Warn().Msgf("include_dbs entries did not match any database: %v", unmatched)
 		}
 
-		return toBackup
+		return toBackup, nil
 	}
 
 	for _, existing := range existingDbs {
-		if slices.Contains(s.cfg.ExcludeDbs, existing) {
+		if matchAnyPattern(excludePatterns, existing) {
 			continue
 		}
 
 		toBackup = append(toBackup, existing)
 	}
 
-	return toBackup
+	return toBackup, nil
 }
 
 func (s *Service) validate(ctx context.Context) error {
@@ -293,5 +931,134 @@ func (s *Service) validate(ctx context.Context) error {
 		return err
 	}
 
+	for name, destination := range s.destinations {
+		if err := destination.Validate(ctx); err != nil {
+			return errors.Wrapf(err, "destination %v", name)
+		}
+	}
+
 	return nil
 }
+
+// ValidateConfiguration checks database patterns and storage templates without connecting anywhere.
+func (s *Service) ValidateConfiguration() error {
+	var finalErr error
+
+	for name, patterns := range map[string][]string{
+		"include_dbs": s.cfg.IncludeDbs,
+		"exclude_dbs": s.cfg.ExcludeDbs,
+		"--db":        s.cfg.SelectedDbs,
+	} {
+		if _, err := newDbPatterns(patterns); err != nil {
+			finalErr = multierror.Append(finalErr, errors.Wrapf(err, "invalid %v", name))
+		}
+	}
+
+	storages := map[string]configuration.StorageConfiguration{
+		configuration.DefaultDestination: s.cfg.Storage,
+	}
+
+	for name, destination := range s.cfg.Destinations {
+		storages[name] = destination
+	}
+
+	for name, storageCfg := range storages {
+		if _, err := s.templateDir(storageCfg.DirTemplate, "db", storageCfg.Prefix); err != nil {
+			finalErr = multierror.Append(finalErr, errors.Wrapf(err, "invalid dir_template of storage %v", name))
+		}
+	}
+
+	for name, override := range s.cfg.Databases {
+		if len(override.DirTemplate) == 0 {
+			continue
+		}
+
+		if _, err := s.templateDir(override.DirTemplate, name, ""); err != nil {
+			finalErr = multierror.Append(finalErr, errors.Wrapf(err, "invalid dir_template of database %v", name))
+		}
+	}
+
+	if !lo.Contains([]string{"", onInsufficientSpaceSkip, onInsufficientSpaceFail}, s.cfg.Db.OnInsufficientSpace) {
+		finalErr = multierror.Append(finalErr, errors.New(fmt.Sprintf("invalid on_insufficient_space %v, "+
+			"expected %v or %v", s.cfg.Db.OnInsufficientSpace, onInsufficientSpaceSkip, onInsufficientSpaceFail)))
+	}
+
+	if err := validateLockConfiguration(s.cfg.Lock); err != nil {
+		finalErr = multierror.Append(finalErr, err)
+	}
+
+	if s.cfg.Db.DiskSpaceRatio < 0 || s.cfg.Db.MinDumpRatio < 0 || s.cfg.Db.MinPreviousDumpRatio < 0 {
+		finalErr = multierror.Append(finalErr, errors.New("disk_space_ratio, min_dump_ratio and "+
+			"min_previous_dump_ratio should not be negative"))
+	}
+
+	if len(s.cfg.Wal.DirTemplate) > 0 {
+		if _, err := s.templateDir(s.cfg.Wal.DirTemplate, "wal", ""); err != nil {
+			finalErr = multierror.Append(finalErr, errors.Wrap(err, "invalid wal dir_template"))
+		}
+	}
+
+	return finalErr
+}
+
+func (s *Service) newJobContext(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout > 0 {
+		return context.WithTimeout(ctx, timeout)
+	}
+
+	return context.WithCancel(ctx)
+}
+
+func (s *Service) getDatabaseSettings(dbName string) (databaseSettings, error) {
+	override := s.cfg.GetDatabase(s.cfg.Db.Name, dbName)
+
+	settings := databaseSettings{
+		storageProvider: s.storageProvider,
+		storage:         s.cfg.Storage,
+		backupOptions: database.BackupOptions{
+			CompressionLevel: override.CompressionLevel,
+			Format:           override.Format,
+		},
+		timeout:        s.cfg.Db.Timeout,
+		dumpTimeout:    s.cfg.Db.DumpTimeout,
+		dumpRetries:    s.cfg.Db.DumpRetries,
+		dumpRetryDelay: s.cfg.Db.DumpRetryDelay,
+	}
+
+	if settings.dumpRetryDelay == 0 {
+		settings.dumpRetryDelay = 10 * time.Second
+	}
+
+	if destination := override.Destination; len(destination) > 0 && destination != configuration.DefaultDestination {
+		provider, ok := s.destinations[destination]
+
+		if !ok {
+			return settings, errors.New(fmt.Sprintf("no storage provider for destination %v", destination))
+		}
+
+		settings.storageProvider = provider
+		settings.storage = s.cfg.Destinations[destination]
+	}
+
+	if override.MaxFiles > 0 {
+		settings.storage.MaxFiles = override.MaxFiles
+	}
+
+	if len(override.DirTemplate) > 0 {
+		settings.storage.DirTemplate = override.DirTemplate
+	}
+
+	if override.Timeout > 0 {
+		settings.timeout = override.Timeout
+	}
+
+	if override.DumpTimeout > 0 {
+		settings.dumpTimeout = override.DumpTimeout
+	}
+
+	if override.DumpRetries != nil {
+		settings.dumpRetries = *override.DumpRetries
+	}
+
+	return settings, nil
+}
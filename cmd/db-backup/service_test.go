@@ -1,2 +1,566 @@
 package main
 
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/errors"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/skynet2/db-backup/pkg/common"
+	"github.com/skynet2/db-backup/pkg/configuration"
+	"github.com/skynet2/db-backup/pkg/database"
+	"github.com/skynet2/db-backup/pkg/hooks"
+	"github.com/skynet2/db-backup/pkg/manifest"
+	"github.com/skynet2/db-backup/pkg/storage"
+)
+
+// fakeDbProvider writes a small dump, errors are returned by consecutive dump attempts
+type fakeDbProvider struct {
+	database.Provider
+	errors []error
+	calls  int
+	size   int64
+}
+
+func (f *fakeDbProvider) Validate(_ context.Context) error {
+	return nil
+}
+
+func (f *fakeDbProvider) GetDatabaseSize(_ context.Context, _ string) (int64, error) {
+	return f.size, nil
+}
+
+func (f *fakeDbProvider) GetTableRowCounts(_ context.Context, _ string) (map[string]int64, error) {
+	return map[string]int64{"public.users": 42}, nil
+}
+
+func (f *fakeDbProvider) SelectHost(_ context.Context) (string, error) {
+	return "replica.local", nil
+}
+
+func (f *fakeDbProvider) BackupDatabase(
+	_ context.Context,
+	_ string,
+	finalFileName string,
+	_ database.BackupOptions,
+) (string, error) {
+	f.calls += 1
+
+	if len(finalFileName) > 0 {
+		_ = os.WriteFile(finalFileName, []byte("partial dump"), 0600)
+	}
+
+	if len(f.errors) < f.calls {
+		return "ok", nil
+	}
+
+	return "failed", f.errors[f.calls-1]
+}
+
+func (f *fakeDbProvider) GetFileExtension(_ database.BackupOptions) string {
+	return ".sql.gzip"
+}
+
+func (f *fakeDbProvider) ListDatabase(_ context.Context) ([]string, error) {
+	return []string{"config", "tenant_0001", "tenant_0002"}, nil
+}
+
+func (f *fakeDbProvider) GetBackupFormat(_ database.BackupOptions) database.BackupFormat {
+	return database.BackupFormat{
+		Format:           "plain",
+		Compression:      "gzip",
+		CompressionLevel: 5,
+	}
+}
+
+func TestGetDbsToBackupPatterns(t *testing.T) {
+	existing := []string{"config", "master", "tenant_0001", "tenant_0002", "tenant_test", "stats"}
+
+	srv := NewService(nil, nil, nil, configuration.Configuration{
+		IncludeDbs: []string{"config", "tenant_*", `re:^stat\w+$`},
+		ExcludeDbs: []string{"tenant_test"},
+	})
+
+	dbs, err := srv.getDbsToBackup(context.TODO(), existing)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"config", "tenant_0001", "tenant_0002", "stats"}, dbs)
+}
+
+func TestGetDbsToBackupExcludePatterns(t *testing.T) {
+	existing := []string{"config", "tenant_0001", "tenant_0002"}
+
+	srv := NewService(nil, nil, nil, configuration.Configuration{
+		ExcludeDbs: []string{`re:^tenant_\d+$`},
+	})
+
+	dbs, err := srv.getDbsToBackup(context.TODO(), existing)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"config"}, dbs)
+}
+
+func TestGetDbsToBackupWarnsAboutExcludedIncludes(t *testing.T) {
+	existing := []string{"config", "tenant_0001", "tenant_0002"}
+
+	srv := NewService(nil, nil, nil, configuration.Configuration{
+		IncludeDbs: []string{"config", "tenant_*"},
+		ExcludeDbs: []string{"tenant_0002"},
+	})
+
+	var logs bytes.Buffer
+	ctx := zerolog.New(&logs).WithContext(context.TODO())
+
+	dbs, err := srv.getDbsToBackup(ctx, existing)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"config", "tenant_0001"}, dbs)
+	assert.Contains(t, logs.String(), "skipped by exclude_dbs: [tenant_0002]")
+}
+
+func TestGetDbsToBackupUnmatchedInclude(t *testing.T) {
+	existing := []string{"config"}
+
+	srv := NewService(nil, nil, nil, configuration.Configuration{
+		IncludeDbs: []string{"config", "missing"},
+	})
+
+	dbs, err := srv.getDbsToBackup(context.TODO(), existing)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"config"}, dbs)
+
+	srv.cfg.FailOnUnmatchedInclude = true
+
+	_, err = srv.getDbsToBackup(context.TODO(), existing)
+	assert.ErrorContains(t, err, "missing")
+}
+
+func TestGetDbsToBackupInvalidRegex(t *testing.T) {
+	srv := NewService(nil, nil, nil, configuration.Configuration{
+		IncludeDbs: []string{"re:("},
+	})
+
+	_, err := srv.getDbsToBackup(context.TODO(), []string{"config"})
+	assert.Error(t, err)
+}
+
+func TestGetDatabaseSettingsOverrides(t *testing.T) {
+	noRetries := 0
+
+	srv := NewService(nil, nil, nil, configuration.Configuration{
+		Db: configuration.DbConfiguration{
+			Timeout:     time.Hour,
+			DumpRetries: 3,
+		},
+		Storage: configuration.StorageConfiguration{
+			DirTemplate: "{{.Host}}/{{.DbName}}",
+			MaxFiles:    5,
+		},
+		Databases: map[string]configuration.DatabaseOverride{
+			"analytics": {
+				MaxFiles: 2,
+				Format:   "custom",
+				Timeout:  12 * time.Hour,
+			},
+			"events": {
+				DumpRetries: &noRetries,
+			},
+		},
+	})
+
+	settings, err := srv.getDatabaseSettings("analytics")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, settings.storage.MaxFiles)
+	assert.Equal(t, "{{.Host}}/{{.DbName}}", settings.storage.DirTemplate)
+	assert.Equal(t, "custom", settings.backupOptions.Format)
+	assert.Equal(t, 12*time.Hour, settings.timeout)
+	assert.Equal(t, 3, settings.dumpRetries)
+
+	settings, err = srv.getDatabaseSettings("events")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, settings.dumpRetries)
+
+	settings, err = srv.getDatabaseSettings("config")
+	assert.NoError(t, err)
+	assert.Equal(t, 5, settings.storage.MaxFiles)
+	assert.Equal(t, time.Hour, settings.timeout)
+}
+
+func TestBackupDatabaseRetriesTransientErrors(t *testing.T) {
+	provider := &fakeDbProvider{
+		errors: []error{
+			errors.Mark(errors.New("connection reset"), database.ErrTransient),
+			errors.Mark(errors.New("lock timeout"), database.ErrTransient),
+		},
+	}
+
+	srv := NewService(provider, nil, nil, configuration.Configuration{})
+	job := common.Job{DatabaseName: "config"}
+
+	assert.NoError(t, srv.backupDatabase(context.TODO(), &job, databaseSettings{
+		dumpRetries:    2,
+		dumpRetryDelay: time.Millisecond,
+	}))
+	assert.Equal(t, 3, job.DumpAttempts)
+	assert.Equal(t, "ok", job.Output)
+	assert.Equal(t, "replica.local", job.DatabaseHost)
+}
+
+func TestBackupDatabaseDoesNotRetryPermanentErrors(t *testing.T) {
+	provider := &fakeDbProvider{
+		errors: []error{
+			errors.New("permission denied"),
+		},
+	}
+
+	srv := NewService(provider, nil, nil, configuration.Configuration{})
+	job := common.Job{DatabaseName: "config"}
+
+	assert.Error(t, srv.backupDatabase(context.TODO(), &job, databaseSettings{
+		dumpRetries:    2,
+		dumpRetryDelay: time.Millisecond,
+	}))
+	assert.Equal(t, 1, job.DumpAttempts)
+	assert.Equal(t, "failed", job.Output)
+}
+
+func TestBackupDatabaseRemovesPartialDump(t *testing.T) {
+	provider := &fakeDbProvider{
+		errors: []error{
+			errors.New("no space left on device"),
+		},
+	}
+
+	srv := NewService(provider, nil, nil, configuration.Configuration{})
+	job := common.Job{DatabaseName: "config", FileLocation: filepath.Join(t.TempDir(), "db-config.sql.gz")}
+
+	assert.Error(t, srv.backupDatabase(context.TODO(), &job, databaseSettings{}))
+	assert.NoFileExists(t, job.FileLocation)
+}
+
+func TestCheckDiskSpace(t *testing.T) {
+	cases := []struct {
+		name  string
+		ratio float64
+		size  int64
+		err   bool
+	}{
+		{name: "disabled", ratio: 0, size: 10_000},
+		{name: "fits", ratio: 0.5, size: 1_000},
+		{name: "fits exactly", ratio: 1, size: 1_000},
+		{name: "does not fit", ratio: 1.5, size: 1_000, err: true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			srv := NewService(nil, nil, nil, configuration.Configuration{
+				Db: configuration.DbConfiguration{
+					DumpDir:        "/backups",
+					DiskSpaceRatio: c.ratio,
+				},
+			})
+			srv.freeSpace = func(dir string) (int64, error) {
+				assert.Equal(t, "/backups", dir)
+				return 1_000, nil
+			}
+
+			err := srv.checkDiskSpace(context.TODO(), common.Job{DatabaseName: "config", DatabaseSize: c.size})
+			if !c.err {
+				assert.NoError(t, err)
+				return
+			}
+
+			assert.True(t, errors.Is(err, errInsufficientSpace))
+			assert.ErrorContains(t, err, "database config requires 1.5 kB in /backups")
+		})
+	}
+}
+
+func TestCollectDatabaseStats(t *testing.T) {
+	srv := NewService(&fakeDbProvider{size: 1_000_000}, nil, nil, configuration.Configuration{})
+	job := common.Job{DatabaseName: "config"}
+
+	assert.NoError(t, srv.collectDatabaseStats(context.TODO(), &job))
+	assert.Equal(t, int64(1_000_000), job.DatabaseSize)
+	assert.Nil(t, job.TableRows)
+
+	srv.cfg.Db.CollectRowCounts = true
+
+	assert.NoError(t, srv.collectDatabaseStats(context.TODO(), &job))
+	assert.Equal(t, map[string]int64{"public.users": 42}, job.TableRows)
+}
+
+func TestCheckDumpSize(t *testing.T) {
+	files := []storage.File{
+		{AbsolutePath: "db/db-config-1.sql.gzip", Size: 100},
+		{AbsolutePath: "db/db-config-2.sql.gzip", Size: 1_000},
+		{AbsolutePath: "db/db-config-3.sql.gzip", Size: 400},
+	}
+	job := common.Job{
+		DatabaseName:        "config",
+		StorageFileLocation: "db/db-config-3.sql.gzip",
+		FileSize:            400,
+		DatabaseSize:        10_000,
+	}
+
+	srv := NewService(nil, nil, nil, configuration.Configuration{})
+	assert.NoError(t, srv.checkDumpSize(job, files))
+
+	srv.cfg.Db.MinDumpRatio = 0.05
+	err := srv.checkDumpSize(job, files)
+	assert.True(t, errors.Is(err, errSuspiciousDump))
+	assert.ErrorContains(t, err, "less than 0.05 of database size 10.0 kB")
+
+	srv.cfg.Db.MinDumpRatio = 0.01
+	srv.cfg.Db.MinPreviousDumpRatio = 0.5
+	err = srv.checkDumpSize(job, files)
+	assert.True(t, errors.Is(err, errSuspiciousDump))
+	assert.ErrorContains(t, err, "previous backup db/db-config-2.sql.gzip")
+
+	srv.cfg.Db.MinPreviousDumpRatio = 0.4
+	assert.NoError(t, srv.checkDumpSize(job, files))
+	assert.NoError(t, srv.checkDumpSize(job, files[2:])) // first backup
+}
+
+func TestResolveDatabasesSelected(t *testing.T) {
+	srv := NewService(&fakeDbProvider{}, nil, nil, configuration.Configuration{
+		SelectedDbs: []string{"tenant_*"},
+		ExcludeDbs:  []string{"tenant_0002"},
+	})
+
+	dbs, err := srv.resolveDatabases(context.TODO())
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"tenant_0001"}, dbs)
+}
+
+func TestGetUploadTags(t *testing.T) {
+	srv := NewService(nil, nil, nil, configuration.Configuration{
+		RunId: "20240102T030405Z-1a2b3c4d",
+		Db: configuration.DbConfiguration{
+			Name: "main",
+		},
+	})
+
+	settings := databaseSettings{
+		storage: configuration.StorageConfiguration{
+			S3: configuration.S3Config{
+				Tags: map[string]string{
+					"database": "{{.Source}}/{{.DbName}}",
+					"host":     "{{.DbHost}}",
+					"run":      "{{.RunId}}",
+				},
+			},
+		},
+	}
+
+	tags, err := srv.getUploadTags(settings, common.Job{DatabaseName: "config", DatabaseHost: "replica.local"})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"database": "main/config",
+		"host":     "replica.local",
+		"run":      "20240102T030405Z-1a2b3c4d",
+	}, tags)
+
+	settings.storage.S3.Tags = map[string]string{"invalid": "{{.DbName"}
+
+	_, err = srv.getUploadTags(settings, common.Job{DatabaseName: "config"})
+	assert.ErrorContains(t, err, "invalid")
+}
+
+type recordingHooks struct {
+	events  []hooks.Event
+	ctxErrs []error
+}
+
+func (r *recordingHooks) Run(ctx context.Context, event hooks.Event, _ hooks.Data) error {
+	r.events = append(r.events, event)
+	r.ctxErrs = append(r.ctxErrs, ctx.Err())
+
+	return nil
+}
+
+// hangingDbProvider never finishes dump before the job timeout
+type hangingDbProvider struct {
+	fakeDbProvider
+}
+
+func (h *hangingDbProvider) BackupDatabase(
+	ctx context.Context,
+	_ string,
+	_ string,
+	_ database.BackupOptions,
+) (string, error) {
+	<-ctx.Done()
+
+	return "", ctx.Err()
+}
+
+type validMemoryStorage struct {
+	*memoryStorage
+}
+
+func (v validMemoryStorage) Validate(_ context.Context) error {
+	return nil
+}
+
+func TestProcessRunsFailureHookAfterJobTimeout(t *testing.T) {
+	srv := NewService(&hangingDbProvider{}, validMemoryStorage{newMemoryStorage()}, nil, configuration.Configuration{
+		SelectedDbs: []string{"config"},
+		Db: configuration.DbConfiguration{
+			DumpDir: t.TempDir(),
+			Timeout: 50 * time.Millisecond,
+		},
+	})
+
+	recorded := &recordingHooks{}
+	srv.hooks = recorded
+
+	jobs, err := srv.Process(context.TODO())
+	assert.NoError(t, err)
+	assert.Len(t, jobs, 1)
+	assert.True(t, errors.Is(jobs[0].Error, context.DeadlineExceeded))
+
+	assert.Equal(t, []hooks.Event{hooks.EventBeforeRun, hooks.EventBeforeDump, hooks.EventOnFailure,
+		hooks.EventAfterRun}, recorded.events)
+	assert.NoError(t, recorded.ctxErrs[2]) // on_failure is not cancelled by the job timeout
+}
+
+func TestProcessContinuesInterruptedUpload(t *testing.T) {
+	dir := t.TempDir()
+	provider := &fakeDbProvider{}
+	store := newMemoryStorage()
+
+	srv := NewService(provider, validMemoryStorage{store}, nil, configuration.Configuration{
+		SelectedDbs: []string{"config"},
+		Db: configuration.DbConfiguration{
+			DumpDir: dir,
+		},
+		Storage: configuration.StorageConfiguration{
+			DirTemplate: "{{.DbName}}",
+		},
+	})
+
+	recorded := &recordingHooks{}
+	srv.hooks = recorded
+
+	keptAt := time.Now().UTC().Add(-time.Hour).Truncate(time.Second)
+	kept := fmt.Sprintf("db-config-%v.sql.gzip", keptAt.Format(backupTimeFormat))
+	stale := fmt.Sprintf("db-config-%v.sql.gzip", time.Now().UTC().Add(-48*time.Hour).Format(backupTimeFormat))
+	other := fmt.Sprintf("db-config-old-%v.sql.gzip", keptAt.Format(backupTimeFormat)) // other database
+
+	for _, name := range []string{kept, stale, other} {
+		assert.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte("kept dump"), 0600))
+		assert.NoError(t, os.WriteFile(filepath.Join(dir, name+".upload.json"), []byte("{}"), 0600))
+	}
+
+	jobs, err := srv.Process(context.TODO())
+	assert.NoError(t, err)
+	assert.Len(t, jobs, 1)
+	assert.NoError(t, jobs[0].Error)
+	assert.Equal(t, 0, provider.calls) // not dumped again
+	assert.Equal(t, keptAt, jobs[0].DatabaseBackupStartedAt)
+	assert.Equal(t, "config/"+kept, jobs[0].StorageFileLocation)
+	assert.Equal(t, []byte("kept dump"), store.files["config/"+kept])
+
+	assert.NoFileExists(t, filepath.Join(dir, kept))
+	assert.NoFileExists(t, filepath.Join(dir, stale)) // its upload is aborted by the cleanup
+	assert.NoFileExists(t, filepath.Join(dir, stale+".upload.json"))
+	assert.FileExists(t, filepath.Join(dir, other))
+
+	assert.Equal(t, []hooks.Event{hooks.EventBeforeRun, hooks.EventAfterUpload, hooks.EventAfterRun}, recorded.events)
+}
+
+type interruptingStorage struct {
+	validMemoryStorage
+}
+
+func (i interruptingStorage) Upload(
+	_ context.Context,
+	_ string,
+	_ storage.UploadFile,
+	_ storage.UploadOptions,
+) error {
+	return errors.Mark(errors.New("context canceled"), storage.ErrUploadInterrupted)
+}
+
+func TestProcessKeepsDumpOfInterruptedUpload(t *testing.T) {
+	srv := NewService(&fakeDbProvider{}, interruptingStorage{validMemoryStorage{newMemoryStorage()}}, nil,
+		configuration.Configuration{
+			SelectedDbs: []string{"config"},
+			Db: configuration.DbConfiguration{
+				DumpDir: t.TempDir(),
+			},
+		})
+
+	jobs, err := srv.Process(context.TODO())
+	assert.NoError(t, err)
+	assert.Len(t, jobs, 1)
+	assert.True(t, errors.Is(jobs[0].Error, storage.ErrUploadInterrupted))
+	assert.FileExists(t, jobs[0].FileLocation)
+}
+
+func TestProcessBacksUpDatabase(t *testing.T) {
+	dir := t.TempDir()
+	provider := &fakeDbProvider{size: 1200}
+	store := newMemoryStorage()
+
+	srv := NewService(provider, validMemoryStorage{store}, nil, configuration.Configuration{
+		SelectedDbs: []string{"config"},
+		Db: configuration.DbConfiguration{
+			Name:                 "cluster-a",
+			DumpDir:              dir,
+			CollectRowCounts:     true,
+			MinPreviousDumpRatio: 0.5,
+		},
+		Storage: configuration.StorageConfiguration{
+			DirTemplate: "{{.Source}}/{{.DbName}}",
+			MaxFiles:    2,
+		},
+	})
+
+	recorded := &recordingHooks{}
+	srv.hooks = recorded
+
+	// previous dumps are 10 bytes, the new one is above min_previous_dump_ratio of them
+	createdAt := time.Now().UTC().Add(-48 * time.Hour)
+	store.put("cluster-a/config/db-config-2024_01_01-00_00_00.sql.gzip", []byte("older dump"), createdAt)
+	store.put("cluster-a/config/db-config-2024_01_02-00_00_00.sql.gzip", []byte("old dump!!"), createdAt.Add(time.Hour))
+
+	jobs, err := srv.Process(context.TODO())
+	assert.NoError(t, err)
+	assert.Len(t, jobs, 1)
+
+	job := jobs[0]
+	assert.NoError(t, job.Error)
+	assert.Equal(t, 1, provider.calls)
+	assert.Equal(t, "replica.local", job.DatabaseHost)
+
+	// sizes used for compression ratio in notifications and for min_previous_dump_ratio check
+	dump := []byte("partial dump")
+	assert.Equal(t, int64(len(dump)), job.FileSize)
+	assert.Equal(t, int64(1200), job.DatabaseSize)
+	assert.Equal(t, map[string]int64{"public.users": 42}, job.TableRows)
+
+	sum := sha256.Sum256(dump)
+	assert.Equal(t, hex.EncodeToString(sum[:]), job.Checksum)
+
+	assert.Equal(t, dump, store.files[job.StorageFileLocation])
+	assert.NoFileExists(t, job.FileLocation)
+	assert.Equal(t, []string{"cluster-a/config/db-config-2024_01_01-00_00_00.sql.gzip"}, job.RemovedFiles)
+
+	m, err := manifest.Load(context.TODO(), store, "cluster-a/config/manifest-config.json")
+	assert.NoError(t, err)
+	assert.Len(t, m.Backups, 1)
+	assert.Equal(t, job.StorageFileLocation, m.Backups[0].Key)
+	assert.Equal(t, job.Checksum, m.Backups[0].Checksum)
+	assert.Equal(t, job.FileSize, m.Backups[0].Size)
+
+	assert.Equal(t, []hooks.Event{hooks.EventBeforeRun, hooks.EventBeforeDump, hooks.EventAfterDump,
+		hooks.EventAfterUpload, hooks.EventAfterRun}, recorded.events)
+}
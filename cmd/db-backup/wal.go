@@ -0,0 +1,409 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/cockroachdb/errors"
+	"github.com/hashicorp/go-multierror"
+	"github.com/rs/zerolog"
+
+	"github.com/skynet2/db-backup/pkg/database"
+	"github.com/skynet2/db-backup/pkg/storage"
+)
+
+const (
+	archiveWalCommand = "archive-wal"
+	restoreWalCommand = "restore-wal"
+
+	walCompressedExtension = ".gz"
+	defaultWalDirTemplate  = "{{.Prefix}}/{{.Source}}/wal"
+)
+
+var backupTimeRegex = regexp.MustCompile(`\d{4}_\d{2}_\d{2}-\d{2}_\d{2}_\d{2}`)
+
+// runWalCommand handles postgres archive_command and restore_command:
+//
+//	db-backup archive-wal %p %f [source]
+//	db-backup restore-wal %f %p [source]
+func runWalCommand(ctx context.Context, services []*Service, args []string) error {
+	if len(args) < 3 {
+		return errors.New(fmt.Sprintf("usage: %v <path> <file name> [source]", args[0]))
+	}
+
+	service := services[0]
+
+	if len(args) > 3 {
+		service = nil
+
+		for _, s := range services {
+			if s.cfg.Db.Name == args[3] {
+				service = s
+			}
+		}
+
+		if service == nil {
+			return errors.New(fmt.Sprintf("unknown source %v", args[3]))
+		}
+	}
+
+	switch args[0] {
+	case archiveWalCommand:
+		return service.ArchiveWal(ctx, args[1], args[2])
+	case restoreWalCommand:
+		return service.RestoreWal(ctx, args[1], args[2])
+	default:
+		return errors.New(fmt.Sprintf("unknown command %v", args[0]))
+	}
+}
+
+// ArchiveWal uploads wal segment to the storage of base backups.
+func (s *Service) ArchiveWal(ctx context.Context, walPath string, walName string) error {
+	settings, err := s.getDatabaseSettings(database.PhysicalBackupName)
+
+	if err != nil {
+		return err
+	}
+
+	walDir, err := s.getWalDir(settings)
+
+	if err != nil {
+		return err
+	}
+
+	toUpload, err := os.Open(walPath)
+
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	defer func() {
+		_ = toUpload.Close()
+	}()
+
+	key := path.Join(walDir, walName)
+
+	archived, err := s.findArchivedWal(ctx, settings, key)
+
+	if err != nil {
+		return err
+	}
+
+	if len(archived) > 0 {
+		// postgres may retry archiving after a crash, the same segment is fine, but a different one must
+		// never be overwritten
+		same, compareErr := s.isSameWal(ctx, settings, archived, toUpload)
+
+		if compareErr != nil {
+			return compareErr
+		}
+
+		if !same {
+			return errors.New(fmt.Sprintf("wal %v is already archived as %v with different content", walPath, archived))
+		}
+
+		zerolog.Ctx(ctx).Info().Msgf("wal %v is already archived as %v", walPath, archived)
+
+		return nil
+	}
+
+	if !s.cfg.Wal.DisableCompression {
+		compressed, compressErr := s.compressWal(toUpload)
+
+		if compressErr != nil {
+			return compressErr
+		}
+
+		defer func() {
+			_ = compressed.Close()
+			_ = os.Remove(compressed.Name())
+		}()
+
+		toUpload = compressed
+		key += walCompressedExtension
+	}
+
+	zerolog.Ctx(ctx).Info().Msgf("archiving wal %v to %v", walPath, key)
+
+	return settings.storageProvider.Upload(ctx, key, toUpload, storage.UploadOptions{
+		Lock: true,
+	})
+}
+
+// RestoreWal downloads wal segment from the storage into targetPath.
+func (s *Service) RestoreWal(ctx context.Context, walName string, targetPath string) error {
+	settings, err := s.getDatabaseSettings(database.PhysicalBackupName)
+
+	if err != nil {
+		return err
+	}
+
+	walDir, err := s.getWalDir(settings)
+
+	if err != nil {
+		return err
+	}
+
+	key := path.Join(walDir, walName)
+
+	found, err := s.findArchivedWal(ctx, settings, key)
+
+	if err != nil {
+		return err
+	}
+
+	if len(found) == 0 {
+		return errors.New(fmt.Sprintf("wal file %v not found", key))
+	}
+
+	zerolog.Ctx(ctx).Info().Msgf("restoring wal %v to %v", found, targetPath)
+
+	target, err := os.Create(targetPath)
+
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	if err = s.readArchivedWal(ctx, settings, found, target); err != nil {
+		_ = target.Close()
+		_ = os.Remove(targetPath) // postgres should not see partial segment
+
+		return err
+	}
+
+	return errors.WithStack(target.Close())
+}
+
+// pruneWal removes archived wal older than the oldest retained base backup.
+// In dry run mode wal is only returned. Wal protected by object lock is returned as locked.
+func (s *Service) pruneWal(
+	ctx context.Context,
+	settings databaseSettings,
+	backups []storage.File,
+) ([]string, []string, error) {
+	toRemove, err := s.getWalForRemoving(ctx, settings, backups)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var removed []string
+	var locked []string
+	var finalErr error
+
+	for _, f := range toRemove {
+		if s.cfg.DryRun {
+			removed = append(removed, f.AbsolutePath)
+			continue
+		}
+
+		if removeErr := settings.storageProvider.Remove(ctx, f.AbsolutePath); removeErr != nil {
+			if errors.Is(removeErr, storage.ErrObjectLocked) {
+				locked = append(locked, f.AbsolutePath)
+				continue
+			}
+
+			finalErr = multierror.Append(finalErr, errors.WithStack(removeErr))
+			continue
+		}
+
+		removed = append(removed, f.AbsolutePath)
+	}
+
+	return removed, locked, finalErr
+}
+
+func (s *Service) getWalForRemoving(
+	ctx context.Context,
+	settings databaseSettings,
+	backups []storage.File,
+) ([]storage.File, error) {
+	if len(backups) == 0 {
+		return nil, nil
+	}
+
+	oldest := s.getBackupTime(backups[0])
+
+	for _, b := range backups[1:] {
+		if t := s.getBackupTime(b); t.Before(oldest) {
+			oldest = t
+		}
+	}
+
+	walDir, err := s.getWalDir(settings)
+
+	if err != nil {
+		return nil, err
+	}
+
+	files, err := settings.storageProvider.List(ctx, walDir+"/")
+
+	if err != nil {
+		return nil, err
+	}
+
+	zerolog.Ctx(ctx).Info().Msgf("wal older than %v from %v will be removed", oldest, walDir)
+
+	var toRemove []storage.File
+
+	for _, f := range files {
+		if !f.CreatedAt.Before(oldest) || strings.Contains(path.Base(f.AbsolutePath), ".history") {
+			continue // timeline history files are required for any recovery
+		}
+
+		toRemove = append(toRemove, f)
+	}
+
+	return toRemove, nil
+}
+
+// getBackupTime returns backup start time from file name or upload time if name has no timestamp.
+func (s *Service) getBackupTime(file storage.File) time.Time {
+	if match := backupTimeRegex.FindString(path.Base(file.AbsolutePath)); len(match) > 0 {
+		if t, err := time.Parse(backupTimeFormat, match); err == nil {
+			return t
+		}
+	}
+
+	return file.CreatedAt
+}
+
+func (s *Service) getWalDir(settings databaseSettings) (string, error) {
+	dirTemplate := s.cfg.Wal.DirTemplate
+
+	if len(dirTemplate) == 0 {
+		dirTemplate = defaultWalDirTemplate
+	}
+
+	dir, err := s.templateDir(dirTemplate, "wal", settings.storage.Prefix)
+
+	if err != nil {
+		return "", err
+	}
+
+	// empty prefix renders as leading slash, which is a different s3 key
+	return strings.TrimLeft(dir, "/"), nil
+}
+
+// findArchivedWal returns the key of archived wal segment, compressed or not, empty if it is not archived.
+func (s *Service) findArchivedWal(ctx context.Context, settings databaseSettings, key string) (string, error) {
+	files, err := settings.storageProvider.List(ctx, key)
+
+	if err != nil {
+		return "", err
+	}
+
+	found := ""
+
+	for _, f := range files {
+		if f.AbsolutePath == key || f.AbsolutePath == key+walCompressedExtension {
+			found = f.AbsolutePath
+		}
+	}
+
+	return found, nil
+}
+
+// readArchivedWal downloads archived wal segment and writes its decompressed content to writer.
+func (s *Service) readArchivedWal(
+	ctx context.Context,
+	settings databaseSettings,
+	key string,
+	writer io.Writer,
+) error {
+	downloaded, err := os.CreateTemp(s.cfg.Db.DumpDir, path.Base(key)+"-*")
+
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	defer func() {
+		_ = downloaded.Close()
+		_ = os.Remove(downloaded.Name())
+	}()
+
+	if err = settings.storageProvider.Download(ctx, key, downloaded); err != nil {
+		return err
+	}
+
+	if _, err = downloaded.Seek(0, io.SeekStart); err != nil {
+		return errors.WithStack(err)
+	}
+
+	var reader io.Reader = downloaded
+
+	if strings.HasSuffix(key, walCompressedExtension) {
+		gz, gzErr := gzip.NewReader(downloaded)
+
+		if gzErr != nil {
+			return errors.WithStack(gzErr)
+		}
+
+		defer func() {
+			_ = gz.Close()
+		}()
+
+		reader = gz
+	}
+
+	_, err = io.Copy(writer, reader)
+
+	return errors.WithStack(err)
+}
+
+// isSameWal compares archived wal segment with the local one, local file is rewound afterwards.
+func (s *Service) isSameWal(ctx context.Context, settings databaseSettings, key string, local *os.File) (bool, error) {
+	archived := sha256.New()
+
+	if err := s.readArchivedWal(ctx, settings, key, archived); err != nil {
+		return false, err
+	}
+
+	current := sha256.New()
+
+	if _, err := io.Copy(current, local); err != nil {
+		return false, errors.WithStack(err)
+	}
+
+	if _, err := local.Seek(0, io.SeekStart); err != nil {
+		return false, errors.WithStack(err)
+	}
+
+	return bytes.Equal(archived.Sum(nil), current.Sum(nil)), nil
+}
+
+func (s *Service) compressWal(source *os.File) (*os.File, error) {
+	compressed, err := os.CreateTemp(s.cfg.Db.DumpDir, path.Base(source.Name())+"-*"+walCompressedExtension)
+
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	gz := gzip.NewWriter(compressed)
+
+	if _, err = io.Copy(gz, source); err == nil {
+		err = gz.Close()
+	}
+
+	if err == nil {
+		_, err = compressed.Seek(0, io.SeekStart)
+	}
+
+	if err != nil {
+		_ = compressed.Close()
+		_ = os.Remove(compressed.Name())
+
+		return nil, errors.WithStack(err)
+	}
+
+	return compressed, nil
+}
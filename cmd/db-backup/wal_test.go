@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/errors"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/skynet2/db-backup/pkg/configuration"
+	"github.com/skynet2/db-backup/pkg/storage"
+)
+
+type memoryStorage struct {
+	storage.Provider
+	files  map[string][]byte
+	times  map[string]time.Time
+	locked map[string]bool
+}
+
+func newMemoryStorage() *memoryStorage {
+	return &memoryStorage{
+		files: map[string][]byte{},
+		times: map[string]time.Time{},
+	}
+}
+
+func (m *memoryStorage) put(key string, data []byte, createdAt time.Time) {
+	m.files[key] = data
+	m.times[key] = createdAt
+}
+
+func (m *memoryStorage) Upload(
+	_ context.Context,
+	finalFilePath string,
+	reader storage.UploadFile,
+	opts storage.UploadOptions,
+) error {
+	data, err := io.ReadAll(reader)
+
+	if err != nil {
+		return err
+	}
+
+	m.put(finalFilePath, data, time.Now().UTC())
+
+	if opts.OnChecksum != nil {
+		sum := sha256.Sum256(data)
+		opts.OnChecksum(hex.EncodeToString(sum[:]))
+	}
+
+	return nil
+}
+
+func (m *memoryStorage) Download(_ context.Context, absolutePath string, writer io.Writer) error {
+	data, ok := m.files[absolutePath]
+
+	if !ok {
+		return errors.New("not found")
+	}
+
+	_, err := writer.Write(data)
+
+	return err
+}
+
+func (m *memoryStorage) List(_ context.Context, prefix string) ([]storage.File, error) {
+	var files []storage.File
+
+	for k := range m.files {
+		if strings.HasPrefix(k, prefix) {
+			files = append(files, storage.File{AbsolutePath: k, CreatedAt: m.times[k], Size: int64(len(m.files[k]))})
+		}
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].CreatedAt.Before(files[j].CreatedAt)
+	})
+
+	return files, nil
+}
+
+func (m *memoryStorage) Remove(_ context.Context, absolutePath string) error {
+	if m.locked[absolutePath] {
+		return errors.Mark(errors.New("locked"), storage.ErrObjectLocked)
+	}
+
+	delete(m.files, absolutePath)
+	delete(m.times, absolutePath)
+
+	return nil
+}
+
+func (m *memoryStorage) GetType() string {
+	return "memory"
+}
+
+func TestArchiveAndRestoreWal(t *testing.T) {
+	dir := t.TempDir()
+	walName := "000000010000000000000001"
+	walPath := filepath.Join(dir, walName)
+	assert.NoError(t, os.WriteFile(walPath, []byte("wal segment content"), 0600))
+
+	store := newMemoryStorage()
+	srv := NewService(nil, store, nil, configuration.Configuration{
+		Db: configuration.DbConfiguration{
+			Name:    "cluster-a",
+			DumpDir: dir,
+		},
+	})
+
+	assert.NoError(t, srv.ArchiveWal(context.TODO(), walPath, walName))
+	assert.Contains(t, store.files, "cluster-a/wal/"+walName+".gz")
+
+	target := filepath.Join(dir, "RECOVERYXLOG")
+	assert.NoError(t, srv.RestoreWal(context.TODO(), walName, target))
+
+	data, err := os.ReadFile(target)
+	assert.NoError(t, err)
+	assert.Equal(t, "wal segment content", string(data))
+
+	assert.Error(t, srv.RestoreWal(context.TODO(), "000000010000000000000002", target))
+}
+
+func TestGetWalDir(t *testing.T) {
+	srv := NewService(nil, nil, nil, configuration.Configuration{
+		Db: configuration.DbConfiguration{
+			Name: "cluster-a",
+		},
+	})
+
+	dir, err := srv.getWalDir(databaseSettings{})
+	assert.NoError(t, err)
+	assert.Equal(t, "cluster-a/wal", dir)
+
+	dir, err = srv.getWalDir(databaseSettings{
+		storage: configuration.StorageConfiguration{
+			Prefix: "team-a",
+		},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "team-a/cluster-a/wal", dir)
+}
+
+func TestArchiveWalDoesNotOverwriteSegment(t *testing.T) {
+	dir := t.TempDir()
+	walName := "000000010000000000000001"
+	walPath := filepath.Join(dir, walName)
+	assert.NoError(t, os.WriteFile(walPath, []byte("wal segment content"), 0600))
+
+	store := newMemoryStorage()
+	srv := NewService(nil, store, nil, configuration.Configuration{
+		Db: configuration.DbConfiguration{
+			Name:    "cluster-a",
+			DumpDir: dir,
+		},
+	})
+
+	assert.NoError(t, srv.ArchiveWal(context.TODO(), walPath, walName))
+	key := "cluster-a/wal/" + walName + ".gz"
+	archived := store.files[key]
+	store.times[key] = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	// retry of the same segment succeeds without upload
+	assert.NoError(t, srv.ArchiveWal(context.TODO(), walPath, walName))
+	assert.Equal(t, time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), store.times[key])
+
+	assert.NoError(t, os.WriteFile(walPath, []byte("other content"), 0600))
+	assert.ErrorContains(t, srv.ArchiveWal(context.TODO(), walPath, walName), "different content")
+	assert.Equal(t, archived, store.files[key])
+}
+
+func TestPruneWal(t *testing.T) {
+	store := newMemoryStorage()
+	srv := NewService(nil, store, nil, configuration.Configuration{
+		Db: configuration.DbConfiguration{
+			Name: "cluster-a",
+		},
+	})
+
+	backupTime := time.Date(2024, 5, 10, 12, 0, 0, 0, time.UTC)
+
+	store.put("cluster-a/wal/000000010000000000000001.gz", nil, backupTime.Add(-2*time.Hour))
+	store.put("cluster-a/wal/00000002.history.gz", nil, backupTime.Add(-2*time.Hour))
+	store.put("cluster-a/wal/000000010000000000000002.gz", nil, backupTime.Add(time.Minute))
+
+	settings, err := srv.getDatabaseSettings("basebackup")
+	assert.NoError(t, err)
+
+	removed, locked, err := srv.pruneWal(context.TODO(), settings, []storage.File{
+		{
+			AbsolutePath: "cluster-a/basebackup/db-basebackup-2024_05_10-12_00_00.tar.gz",
+			CreatedAt:    backupTime.Add(3 * time.Hour), // upload finished later
+		},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"cluster-a/wal/000000010000000000000001.gz"}, removed)
+	assert.Empty(t, locked)
+	assert.Len(t, store.files, 2)
+}
@@ -0,0 +1,18 @@
+package common
+
+import (
+	"syscall"
+
+	"github.com/cockroachdb/errors"
+)
+
+// FreeSpace returns bytes available to unprivileged user on the filesystem of dir.
+func FreeSpace(dir string) (int64, error) {
+	var stat syscall.Statfs_t
+
+	if err := syscall.Statfs(dir, &stat); err != nil {
+		return 0, errors.Wrapf(err, "can not get free space of %v", dir)
+	}
+
+	return int64(stat.Bavail) * int64(stat.Bsize), nil
+}
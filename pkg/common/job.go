@@ -3,7 +3,9 @@ package common
 import "time"
 
 type Job struct {
+	SourceName               string
 	DatabaseName             string
+	DatabaseHost             string
 	DatabaseBackupStartedAt  time.Time
 	DatabaseBackupEndedAt    time.Time
 	StartedAt                time.Time
@@ -15,6 +17,11 @@ type Job struct {
 	Error                    error
 	FileLocation             string
 	Output                   string
+	DumpAttempts             int
 	RemovedFiles             []string
-	FileSize                 int64
+	LockedFiles              []string         // not removed by retention because of object lock
+	FileSize                 int64            // size of the backup file
+	DatabaseSize             int64            // size of the live database before dump, 0 if unknown
+	TableRows                map[string]int64 // approximate row counts by table, if collect_row_counts is enabled
+	Checksum                 string           // sha256 of the backup file, hex encoded
 }
@@ -0,0 +1,15 @@
+package common
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+)
+
+// NewRunId returns unique id of the run, sortable by start time. For example 20240102T030405Z-1a2b3c4d.
+func NewRunId(startedAt time.Time) string {
+	random := make([]byte, 4)
+	_, _ = rand.Read(random)
+
+	return startedAt.Format("20060102T150405Z") + "-" + hex.EncodeToString(random)
+}
@@ -0,0 +1,62 @@
+package common
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/cockroachdb/errors"
+)
+
+// ByteCountSI formats size in bytes using SI units (1 kB = 1000 B).
+func ByteCountSI(b int64) string {
+	const unit = 1000
+	if b < unit {
+		return fmt.Sprintf("%d B", b)
+	}
+	div, exp := int64(unit), 0
+	for n := b / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB",
+		float64(b)/float64(div), "kMGTPE"[exp])
+}
+
+var sizeUnits = map[string]int64{
+	"":    1,
+	"b":   1,
+	"k":   1000,
+	"kb":  1000,
+	"kib": 1 << 10,
+	"m":   1000 * 1000,
+	"mb":  1000 * 1000,
+	"mib": 1 << 20,
+	"g":   1000 * 1000 * 1000,
+	"gb":  1000 * 1000 * 1000,
+	"gib": 1 << 30,
+}
+
+// ParseSize parses size like 512, 100kB, 50MiB or 1.5GB into bytes. Units are case insensitive.
+func ParseSize(value string) (int64, error) {
+	value = strings.TrimSpace(value)
+	numberEnd := strings.IndexFunc(value, func(r rune) bool {
+		return (r < '0' || r > '9') && r != '.'
+	})
+
+	if numberEnd < 0 {
+		numberEnd = len(value)
+	}
+
+	number, err := strconv.ParseFloat(value[:numberEnd], 64)
+	if err != nil {
+		return 0, errors.Wrapf(err, "invalid size %v", value)
+	}
+
+	multiplier, ok := sizeUnits[strings.ToLower(strings.TrimSpace(value[numberEnd:]))]
+	if !ok {
+		return 0, errors.New(fmt.Sprintf("unknown unit of size %v", value))
+	}
+
+	return int64(number * float64(multiplier)), nil
+}
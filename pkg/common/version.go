@@ -0,0 +1,4 @@
+package common
+
+// Version of the tool, set on build with -ldflags "-X github.com/skynet2/db-backup/pkg/common.Version=v1.0.0".
+var Version = "dev"
@@ -0,0 +1,207 @@
+package configuration
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/cockroachdb/errors"
+	"github.com/mitchellh/mapstructure"
+)
+
+var sourceTemplateRegex = regexp.MustCompile(`{{-?\s*\.Source\s*-?}}`)
+
+// Prepare decodes configuration blocks which can not be loaded by aconfig directly.
+func (c *Configuration) Prepare() error {
+	if err := decodeSection(c.RawDatabases, &c.Databases); err != nil {
+		return errors.Wrap(err, "invalid databases configuration")
+	}
+
+	if err := decodeSection(c.RawDestinations, &c.Destinations); err != nil {
+		return errors.Wrap(err, "invalid destinations configuration")
+	}
+
+	if err := decodeSection(c.RawHooks, &c.Hooks); err != nil {
+		return errors.Wrap(err, "invalid hooks configuration")
+	}
+
+	if err := c.prepareSources(); err != nil {
+		return errors.Wrap(err, "invalid sources configuration")
+	}
+
+	if err := c.validateSourceTemplates(); err != nil {
+		return err
+	}
+
+	for name, db := range c.Databases {
+		if len(db.Destination) == 0 || db.Destination == DefaultDestination {
+			continue
+		}
+
+		if _, ok := c.Destinations[db.Destination]; !ok {
+			return errors.New(fmt.Sprintf("unknown destination %v for database %v", db.Destination, name))
+		}
+	}
+
+	return nil
+}
+
+func (c *Configuration) prepareSources() error {
+	var rawSources []any
+
+	if err := decodeSection(c.RawSources, &rawSources); err != nil {
+		return err
+	}
+
+	names := map[string]bool{}
+
+	for i, raw := range rawSources {
+		source := SourceConfiguration{
+			DbConfiguration: c.Db,
+		}
+		source.Name = ""
+
+		if err := decodeSection(raw, &source); err != nil {
+			return errors.Wrapf(err, "source #%v", i)
+		}
+
+		if len(source.Name) == 0 {
+			return errors.New(fmt.Sprintf("source #%v has no name", i))
+		}
+
+		if names[source.Name] {
+			return errors.New(fmt.Sprintf("duplicate source name %v", source.Name))
+		}
+
+		names[source.Name] = true
+		c.Sources = append(c.Sources, source)
+	}
+
+	return nil
+}
+
+// validateSourceTemplates requires {{.Source}} in every dir_template if there are multiple sources,
+// otherwise databases with the same name on different servers share retention prefix and manifest.
+func (c *Configuration) validateSourceTemplates() error {
+	if len(c.Sources) < 2 {
+		return nil
+	}
+
+	templates := map[string]string{
+		"storage": c.Storage.DirTemplate,
+	}
+
+	for name, destination := range c.Destinations {
+		templates[fmt.Sprintf("destination %v", name)] = destination.DirTemplate
+	}
+
+	for name, db := range c.Databases {
+		if len(db.DirTemplate) > 0 {
+			templates[fmt.Sprintf("database %v", name)] = db.DirTemplate
+		}
+	}
+
+	if len(c.Wal.DirTemplate) > 0 {
+		templates["wal"] = c.Wal.DirTemplate
+	}
+
+	var invalid []string
+
+	for name, dirTemplate := range templates {
+		if !sourceTemplateRegex.MatchString(dirTemplate) {
+			invalid = append(invalid, name)
+		}
+	}
+
+	if len(invalid) == 0 {
+		return nil
+	}
+
+	sort.Strings(invalid)
+
+	return errors.New(fmt.Sprintf("dir_template of %v should contain {{.Source}} when multiple sources are configured",
+		strings.Join(invalid, ", ")))
+}
+
+// GetSources returns configured database servers or single server from db section.
+func (c Configuration) GetSources() []SourceConfiguration {
+	if len(c.Sources) > 0 {
+		return c.Sources
+	}
+
+	source := SourceConfiguration{
+		DbConfiguration: c.Db,
+	}
+
+	if len(source.Name) == 0 {
+		source.Name = DefaultSource
+	}
+
+	return []SourceConfiguration{source}
+}
+
+// ForSource returns configuration for processing of the specific database server.
+func (c Configuration) ForSource(source SourceConfiguration) Configuration {
+	final := c
+	final.Db = source.DbConfiguration
+
+	if len(source.IncludeDbs) > 0 {
+		final.IncludeDbs = source.IncludeDbs
+	}
+
+	if len(source.ExcludeDbs) > 0 {
+		final.ExcludeDbs = source.ExcludeDbs
+	}
+
+	return final
+}
+
+// GetDatabase returns overrides for specific database. "source/db" key has priority over "db".
+// Empty struct if there is no overrides.
+func (c Configuration) GetDatabase(sourceName string, dbName string) DatabaseOverride {
+	if override, ok := c.Databases[fmt.Sprintf("%v/%v", sourceName, dbName)]; ok {
+		return override
+	}
+
+	return c.Databases[dbName]
+}
+
+// decodeSection decodes raw configuration block into out.
+// aconfig can not map snake_case keys of structs nested into maps or lists,
+// so such blocks are loaded as is and decoded here using yaml tags.
+// Value from environment variable is expected to be json.
+func decodeSection(raw any, out any) error {
+	if raw == nil {
+		return nil
+	}
+
+	if str, ok := raw.(string); ok {
+		if len(strings.TrimSpace(str)) == 0 {
+			return nil
+		}
+
+		var parsed any
+
+		if err := json.Unmarshal([]byte(str), &parsed); err != nil {
+			return errors.WithStack(err)
+		}
+
+		raw = parsed
+	}
+
+	decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+		DecodeHook:       mapstructure.StringToTimeDurationHookFunc(),
+		ErrorUnused:      true,
+		WeaklyTypedInput: true,
+		TagName:          "yaml",
+		Result:           out,
+	})
+
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	return errors.WithStack(decoder.Decode(raw))
+}
@@ -0,0 +1,195 @@
+package configuration
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPrepareDatabases(t *testing.T) {
+	cfg := Configuration{
+		RawDatabases: map[string]any{
+			"analytics": map[string]any{
+				"max_files":   2,
+				"timeout":     "12h",
+				"format":      "custom",
+				"destination": "cold",
+			},
+		},
+		RawDestinations: map[string]any{
+			"cold": map[string]any{
+				"provider":  "s3",
+				"max_files": 10,
+				"s3": map[string]any{
+					"bucket":     "cold-backups",
+					"access_key": "key",
+				},
+			},
+		},
+	}
+
+	assert.NoError(t, cfg.Prepare())
+	assert.Equal(t, DatabaseOverride{
+		MaxFiles:    2,
+		Format:      "custom",
+		Timeout:     12 * time.Hour,
+		Destination: "cold",
+	}, cfg.GetDatabase(DefaultSource, "analytics"))
+	assert.Equal(t, "cold-backups", cfg.Destinations["cold"].S3.Bucket)
+	assert.Equal(t, "key", cfg.Destinations["cold"].S3.AccessKey)
+}
+
+func TestPrepareFromEnv(t *testing.T) {
+	cfg := Configuration{
+		RawDatabases: `{"analytics": {"max_files": 3}}`,
+	}
+
+	assert.NoError(t, cfg.Prepare())
+	assert.Equal(t, 3, cfg.GetDatabase(DefaultSource, "analytics").MaxFiles)
+}
+
+func TestPrepareUnknownDestination(t *testing.T) {
+	cfg := Configuration{
+		RawDatabases: map[string]any{
+			"analytics": map[string]any{
+				"destination": "missing",
+			},
+		},
+	}
+
+	assert.Error(t, cfg.Prepare())
+}
+
+func TestPrepareUnknownField(t *testing.T) {
+	cfg := Configuration{
+		RawDatabases: map[string]any{
+			"analytics": map[string]any{
+				"max_filez": 3,
+			},
+		},
+	}
+
+	assert.Error(t, cfg.Prepare())
+}
+
+func TestPrepareSources(t *testing.T) {
+	cfg := Configuration{
+		Db: DbConfiguration{
+			Provider: "postgres",
+			DumpDir:  "/var/backup",
+			Postgres: PostgresConfiguration{
+				User:     "backup",
+				Password: "secret",
+				Port:     5432,
+			},
+		},
+		Storage: StorageConfiguration{
+			DirTemplate: "{{.Source}}/{{.DbName}}",
+		},
+		IncludeDbs: []string{"config"},
+		RawSources: []any{
+			map[string]any{
+				"name": "cluster-a",
+				"postgres": map[string]any{
+					"host": "10.0.0.1",
+				},
+			},
+			map[string]any{
+				"name":        "cluster-b",
+				"include_dbs": []any{"tenant_*"},
+				"postgres": map[string]any{
+					"host": "10.0.0.2",
+					"port": 6432,
+				},
+			},
+		},
+		RawDatabases: map[string]any{
+			"config":           map[string]any{"max_files": 2},
+			"cluster-b/config": map[string]any{"max_files": 7},
+		},
+	}
+
+	assert.NoError(t, cfg.Prepare())
+
+	sources := cfg.GetSources()
+	assert.Len(t, sources, 2)
+
+	a := cfg.ForSource(sources[0])
+	assert.Equal(t, "cluster-a", a.Db.Name)
+	assert.Equal(t, "10.0.0.1", a.Db.Postgres.Host)
+	assert.Equal(t, 5432, a.Db.Postgres.Port)
+	assert.Equal(t, "backup", a.Db.Postgres.User)
+	assert.Equal(t, "/var/backup", a.Db.DumpDir)
+	assert.Equal(t, []string{"config"}, a.IncludeDbs)
+
+	b := cfg.ForSource(sources[1])
+	assert.Equal(t, 6432, b.Db.Postgres.Port)
+	assert.Equal(t, []string{"tenant_*"}, b.IncludeDbs)
+
+	assert.Equal(t, 2, cfg.GetDatabase("cluster-a", "config").MaxFiles)
+	assert.Equal(t, 7, cfg.GetDatabase("cluster-b", "config").MaxFiles)
+}
+
+func TestPrepareSourcesRequireSourceInDirTemplate(t *testing.T) {
+	cfg := Configuration{
+		Storage: StorageConfiguration{
+			DirTemplate: "{{ .Source }}/{{.DbName}}",
+		},
+		RawSources: []any{
+			map[string]any{"name": "cluster-a"},
+			map[string]any{"name": "cluster-b"},
+		},
+		RawDatabases: map[string]any{
+			"config": map[string]any{"dir_template": "{{.Host}}/config"},
+		},
+	}
+
+	assert.ErrorContains(t, cfg.Prepare(), "dir_template of database config should contain {{.Source}}")
+
+	single := Configuration{
+		RawSources: []any{
+			map[string]any{"name": "cluster-a"},
+		},
+	}
+
+	assert.NoError(t, single.Prepare())
+}
+
+func TestGetSourcesDefault(t *testing.T) {
+	cfg := Configuration{
+		Db: DbConfiguration{
+			Provider: "postgres",
+		},
+	}
+
+	sources := cfg.GetSources()
+	assert.Len(t, sources, 1)
+	assert.Equal(t, DefaultSource, sources[0].Name)
+}
+
+func TestPrepareSourcesDuplicateName(t *testing.T) {
+	cfg := Configuration{
+		RawSources: []any{
+			map[string]any{"name": "a"},
+			map[string]any{"name": "a"},
+		},
+	}
+
+	assert.Error(t, cfg.Prepare())
+}
+
+func TestPrepareZeroDumpRetries(t *testing.T) {
+	cfg := Configuration{
+		RawDatabases: `{"analytics": {"dump_retries": 0}, "config": {"max_files": 3}}`,
+	}
+
+	assert.NoError(t, cfg.Prepare())
+
+	retries := cfg.GetDatabase(DefaultSource, "analytics").DumpRetries
+	if assert.NotNil(t, retries) {
+		assert.Equal(t, 0, *retries)
+	}
+
+	assert.Nil(t, cfg.GetDatabase(DefaultSource, "config").DumpRetries)
+}
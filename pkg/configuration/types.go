@@ -1,12 +1,99 @@
 package configuration
 
+import "time"
+
 type Configuration struct {
-	IncludeDbs    []string                  `env:"INCLUDE_DBS"` // not empty -> include only specified dbs
-	ExcludeDbs    []string                  `env:"EXCLUDE_DBS"` // not empty -> exclude databases
-	Db            DbConfiguration           `env:"DB"`
-	Storage       StorageConfiguration      `env:"STORAGE"`
-	Notifications NotificationConfiguration `env:"NOTIFICATIONS"`
-	Metrics       Metrics                   `env:"METRICS"`
+	IncludeDbs             []string                  `env:"INCLUDE_DBS"`                  // not empty -> include only specified dbs
+	ExcludeDbs             []string                  `env:"EXCLUDE_DBS"`                  // not empty -> exclude databases
+	FailOnUnmatchedInclude bool                      `env:"FAIL_ON_UNMATCHED_INCLUDE"`    // true -> fail if include_dbs entry matches nothing
+	SelectedDbs            []string                  `yaml:"-" json:"-" env:"-" flag:"-"` // --db command line filter, applied on top of include_dbs
+	DryRun                 bool                      `env:"DRY_RUN" flag:"-"`             // --dry-run, print plan without dump, upload and removal
+	RunId                  string                    `yaml:"-" json:"-" env:"-" flag:"-"` // unique id of the current run, available in templates
+	Db                     DbConfiguration           `env:"DB"`
+	Storage                StorageConfiguration      `env:"STORAGE"`
+	Notifications          NotificationConfiguration `env:"NOTIFICATIONS"`
+	Metrics                Metrics                   `env:"METRICS"`
+	Wal                    WalConfiguration          `env:"WAL"`
+	Report                 ReportConfiguration       `env:"REPORT"`
+	Lock                   LockConfiguration         `env:"LOCK"`
+
+	RawDatabases    any `yaml:"databases" json:"databases" env:"DATABASES"`          // decoded into Databases
+	RawDestinations any `yaml:"destinations" json:"destinations" env:"DESTINATIONS"` // decoded into Destinations
+	RawSources      any `yaml:"sources" json:"sources" env:"SOURCES"`                // decoded into Sources
+	RawHooks        any `yaml:"hooks" json:"hooks" env:"HOOKS"`                      // decoded into Hooks
+
+	Databases    map[string]DatabaseOverride     `yaml:"-" json:"-" env:"-" flag:"-"` // per database overrides
+	Destinations map[string]StorageConfiguration `yaml:"-" json:"-" env:"-" flag:"-"` // additional named storages
+	Sources      []SourceConfiguration           `yaml:"-" json:"-" env:"-" flag:"-"` // database servers, db section by default
+	Hooks        HooksConfiguration              `yaml:"-" json:"-" env:"-" flag:"-"`
+}
+
+// DefaultSource is the name of the database server configured in db section.
+const DefaultSource = "default"
+
+// SourceConfiguration describes single database server. Not specified values are taken from db section.
+type SourceConfiguration struct {
+	DbConfiguration `yaml:",squash"`
+	IncludeDbs      []string `yaml:"include_dbs"` // empty -> global include_dbs
+	ExcludeDbs      []string `yaml:"exclude_dbs"` // empty -> global exclude_dbs
+}
+
+// DefaultDestination is the name of the main storage configuration (storage section).
+const DefaultDestination = "default"
+
+// DatabaseOverride overrides global settings for specific database. Zero values are ignored.
+type DatabaseOverride struct {
+	MaxFiles         int           `yaml:"max_files"`
+	DirTemplate      string        `yaml:"dir_template"`
+	CompressionLevel int           `yaml:"compression_level"`
+	Format           string        `yaml:"format"`
+	Timeout          time.Duration `yaml:"timeout"`
+	DumpTimeout      time.Duration `yaml:"dump_timeout"`
+	DumpRetries      *int          `yaml:"dump_retries"` // nil keeps db.dump_retries, 0 disables retries
+	Destination      string        `yaml:"destination"`  // name from destinations or "default"
+}
+
+// HooksConfiguration describes hooks executed around the run and each database job.
+type HooksConfiguration struct {
+	BeforeRun   []HookConfiguration `yaml:"before_run"`
+	AfterRun    []HookConfiguration `yaml:"after_run"`
+	BeforeDump  []HookConfiguration `yaml:"before_dump"`
+	AfterDump   []HookConfiguration `yaml:"after_dump"`
+	AfterUpload []HookConfiguration `yaml:"after_upload"`
+	OnFailure   []HookConfiguration `yaml:"on_failure"`
+}
+
+// HookConfiguration is a single hook: shell command or http call. Only one of Command and Url should be set.
+type HookConfiguration struct {
+	Name            string            `yaml:"name"`
+	Command         string            `yaml:"command"` // executed with sh -c
+	Url             string            `yaml:"url"`
+	Method          string            `yaml:"method"` // POST by default
+	Headers         map[string]string `yaml:"headers"`
+	Timeout         time.Duration     `yaml:"timeout"`           // 5m by default
+	ContinueOnError bool              `yaml:"continue_on_error"` // false -> hook error fails the job (or run)
+}
+
+// WalConfiguration describes WAL archiving (archive-wal and restore-wal commands).
+type WalConfiguration struct {
+	Prune              bool   `yaml:"prune" env:"PRUNE"`                             // remove wal older than the oldest base backup
+	DirTemplate        string `yaml:"dir_template" env:"DIR_TEMPLATE"`               // {{.Source}}/wal by default
+	DisableCompression bool   `yaml:"disable_compression" env:"DISABLE_COMPRESSION"` // gzip is used by default
+}
+
+// LockConfiguration of the run lock object in the default storage, which prevents overlapping backup and prune runs.
+type LockConfiguration struct {
+	Enabled      bool          `yaml:"enabled" env:"ENABLED"`
+	Key          string        `yaml:"key" env:"KEY"`                     // db-backup.lock by default
+	Lease        time.Duration `yaml:"lease" env:"LEASE"`                 // lock not renewed within lease is taken over, 5m by default
+	OnContention string        `yaml:"on_contention" env:"ON_CONTENTION"` // wait (default), skip, fail
+	WaitTimeout  time.Duration `yaml:"wait_timeout" env:"WAIT_TIMEOUT"`   // max wait for the lock, 0 - unlimited
+}
+
+type ReportConfiguration struct {
+	Path      string `yaml:"path" env:"PATH"`             // json report file, "-" for stdout
+	Upload    bool   `yaml:"upload" env:"UPLOAD"`         // upload report to the default storage
+	UploadDir string `yaml:"upload_dir" env:"UPLOAD_DIR"` // reports by default
 }
 
 type Metrics struct {
@@ -25,37 +112,93 @@ type NotificationMode struct {
 }
 
 type DbConfiguration struct {
-	Provider string                `env:"PROVIDER"`
-	DumpDir  string                `env:"DUMP_DIR"`
-	Postgres PostgresConfiguration `env:"POSTGRES"`
+	Name     string                `yaml:"name" env:"NAME"` // source name, available as {{.Source}}
+	Provider string                `yaml:"provider" env:"PROVIDER"`
+	DumpDir  string                `yaml:"dump_dir" env:"DUMP_DIR"`
+	Timeout  time.Duration         `yaml:"timeout" env:"TIMEOUT"` // per database job timeout, 0 - unlimited
+	Postgres PostgresConfiguration `yaml:"postgres" env:"POSTGRES"`
+
+	DumpTimeout    time.Duration `yaml:"dump_timeout" env:"DUMP_TIMEOUT"`         // single dump attempt timeout, 0 - unlimited
+	DumpRetries    int           `yaml:"dump_retries" env:"DUMP_RETRIES"`         // additional attempts on transient errors
+	DumpRetryDelay time.Duration `yaml:"dump_retry_delay" env:"DUMP_RETRY_DELAY"` // delay before first retry, doubled each time
+
+	DiskSpaceRatio      float64 `yaml:"disk_space_ratio" env:"DISK_SPACE_RATIO"`           // free space required in dump_dir as share of database size, 0 - no check
+	OnInsufficientSpace string  `yaml:"on_insufficient_space" env:"ON_INSUFFICIENT_SPACE"` // skip (default) - next database, fail - stop the run
+
+	CollectRowCounts     bool    `yaml:"collect_row_counts" env:"COLLECT_ROW_COUNTS"`           // approximate row counts per table in job results
+	MinDumpRatio         float64 `yaml:"min_dump_ratio" env:"MIN_DUMP_RATIO"`                   // dump smaller than database size * ratio fails the job, 0 - no check
+	MinPreviousDumpRatio float64 `yaml:"min_previous_dump_ratio" env:"MIN_PREVIOUS_DUMP_RATIO"` // dump smaller than previous backup * ratio fails the job, 0 - no check
 }
 
 type StorageConfiguration struct {
-	Provider    string   `env:"PROVIDER"`
-	DirTemplate string   `env:"DIR_TEMPLATE"`
-	Prefix      string   `env:"PREFIX"`
-	MaxFiles    int      `env:"MAX_FILES"`
+	Provider    string   `yaml:"provider" env:"PROVIDER"`
+	DirTemplate string   `yaml:"dir_template" env:"DIR_TEMPLATE"`
+	Prefix      string   `yaml:"prefix" env:"PREFIX"`
+	MaxFiles    int      `yaml:"max_files" env:"MAX_FILES"`
 	S3          S3Config `yaml:"s3" env:"S3"`
+
+	MaxUploadRate      string   `yaml:"max_upload_rate" env:"MAX_UPLOAD_RATE"`           // e.g. 50MiB/s, unlimited if empty
+	UploadRateSchedule []string `yaml:"upload_rate_schedule" env:"UPLOAD_RATE_SCHEDULE"` // HH:MM-HH:MM=rate, overrides max_upload_rate within the window
+	VolumeSize         string   `yaml:"volume_size" env:"VOLUME_SIZE"`                   // e.g. 4GiB, bigger backups are split into volumes
 }
 
 type PostgresConfiguration struct {
-	Host             string `env:"HOST"`
-	Port             int    `env:"PORT"`
-	User             string `env:"USER"`
-	Password         string `env:"PASSWORD"`
-	DbDefaultName    string `env:"DB_DEFAULT_NAME"`
-	TlsEnabled       bool   `env:"TLS_ENABLED"`
-	CompressionLevel int    `env:"COMPRESSION_LEVEL"`
+	Host             string `yaml:"host" env:"HOST"`
+	Port             int    `yaml:"port" env:"PORT"`
+	User             string `yaml:"user" env:"USER"`
+	Password         string `yaml:"password" env:"PASSWORD"`
+	DbDefaultName    string `yaml:"db_default_name" env:"DB_DEFAULT_NAME"`
+	TlsEnabled       bool   `yaml:"tls_enabled" env:"TLS_ENABLED"` // same as ssl_mode = require
+	CompressionLevel int    `yaml:"compression_level" env:"COMPRESSION_LEVEL"`
+	Format           string `yaml:"format" env:"FORMAT"` // pg_dump format: plain (default), custom or tar
+
+	SslMode     string `yaml:"ssl_mode" env:"SSL_MODE"` // disable, allow, prefer (default), require, verify-ca, verify-full
+	SslRootCert string `yaml:"ssl_root_cert" env:"SSL_ROOT_CERT"`
+	SslCert     string `yaml:"ssl_cert" env:"SSL_CERT"`
+	SslKey      string `yaml:"ssl_key" env:"SSL_KEY"`
+	SocketDir   string `yaml:"socket_dir" env:"SOCKET_DIR"` // unix socket directory, used instead of host
+	Dsn         string `yaml:"dsn" env:"DSN"`               // libpq keyword/value connection string, other fields are appended
+	Service     string `yaml:"service" env:"SERVICE"`       // libpq service name from pg_service.conf
+
+	ReplicaHosts         []string      `yaml:"replica_hosts" env:"REPLICA_HOSTS"`                   // host or host:port of standby servers
+	MaxReplicationLag    time.Duration `yaml:"max_replication_lag" env:"MAX_REPLICATION_LAG"`       // 0 - any lag
+	AllowPrimaryFallback bool          `yaml:"allow_primary_fallback" env:"ALLOW_PRIMARY_FALLBACK"` // use host if no healthy replica
 }
 
 type S3Config struct {
-	Region         string `env:"REGION"`
-	Endpoint       string `env:"ENDPOINT"`
-	Bucket         string `env:"BUCKET"`
-	AccessKey      string `env:"ACCESS_KEY"`
-	SecretKey      string `env:"SECRET_KEY"`
-	DisableSsl     bool   `env:"DISABLE_SSL"`
-	ForcePathStyle bool   `env:"FORCE_PATH_STYLE"`
+	Region         string `yaml:"region" env:"REGION"`
+	Endpoint       string `yaml:"endpoint" env:"ENDPOINT"`
+	Bucket         string `yaml:"bucket" env:"BUCKET"`
+	AccessKey      string `yaml:"access_key" env:"ACCESS_KEY"`
+	SecretKey      string `yaml:"secret_key" env:"SECRET_KEY"`
+	DisableSsl     bool   `yaml:"disable_ssl" env:"DISABLE_SSL"`
+	ForcePathStyle bool   `yaml:"force_path_style" env:"FORCE_PATH_STYLE"`
+
+	Profile              string        `yaml:"profile" env:"PROFILE"`                                 // shared config profile, default chain if empty
+	RoleArn              string        `yaml:"role_arn" env:"ROLE_ARN"`                               // role assumed with base or web identity credentials
+	WebIdentityTokenFile string        `yaml:"web_identity_token_file" env:"WEB_IDENTITY_TOKEN_FILE"` // e.g. IRSA token, requires role_arn
+	ExternalId           string        `yaml:"external_id" env:"EXTERNAL_ID"`                         // AssumeRole external id
+	RoleSessionName      string        `yaml:"role_session_name" env:"ROLE_SESSION_NAME"`             // db-backup by default
+	AssumeRoleDuration   time.Duration `yaml:"assume_role_duration" env:"ASSUME_ROLE_DURATION"`       // 1h by default
+
+	ChecksumAlgorithm         string `yaml:"checksum_algorithm" env:"CHECKSUM_ALGORITHM"`                   // sha256 (default), md5 or none
+	DisableUploadVerification bool   `yaml:"disable_upload_verification" env:"DISABLE_UPLOAD_VERIFICATION"` // skip HEAD after upload
+
+	PartSizeMb           int `yaml:"part_size_mb" env:"PART_SIZE_MB"`                     // multipart part size, 16 by default
+	MultipartThresholdMb int `yaml:"multipart_threshold_mb" env:"MULTIPART_THRESHOLD_MB"` // bigger files use multipart upload, 64 by default
+	UploadConcurrency    int `yaml:"upload_concurrency" env:"UPLOAD_CONCURRENCY"`         // parts uploaded in parallel, 4 by default
+
+	ServerSideEncryption string            `yaml:"server_side_encryption" env:"SERVER_SIDE_ENCRYPTION"` // AES256 or aws:kms
+	KmsKeyId             string            `yaml:"kms_key_id" env:"KMS_KEY_ID"`                         // aws:kms key, bucket default if empty
+	SseCustomerKey       string            `yaml:"sse_customer_key" env:"SSE_CUSTOMER_KEY"`             // SSE-C, base64 encoded 256 bit key
+	StorageClass         string            `yaml:"storage_class" env:"STORAGE_CLASS"`                   // STANDARD by default
+	Tags                 map[string]string `yaml:"tags" env:"TAGS"`                                     // object tags, values are templates
+
+	ObjectLockMode       string `yaml:"object_lock_mode" env:"OBJECT_LOCK_MODE"`               // GOVERNANCE or COMPLIANCE retention of backups
+	ObjectLockRetainDays int    `yaml:"object_lock_retain_days" env:"OBJECT_LOCK_RETAIN_DAYS"` // retain-until = upload time + days
+	ObjectLockLegalHold  bool   `yaml:"object_lock_legal_hold" env:"OBJECT_LOCK_LEGAL_HOLD"`   // legal hold on backups, removed manually only
+
+	AbortIncompleteUploadsAfter time.Duration `yaml:"abort_incomplete_uploads_after" env:"ABORT_INCOMPLETE_UPLOADS_AFTER"` // 24h by default, negative - never
 }
 
 type NotificationChannelConfig struct {
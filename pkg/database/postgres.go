@@ -1,17 +1,49 @@
 package database
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
-	"crypto/tls"
 	"fmt"
+	"os"
 	"os/exec"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/cockroachdb/errors"
+	"github.com/hashicorp/go-multierror"
 	"github.com/jackc/pgx/v4"
+	"github.com/rs/zerolog"
 
 	"github.com/skynet2/db-backup/pkg/configuration"
 )
 
+const terminationGracePeriod = 30 * time.Second
+
+// transientErrors are pg_dump output fragments for errors which make sense to retry.
+// Generic "connection to server ... failed" prefix is not listed, libpq uses it for permanent errors as well
+// (authentication, missing database, pg_hba, ssl verification).
+var transientErrors = []string{
+	"connection reset",
+	"connection refused",
+	"connection timed out",
+	"timeout expired",
+	"no route to host",
+	"network is unreachable",
+	"server closed the connection unexpectedly",
+	"terminating connection due to administrator command",
+	"the database system is starting up",
+	"the database system is shutting down",
+	"lock timeout",
+	"could not obtain lock",
+	"deadlock detected",
+	"canceling statement due to conflict with recovery",
+	"too many connections",
+	"too many clients already",
+	"remaining connection slots are reserved",
+}
+
 type PostgresProvider struct {
 	cfg configuration.PostgresConfiguration
 }
@@ -24,7 +56,7 @@ func NewPostgresProvider(cfg configuration.PostgresConfiguration) Provider {
 
 func (p PostgresProvider) Validate(ctx context.Context) error {
 	// todo validate pgdump location
-	con, err := p.getConnection(ctx)
+	con, err := p.getConnection(ctx, p.getPrimaryHost())
 
 	if err != nil {
 		return errors.WithStack(err)
@@ -35,7 +67,7 @@ func (p PostgresProvider) Validate(ctx context.Context) error {
 }
 
 func (p PostgresProvider) ListDatabase(ctx context.Context) ([]string, error) {
-	con, err := p.getConnection(ctx)
+	con, err := p.getConnection(ctx, p.getPrimaryHost())
 
 	if err != nil {
 		return nil, err
@@ -61,7 +93,70 @@ func (p PostgresProvider) ListDatabase(ctx context.Context) ([]string, error) {
 	return dbs, nil
 }
 
-func (p PostgresProvider) getCompressionLevel() int {
+// GetDatabaseSize returns pg_database_size on primary host, dump is usually smaller because of compression
+// and indexes which are not dumped.
+func (p PostgresProvider) GetDatabaseSize(ctx context.Context, databaseName string) (int64, error) {
+	con, err := p.getConnection(ctx, p.getPrimaryHost())
+
+	if err != nil {
+		return 0, err
+	}
+
+	defer func() {
+		_ = con.Close(ctx)
+	}()
+
+	var size int64
+
+	if err = con.QueryRow(ctx, "select pg_database_size($1)", databaseName).Scan(&size); err != nil {
+		return 0, errors.WithStack(err)
+	}
+
+	return size, nil
+}
+
+// GetTableRowCounts returns live row estimates of user tables from statistics collector, keyed by schema.table.
+// Estimates are updated by autovacuum and analyze, so they can lag behind for recently changed tables.
+func (p PostgresProvider) GetTableRowCounts(ctx context.Context, databaseName string) (map[string]int64, error) {
+	con, err := p.getDatabaseConnection(ctx, p.getPrimaryHost(), databaseName)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		_ = con.Close(ctx)
+	}()
+
+	rows, err := con.Query(ctx, "select schemaname || '.' || relname, n_live_tup from pg_stat_user_tables")
+
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	defer rows.Close()
+
+	counts := map[string]int64{}
+
+	for rows.Next() {
+		var table string
+		var count int64
+
+		if err = rows.Scan(&table, &count); err != nil {
+			return nil, errors.WithStack(err)
+		}
+
+		counts[table] = count
+	}
+
+	return counts, errors.WithStack(rows.Err())
+}
+
+func (p PostgresProvider) getCompressionLevel(opts BackupOptions) int {
+	if opts.CompressionLevel != 0 {
+		return opts.CompressionLevel
+	}
+
 	level := p.cfg.CompressionLevel
 
 	if level == 0 {
@@ -71,61 +166,286 @@ func (p PostgresProvider) getCompressionLevel() int {
 	return level
 }
 
+func (p PostgresProvider) getFormat(opts BackupOptions) (string, error) {
+	format := opts.Format
+
+	if len(format) == 0 {
+		format = p.cfg.Format
+	}
+
+	format = strings.TrimSpace(strings.ToLower(format))
+
+	switch format {
+	case "", "plain":
+		return "plain", nil
+	case "custom", "tar":
+		return format, nil
+	default:
+		return "", errors.New(fmt.Sprintf("unsupported pg_dump format %v", format))
+	}
+}
+
+func (p PostgresProvider) GetFileExtension(opts BackupOptions) string {
+	format, _ := p.getFormat(opts)
+
+	switch format {
+	case "custom":
+		return ".dump"
+	case "tar":
+		return ".tar"
+	default:
+		return ".sql.gzip"
+	}
+}
+
+func (p PostgresProvider) GetBackupFormat(opts BackupOptions) BackupFormat {
+	format, _ := p.getFormat(opts)
+
+	if format == "tar" {
+		return BackupFormat{
+			Format:      format,
+			Compression: "none",
+		}
+	}
+
+	return BackupFormat{
+		Format:           format,
+		Compression:      "gzip",
+		CompressionLevel: p.getCompressionLevel(opts),
+	}
+}
+
 func (p PostgresProvider) BackupDatabase(
 	ctx context.Context,
 	databaseName string,
 	finalFileName string,
+	opts BackupOptions,
 ) (string, error) {
-	cmd := exec.Command("pg_dump",
-		fmt.Sprintf("--username=%v", p.cfg.User),
-		fmt.Sprintf("--host=%v", p.cfg.Host),
-		fmt.Sprintf("--file=%v", finalFileName),
-		fmt.Sprintf("--compress=%v", p.getCompressionLevel()),
-		fmt.Sprintf("--dbname=%v", databaseName),
-	)
+	format, err := p.getFormat(opts)
 
-	dbPassword := p.cfg.Password
+	if err != nil {
+		return "", err
+	}
 
-	if len(dbPassword) > 0 {
-		cmd.Env = append(cmd.Env, fmt.Sprintf("PGPASSWORD=%v", dbPassword))
+	host := opts.Host
+
+	if len(host) == 0 {
+		host = p.getPrimaryHost()
+	}
+
+	args := []string{
+		fmt.Sprintf("--file=%v", finalFileName),
+		fmt.Sprintf("--format=%v", format),
+		fmt.Sprintf("--dbname=%v", p.getConnectionString(host, databaseName)),
+	}
+
+	if format != "tar" { // tar format does not support compression
+		args = append(args, fmt.Sprintf("--compress=%v", p.getCompressionLevel(opts)))
 	}
 
+	cmd := p.newCommand(ctx, "pg_dump", args...)
+
 	output, err := cmd.CombinedOutput()
 
 	if err != nil {
-		return string(output), errors.Wrap(err, string(output))
+		return string(output), p.wrapCommandError(ctx, "pg_dump", string(output), err)
 	}
 
 	return string(output), nil
 }
 
+// RestoreDatabase restores backup file into existing database on primary host.
+// Format is detected by file extension: plain dumps are applied with psql, custom and tar with pg_restore.
+func (p PostgresProvider) RestoreDatabase(ctx context.Context, databaseName string, fileName string) (string, error) {
+	connectionString := p.getConnectionString(p.getPrimaryHost(), databaseName)
+
+	if strings.HasSuffix(fileName, ".dump") || strings.HasSuffix(fileName, ".tar") {
+		cmd := p.newCommand(ctx, "pg_restore",
+			fmt.Sprintf("--dbname=%v", connectionString),
+			"--exit-on-error",
+			fileName,
+		)
+
+		output, err := cmd.CombinedOutput()
+
+		if err != nil {
+			return string(output), p.wrapCommandError(ctx, "pg_restore", string(output), err)
+		}
+
+		return string(output), nil
+	}
+
+	file, err := os.Open(fileName)
+
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+
+	defer func() {
+		_ = file.Close()
+	}()
+
+	gz, err := gzip.NewReader(file) // plain dumps are compressed by pg_dump
+
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+
+	defer func() {
+		_ = gz.Close()
+	}()
+
+	cmd := p.newCommand(ctx, "psql",
+		fmt.Sprintf("--dbname=%v", connectionString),
+		"--no-psqlrc",
+		"--quiet",
+		"--set=ON_ERROR_STOP=1",
+	)
+
+	var output bytes.Buffer
+
+	cmd.Stdin = gz
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+
+	if err = cmd.Run(); err != nil {
+		return output.String(), p.wrapCommandError(ctx, "psql", output.String(), err)
+	}
+
+	return output.String(), nil
+}
+
+// newCommand creates command for postgres client tool with password and graceful termination on cancel.
+func (p PostgresProvider) newCommand(ctx context.Context, name string, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Cancel = func() error { // let the tool close connection gracefully, killed after WaitDelay
+		return cmd.Process.Signal(syscall.SIGTERM)
+	}
+	cmd.WaitDelay = terminationGracePeriod
+
+	cmd.Env = os.Environ() // HOME, PGSERVICEFILE etc.
+
+	if dbPassword := p.cfg.Password; len(dbPassword) > 0 {
+		cmd.Env = append(cmd.Env, fmt.Sprintf("PGPASSWORD=%v", dbPassword))
+	}
+
+	return cmd
+}
+
+func (p PostgresProvider) wrapCommandError(ctx context.Context, name string, output string, err error) error {
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return errors.Wrapf(ctxErr, "%v terminated: %v", name, output)
+	}
+
+	err = errors.Wrap(err, output)
+
+	if p.isTransient(output) {
+		err = errors.Mark(err, ErrTransient)
+	}
+
+	return err
+}
+
+func (p PostgresProvider) isTransient(output string) bool {
+	output = strings.ToLower(output)
+
+	for _, e := range transientErrors {
+		if strings.Contains(output, e) {
+			return true
+		}
+	}
+
+	return false
+}
+
 func (p PostgresProvider) GetType() string {
 	return "postgres"
 }
 
-func (p PostgresProvider) getConnection(ctx context.Context) (*pgx.Conn, error) {
+// SelectHost returns first healthy replica from replica_hosts or primary host if there are no replicas configured.
+func (p PostgresProvider) SelectHost(ctx context.Context) (string, error) {
+	if len(p.cfg.ReplicaHosts) == 0 {
+		return p.getPrimaryHost(), nil
+	}
+
+	var finalErr error
+
+	for _, host := range p.cfg.ReplicaHosts {
+		if err := p.checkReplica(ctx, host); err != nil {
+			zerolog.Ctx(ctx).Warn().Err(err).Msgf("replica %v is not healthy", host)
+			finalErr = multierror.Append(finalErr, err)
+
+			continue
+		}
+
+		return host, nil
+	}
+
+	if p.cfg.AllowPrimaryFallback {
+		zerolog.Ctx(ctx).Warn().Msgf("no healthy replica found, falling back to primary %v", p.getPrimaryHost())
+
+		return p.getPrimaryHost(), nil
+	}
+
+	return "", errors.Wrap(finalErr, "no healthy replica found")
+}
+
+func (p PostgresProvider) checkReplica(ctx context.Context, host string) error {
+	con, err := p.getConnection(ctx, host)
+
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		_ = con.Close(ctx)
+	}()
+
+	var inRecovery bool
+	var lagSeconds float64
+
+	if err = con.QueryRow(ctx, `select pg_is_in_recovery(),
+       case
+           when not pg_is_in_recovery() or pg_last_wal_receive_lsn() = pg_last_wal_replay_lsn() then 0
+           else coalesce(extract(epoch from now() - pg_last_xact_replay_timestamp()), 0)
+           end::float8`).Scan(&inRecovery, &lagSeconds); err != nil {
+		return errors.WithStack(err)
+	}
+
+	if !inRecovery {
+		return errors.New(fmt.Sprintf("host %v is not a standby", host))
+	}
+
+	lag := time.Duration(lagSeconds * float64(time.Second))
+
+	if p.cfg.MaxReplicationLag > 0 && lag > p.cfg.MaxReplicationLag {
+		return errors.New(fmt.Sprintf("replication lag %v on host %v exceeds %v", lag, host,
+			p.cfg.MaxReplicationLag))
+	}
+
+	return nil
+}
+
+func (p PostgresProvider) getConnection(ctx context.Context, host string) (*pgx.Conn, error) {
 	defaultDbName := p.cfg.DbDefaultName
 
 	if len(defaultDbName) == 0 {
 		defaultDbName = "postgres"
 	}
 
-	var tlsConfig *tls.Config
-
-	if p.cfg.TlsEnabled {
-		tlsConfig = &tls.Config{
-			InsecureSkipVerify: true,
-		}
-	}
+	return p.getDatabaseConnection(ctx, host, defaultDbName)
+}
 
-	conStr, err := pgx.ParseConfig(fmt.Sprintf("postgresql://%v:%v@%v:%v/%v?connect_timeout=10&application_name=backup",
-		p.cfg.User, p.cfg.Password, p.cfg.Host, p.cfg.Port, defaultDbName))
+func (p PostgresProvider) getDatabaseConnection(ctx context.Context, host string, dbName string) (*pgx.Conn, error) {
+	conStr, err := pgx.ParseConfig(p.getConnectionString(host, dbName) + " connect_timeout=10")
 
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
 
-	conStr.TLSConfig = tlsConfig
+	if len(p.cfg.Password) > 0 {
+		conStr.Password = p.cfg.Password
+	}
 
 	con, err := pgx.ConnectConfig(ctx, conStr)
 
@@ -0,0 +1,88 @@
+package database
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// getConnectionString builds libpq keyword/value connection string shared by pgx and pg_dump.
+// Password is not included, it is passed separately (PGPASSWORD for pg_dump).
+func (p PostgresProvider) getConnectionString(host string, dbName string) string {
+	var params []string
+
+	add := func(key string, value string) {
+		if len(value) == 0 {
+			return
+		}
+
+		params = append(params, fmt.Sprintf("%v=%v", key, quoteConnectionValue(value)))
+	}
+
+	if dsn := strings.TrimSpace(p.cfg.Dsn); len(dsn) > 0 {
+		params = append(params, dsn)
+	}
+
+	add("service", p.cfg.Service)
+
+	port := ""
+
+	if p.cfg.Port > 0 {
+		port = strconv.Itoa(p.cfg.Port)
+	}
+
+	if h, hostPort, err := net.SplitHostPort(host); err == nil { // replica_hosts entries can have own port
+		host, port = h, hostPort
+	}
+
+	add("host", host)
+	add("port", port)
+
+	add("user", p.cfg.User)
+	add("dbname", dbName)
+	add("sslmode", p.getSslMode())
+	add("sslrootcert", p.cfg.SslRootCert)
+	add("sslcert", p.cfg.SslCert)
+	add("sslkey", p.cfg.SslKey)
+	add("application_name", "backup")
+
+	return strings.Join(params, " ")
+}
+
+// getPrimaryHost returns host (or unix socket directory) from configuration.
+func (p PostgresProvider) getPrimaryHost() string {
+	if len(p.cfg.SocketDir) > 0 {
+		return p.cfg.SocketDir
+	}
+
+	return p.cfg.Host
+}
+
+func (p PostgresProvider) getSslMode() string {
+	if len(p.cfg.SslMode) > 0 {
+		return p.cfg.SslMode
+	}
+
+	if p.cfg.TlsEnabled {
+		return "require"
+	}
+
+	if len(p.cfg.Dsn) > 0 || len(p.cfg.Service) > 0 {
+		return "" // defined by dsn or service
+	}
+
+	return "prefer"
+}
+
+// quoteConnectionValue quotes value according to libpq rules for keyword/value connection strings.
+func quoteConnectionValue(value string) string {
+	if len(value) > 0 && !strings.ContainsAny(value, " '\\\t\n") {
+		return value
+	}
+
+	value = strings.ReplaceAll(value, `\`, `\\`)
+	value = strings.ReplaceAll(value, `'`, `\'`)
+
+	return fmt.Sprintf("'%v'", value)
+}
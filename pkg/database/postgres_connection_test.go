@@ -0,0 +1,83 @@
+package database
+
+import (
+	"testing"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/skynet2/db-backup/pkg/configuration"
+)
+
+func TestGetConnectionString(t *testing.T) {
+	p := PostgresProvider{
+		cfg: configuration.PostgresConfiguration{
+			Host:        "db.local",
+			Port:        6432,
+			User:        "backup",
+			SslMode:     "verify-full",
+			SslRootCert: "/certs/ca.crt",
+			SslCert:     "/certs/my cert.crt",
+			SslKey:      "/certs/client.key",
+		},
+	}
+
+	conStr := p.getConnectionString(p.cfg.Host, "config")
+	assert.Equal(t, "host=db.local port=6432 user=backup dbname=config sslmode=verify-full "+
+		"sslrootcert=/certs/ca.crt sslcert='/certs/my cert.crt' sslkey=/certs/client.key application_name=backup", conStr)
+}
+
+func TestGetConnectionStringSocketDir(t *testing.T) {
+	p := PostgresProvider{
+		cfg: configuration.PostgresConfiguration{
+			Host:      "db.local",
+			User:      "postgres",
+			SocketDir: "/var/run/postgresql",
+		},
+	}
+
+	cfg, err := pgx.ParseConfig(p.getConnectionString(p.getPrimaryHost(), "postgres"))
+	assert.NoError(t, err)
+	assert.Equal(t, "/var/run/postgresql", cfg.Host)
+	assert.Nil(t, cfg.TLSConfig)
+}
+
+func TestGetConnectionStringDsn(t *testing.T) {
+	p := PostgresProvider{
+		cfg: configuration.PostgresConfiguration{
+			Dsn:        "host=db.local port=5433 dbname=ignored options='-c statement_timeout=0'",
+			TlsEnabled: true,
+		},
+	}
+
+	cfg, err := pgx.ParseConfig(p.getConnectionString(p.cfg.Host, "config"))
+	assert.NoError(t, err)
+	assert.Equal(t, "db.local", cfg.Host)
+	assert.Equal(t, uint16(5433), cfg.Port)
+	assert.Equal(t, "config", cfg.Database)
+	assert.NotNil(t, cfg.TLSConfig)
+}
+
+func TestQuoteConnectionValue(t *testing.T) {
+	assert.Equal(t, "simple", quoteConnectionValue("simple"))
+	assert.Equal(t, `'it\'s'`, quoteConnectionValue("it's"))
+	assert.Equal(t, `'a\\b c'`, quoteConnectionValue(`a\b c`))
+}
+
+func TestGetConnectionStringReplicaPort(t *testing.T) {
+	p := PostgresProvider{
+		cfg: configuration.PostgresConfiguration{
+			Host: "primary.local",
+			Port: 5432,
+		},
+	}
+
+	cfg, err := pgx.ParseConfig(p.getConnectionString("replica.local:6432", "config"))
+	assert.NoError(t, err)
+	assert.Equal(t, "replica.local", cfg.Host)
+	assert.Equal(t, uint16(6432), cfg.Port)
+
+	cfg, err = pgx.ParseConfig(p.getConnectionString("replica.local", "config"))
+	assert.NoError(t, err)
+	assert.Equal(t, uint16(5432), cfg.Port)
+}
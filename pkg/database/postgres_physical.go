@@ -0,0 +1,128 @@
+package database
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/cockroachdb/errors"
+
+	"github.com/skynet2/db-backup/pkg/configuration"
+)
+
+// PhysicalBackupName is the database name used for base backup of the whole cluster.
+const PhysicalBackupName = "basebackup"
+
+// PostgresPhysicalProvider creates base backup of the whole cluster using pg_basebackup.
+// Result is a single gzipped tar stream with all WAL required to restore it.
+type PostgresPhysicalProvider struct {
+	PostgresProvider
+}
+
+func NewPostgresPhysicalProvider(cfg configuration.PostgresConfiguration) Provider {
+	return &PostgresPhysicalProvider{
+		PostgresProvider: PostgresProvider{
+			cfg: cfg,
+		},
+	}
+}
+
+func (p PostgresPhysicalProvider) ListDatabase(_ context.Context) ([]string, error) {
+	return []string{PhysicalBackupName}, nil
+}
+
+// GetDatabaseSize returns size of all databases of the cluster, base backup contains all of them.
+func (p PostgresPhysicalProvider) GetDatabaseSize(ctx context.Context, _ string) (int64, error) {
+	con, err := p.getConnection(ctx, p.getPrimaryHost())
+
+	if err != nil {
+		return 0, err
+	}
+
+	defer func() {
+		_ = con.Close(ctx)
+	}()
+
+	var size int64
+
+	if err = con.QueryRow(ctx, "select coalesce(sum(pg_database_size(datname)), 0)::int8 from pg_database").
+		Scan(&size); err != nil {
+		return 0, errors.WithStack(err)
+	}
+
+	return size, nil
+}
+
+// GetTableRowCounts is not supported for base backup, which contains all databases of the cluster.
+func (p PostgresPhysicalProvider) GetTableRowCounts(_ context.Context, _ string) (map[string]int64, error) {
+	return nil, nil
+}
+
+func (p PostgresPhysicalProvider) GetFileExtension(_ BackupOptions) string {
+	return ".tar.gz"
+}
+
+func (p PostgresPhysicalProvider) GetBackupFormat(opts BackupOptions) BackupFormat {
+	return BackupFormat{
+		Format:           "tar",
+		Compression:      "gzip",
+		CompressionLevel: p.getCompressionLevel(opts),
+	}
+}
+
+func (p PostgresPhysicalProvider) BackupDatabase(
+	ctx context.Context,
+	_ string,
+	finalFileName string,
+	opts BackupOptions,
+) (string, error) {
+	host := opts.Host
+
+	if len(host) == 0 {
+		host = p.getPrimaryHost()
+	}
+
+	file, err := os.Create(finalFileName)
+
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+
+	defer func() {
+		_ = file.Close()
+	}()
+
+	// writing to stdout is only possible with fetch wal method and without additional tablespaces
+	cmd := p.newCommand(ctx, "pg_basebackup",
+		fmt.Sprintf("--dbname=%v", p.getConnectionString(host, "")),
+		"--pgdata=-",
+		"--format=tar",
+		"--wal-method=fetch",
+		fmt.Sprintf("--compress=%v", p.getCompressionLevel(opts)),
+	)
+
+	var output bytes.Buffer
+
+	cmd.Stdout = file
+	cmd.Stderr = &output
+
+	if err = cmd.Run(); err != nil {
+		return output.String(), p.wrapCommandError(ctx, "pg_basebackup", output.String(), err)
+	}
+
+	if err = file.Sync(); err != nil {
+		return output.String(), errors.WithStack(err)
+	}
+
+	return output.String(), nil
+}
+
+func (p PostgresPhysicalProvider) RestoreDatabase(_ context.Context, _ string, fileName string) (string, error) {
+	return "", errors.New(fmt.Sprintf("base backup can not be restored into running cluster, "+
+		"extract %v into empty data directory instead", fileName))
+}
+
+func (p PostgresPhysicalProvider) GetType() string {
+	return "postgres-physical"
+}
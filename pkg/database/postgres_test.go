@@ -0,0 +1,50 @@
+package database
+
+import (
+	"context"
+	"testing"
+
+	"github.com/cockroachdb/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWrapCommandErrorTransient(t *testing.T) {
+	cases := []struct {
+		output    string
+		transient bool
+	}{
+		{
+			output: `pg_dump: error: connection to server at "10.0.0.1", port 5432 failed: Connection refused
+	Is the server running on that host and accepting TCP/IP connections?`,
+			transient: true,
+		},
+		{
+			output:    `pg_dump: error: connection to server at "10.0.0.1", port 5432 failed: timeout expired`,
+			transient: true,
+		},
+		{
+			output: `pg_dump: error: connection to server at "10.0.0.1", port 5432 failed: ` +
+				`FATAL:  sorry, too many clients already`,
+			transient: true,
+		},
+		{
+			output: `pg_dump: error: connection to server at "10.0.0.1", port 5432 failed: ` +
+				`FATAL:  password authentication failed for user "backup"`,
+		},
+		{
+			output: `pg_dump: error: connection to server at "10.0.0.1", port 5432 failed: ` +
+				`FATAL:  database "missing" does not exist`,
+		},
+		{
+			output: `pg_dump: error: connection to server at "10.0.0.1", port 5432 failed: ` +
+				`FATAL:  no pg_hba.conf entry for host "10.0.0.5", user "backup", database "app", no encryption`,
+		},
+	}
+
+	p := PostgresProvider{}
+
+	for _, c := range cases {
+		err := p.wrapCommandError(context.TODO(), "pg_dump", c.output, errors.New("exit status 1"))
+		assert.Equal(t, c.transient, errors.Is(err, ErrTransient), c.output)
+	}
+}
@@ -1,13 +1,41 @@
 package database
 
-import "context"
+import (
+	"context"
+
+	"github.com/cockroachdb/errors"
+)
+
+// ErrTransient marks backup errors which can be retried (connection reset, lock timeout etc.)
+var ErrTransient = errors.New("transient database error")
 
 type Provider interface {
 	Validate(ctx context.Context) error
 	ListDatabase(ctx context.Context) ([]string, error)
-	BackupDatabase(ctx context.Context, databaseName string, finalFileName string) (string, error)
+	GetDatabaseSize(ctx context.Context, databaseName string) (int64, error)              // bytes on disk, estimate of dump size
+	GetTableRowCounts(ctx context.Context, databaseName string) (map[string]int64, error) // approximate, by table name
+	BackupDatabase(ctx context.Context, databaseName string, finalFileName string, opts BackupOptions) (string, error)
+	RestoreDatabase(ctx context.Context, databaseName string, fileName string) (string, error)
+	SelectHost(ctx context.Context) (string, error)
+	GetFileExtension(opts BackupOptions) string
+	GetBackupFormat(opts BackupOptions) BackupFormat
 	GetType() string
 }
+
+// BackupOptions overrides provider configuration for a single backup. Zero values -> provider defaults.
+type BackupOptions struct {
+	CompressionLevel int
+	Format           string
+	Host             string // result of SelectHost
+}
+
+// BackupFormat describes backup file produced by provider.
+type BackupFormat struct {
+	Format           string
+	Compression      string // none, gzip
+	CompressionLevel int
+}
+
 type Parameter struct {
 	Name        string
 	Description string
@@ -0,0 +1,194 @@
+package hooks
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cockroachdb/errors"
+	"github.com/rs/zerolog"
+
+	"github.com/skynet2/db-backup/pkg/configuration"
+)
+
+const defaultTimeout = 5 * time.Minute
+
+type DefaultService struct {
+	hooks map[Event][]configuration.HookConfiguration
+}
+
+func NewDefaultService(cfg configuration.HooksConfiguration) Service {
+	return &DefaultService{
+		hooks: map[Event][]configuration.HookConfiguration{
+			EventBeforeRun:   cfg.BeforeRun,
+			EventAfterRun:    cfg.AfterRun,
+			EventBeforeDump:  cfg.BeforeDump,
+			EventAfterDump:   cfg.AfterDump,
+			EventAfterUpload: cfg.AfterUpload,
+			EventOnFailure:   cfg.OnFailure,
+		},
+	}
+}
+
+// Run executes all hooks for event one by one. Stops on first error, unless hook has continue_on_error.
+func (d *DefaultService) Run(ctx context.Context, event Event, data Data) error {
+	for i, hook := range d.hooks[event] {
+		name := hook.Name
+
+		if len(name) == 0 {
+			name = fmt.Sprintf("%v#%v", event, i)
+		}
+
+		logger := zerolog.Ctx(ctx).With().Str("hook", name).Logger()
+		logger.Info().Msgf("executing %v hook %v", event, name)
+
+		if err := d.runHook(logger.WithContext(ctx), hook, event, data); err != nil {
+			err = errors.Wrapf(err, "hook %v failed", name)
+
+			if !hook.ContinueOnError {
+				return err
+			}
+
+			logger.Warn().Err(err).Msg("ignoring hook error due to continue_on_error")
+		}
+	}
+
+	return nil
+}
+
+func (d *DefaultService) runHook(
+	ctx context.Context,
+	hook configuration.HookConfiguration,
+	event Event,
+	data Data,
+) error {
+	timeout := hook.Timeout
+
+	if timeout == 0 {
+		timeout = defaultTimeout
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	switch {
+	case len(hook.Command) > 0:
+		return d.runCommand(ctx, hook, event, data)
+	case len(hook.Url) > 0:
+		return d.runHttp(ctx, hook, event, data)
+	default:
+		return errors.New("hook has neither command nor url")
+	}
+}
+
+func (d *DefaultService) runCommand(
+	ctx context.Context,
+	hook configuration.HookConfiguration,
+	event Event,
+	data Data,
+) error {
+	cmd := exec.CommandContext(ctx, "sh", "-c", hook.Command)
+	cmd.Env = append(os.Environ(), d.getEnv(event, data)...)
+
+	output, err := cmd.CombinedOutput()
+
+	zerolog.Ctx(ctx).Debug().Msgf("hook output: %v", string(output))
+
+	if err != nil {
+		return errors.Wrap(err, string(output))
+	}
+
+	return nil
+}
+
+func (d *DefaultService) runHttp(
+	ctx context.Context,
+	hook configuration.HookConfiguration,
+	event Event,
+	data Data,
+) error {
+	body := struct {
+		Event Event `json:"event"`
+		Data
+		Error string `json:"error,omitempty"`
+	}{
+		Event: event,
+		Data:  data,
+	}
+
+	if data.Error != nil {
+		body.Error = data.Error.Error()
+	}
+
+	payload, err := json.Marshal(body)
+
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	method := strings.ToUpper(hook.Method)
+
+	if len(method) == 0 {
+		method = http.MethodPost
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, hook.Url, bytes.NewBuffer(payload))
+
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+
+	for k, v := range hook.Headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	respBody, _ := io.ReadAll(resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return errors.New(fmt.Sprintf("unexpected status code from hook %v and body [%v]", resp.StatusCode,
+			string(respBody)))
+	}
+
+	return nil
+}
+
+func (d *DefaultService) getEnv(event Event, data Data) []string {
+	env := []string{
+		fmt.Sprintf("DB_BACKUP_EVENT=%v", event),
+		fmt.Sprintf("DB_BACKUP_SOURCE=%v", data.Source),
+		fmt.Sprintf("DB_BACKUP_DATABASE=%v", data.DatabaseName),
+		fmt.Sprintf("DB_BACKUP_FILE=%v", data.FileLocation),
+		fmt.Sprintf("DB_BACKUP_STORAGE_KEY=%v", data.StorageKey),
+		fmt.Sprintf("DB_BACKUP_SIZE=%v", strconv.FormatInt(data.FileSize, 10)),
+		fmt.Sprintf("DB_BACKUP_CHECKSUM=%v", data.Checksum),
+		fmt.Sprintf("DB_BACKUP_STATUS=%v", data.Status),
+	}
+
+	errStr := ""
+
+	if data.Error != nil {
+		errStr = data.Error.Error()
+	}
+
+	return append(env, fmt.Sprintf("DB_BACKUP_ERROR=%v", errStr))
+}
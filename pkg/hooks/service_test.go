@@ -0,0 +1,87 @@
+package hooks
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cockroachdb/errors"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/skynet2/db-backup/pkg/configuration"
+)
+
+func TestCommandHookEnv(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "out")
+
+	srv := NewDefaultService(configuration.HooksConfiguration{
+		AfterUpload: []configuration.HookConfiguration{
+			{
+				Command: "echo \"$DB_BACKUP_EVENT $DB_BACKUP_DATABASE $DB_BACKUP_STORAGE_KEY $DB_BACKUP_SIZE\" > " + out,
+			},
+		},
+	})
+
+	assert.NoError(t, srv.Run(context.TODO(), EventAfterUpload, Data{
+		DatabaseName: "config",
+		StorageKey:   "host/config/db-config-1.sql.gzip",
+		FileSize:     42,
+	}))
+
+	data, err := os.ReadFile(out)
+	assert.NoError(t, err)
+	assert.Equal(t, "after_upload config host/config/db-config-1.sql.gzip 42\n", string(data))
+}
+
+func TestCommandHookContinueOnError(t *testing.T) {
+	srv := NewDefaultService(configuration.HooksConfiguration{
+		BeforeDump: []configuration.HookConfiguration{
+			{
+				Command:         "exit 1",
+				ContinueOnError: true,
+			},
+		},
+		AfterDump: []configuration.HookConfiguration{
+			{
+				Command: "exit 1",
+			},
+		},
+	})
+
+	assert.NoError(t, srv.Run(context.TODO(), EventBeforeDump, Data{}))
+	assert.Error(t, srv.Run(context.TODO(), EventAfterDump, Data{}))
+	assert.NoError(t, srv.Run(context.TODO(), EventOnFailure, Data{}))
+}
+
+func TestHttpHook(t *testing.T) {
+	var body map[string]any
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "secret", r.Header.Get("X-Token"))
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+	}))
+	defer server.Close()
+
+	srv := NewDefaultService(configuration.HooksConfiguration{
+		OnFailure: []configuration.HookConfiguration{
+			{
+				Url: server.URL,
+				Headers: map[string]string{
+					"X-Token": "secret",
+				},
+			},
+		},
+	})
+
+	assert.NoError(t, srv.Run(context.TODO(), EventOnFailure, Data{
+		DatabaseName: "config",
+		Error:        errors.New("dump failed"),
+	}))
+	assert.Equal(t, "on_failure", body["event"])
+	assert.Equal(t, "config", body["database_name"])
+	assert.Equal(t, "dump failed", body["error"])
+}
@@ -0,0 +1,31 @@
+package hooks
+
+import "context"
+
+type Event string
+
+const (
+	EventBeforeRun   Event = "before_run"
+	EventAfterRun    Event = "after_run"
+	EventBeforeDump  Event = "before_dump"
+	EventAfterDump   Event = "after_dump"
+	EventAfterUpload Event = "after_upload"
+	EventOnFailure   Event = "on_failure"
+)
+
+type Service interface {
+	Run(ctx context.Context, event Event, data Data) error
+}
+
+// Data describes the job (or the whole run) for hooks.
+// Passed as DB_BACKUP_* environment variables for commands and as json body for http hooks.
+type Data struct {
+	Source       string `json:"source"`
+	DatabaseName string `json:"database_name,omitempty"`
+	FileLocation string `json:"file_location,omitempty"`
+	StorageKey   string `json:"storage_key,omitempty"`
+	FileSize     int64  `json:"file_size,omitempty"`
+	Checksum     string `json:"checksum,omitempty"`
+	Status       string `json:"status,omitempty"`
+	Error        error  `json:"-"`
+}
@@ -0,0 +1,89 @@
+package manifest
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/cockroachdb/errors"
+	"github.com/samber/lo"
+
+	"github.com/skynet2/db-backup/pkg/storage"
+)
+
+// SchemaVersion is incremented on incompatible changes of the manifest format.
+const SchemaVersion = 1
+
+// Manifest is a catalog of backups of a single database stored next to the backups.
+type Manifest struct {
+	SchemaVersion int       `json:"schema_version"`
+	Source        string    `json:"source"`
+	Database      string    `json:"database"`
+	UpdatedAt     time.Time `json:"updated_at"`
+	Backups       []Entry   `json:"backups"` // oldest first
+}
+
+// Entry describes a single backup.
+type Entry struct {
+	Key                 string    `json:"key"`
+	CreatedAt           time.Time `json:"created_at"`
+	Size                int64     `json:"size"`
+	Checksum            string    `json:"checksum"`           // hex encoded
+	ChecksumAlgorithm   string    `json:"checksum_algorithm"` // sha256
+	Format              string    `json:"format"`
+	Compression         string    `json:"compression"`
+	CompressionLevel    int       `json:"compression_level"`
+	EncryptionRecipient string    `json:"encryption_recipient"` // empty, encryption is not supported yet
+	SourceHost          string    `json:"source_host"`
+	ToolVersion         string    `json:"tool_version"`
+}
+
+// Load reads manifest from the storage. Empty manifest is returned if it does not exist yet.
+func Load(ctx context.Context, provider storage.Provider, key string) (Manifest, error) {
+	m := Manifest{
+		SchemaVersion: SchemaVersion,
+	}
+
+	data, found, err := storage.DownloadIfExists(ctx, provider, key)
+
+	if err != nil {
+		return m, errors.WithStack(err)
+	}
+
+	if !found {
+		return m, nil
+	}
+
+	if err = json.Unmarshal(data, &m); err != nil {
+		return m, errors.Wrapf(err, "invalid manifest %v", key)
+	}
+
+	return m, nil
+}
+
+// Save uploads manifest to the storage. Temporary file is created in tempDir.
+func Save(ctx context.Context, provider storage.Provider, key string, tempDir string, m Manifest) error {
+	m.SchemaVersion = SchemaVersion
+	m.UpdatedAt = time.Now().UTC()
+
+	data, err := json.MarshalIndent(m, "", "  ")
+
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	return storage.UploadBytes(ctx, provider, key, data, tempDir, storage.UploadOptions{})
+}
+
+// Add adds backup to the manifest replacing entry with the same key.
+func (m *Manifest) Add(entry Entry) {
+	m.Remove(entry.Key)
+	m.Backups = append(m.Backups, entry)
+}
+
+// Remove removes backups with specified keys from the manifest.
+func (m *Manifest) Remove(keys ...string) {
+	m.Backups = lo.Filter(m.Backups, func(e Entry, _ int) bool {
+		return !lo.Contains(keys, e.Key)
+	})
+}
@@ -0,0 +1,20 @@
+package manifest
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAddRemove(t *testing.T) {
+	m := Manifest{}
+
+	m.Add(Entry{Key: "a", Size: 1})
+	m.Add(Entry{Key: "b", Size: 2})
+	m.Add(Entry{Key: "a", Size: 3})
+
+	assert.Equal(t, []Entry{{Key: "b", Size: 2}, {Key: "a", Size: 3}}, m.Backups)
+
+	m.Remove("a", "c")
+	assert.Equal(t, []Entry{{Key: "b", Size: 2}}, m.Backups)
+}
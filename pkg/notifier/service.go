@@ -109,7 +109,7 @@ Destination: {{.destination}}
 
 Databases:
 {{ range $key, $value := .databases }}
-{{ $key }}: completed in {{ $value.completed_in}}.{{if $value.size }} Size {{$value.size}}.{{end}} {{ if $value.error }}Error : {{$value.error}} {{end}}{{ end }}
+{{ $key }}: completed in {{ $value.completed_in}}.{{if $value.size }} Size {{$value.size}}.{{end}}{{if $value.compression_ratio }} Database {{$value.database_size}}, ratio {{$value.compression_ratio}}.{{end}}{{if $value.db_host }} Db host {{$value.db_host}}.{{end}}{{if $value.locked_files }} Locked files kept: {{len $value.locked_files}}.{{end}} {{ if $value.error }}Error : {{$value.error}} {{end}}{{ end }}
 `
 	}
 
@@ -132,6 +132,7 @@ Databases:
 	}
 
 	dbs := map[string]interface{}{}
+	multipleSources := d.hasMultipleSources(results)
 
 	for _, j := range results {
 		if len(j.StorageProviderType) > 0 {
@@ -140,15 +141,38 @@ Databases:
 
 		item := map[string]interface{}{
 			"completed_in":        j.EndAt.Sub(j.StartedAt).String(),
-			"size":                d.byteCountSI(j.FileSize),
+			"size":                common.ByteCountSI(j.FileSize),
 			"backup_completed_in": j.DatabaseBackupEndedAt.Sub(j.DatabaseBackupStartedAt).String(),
+			"source":              j.SourceName,
+			"db_host":             j.DatabaseHost,
+			"dump_attempts":       j.DumpAttempts,
+			"checksum":            j.Checksum,
+			"locked_files":        j.LockedFiles,
+		}
+
+		if j.DatabaseSize > 0 {
+			item["database_size"] = common.ByteCountSI(j.DatabaseSize)
+		}
+
+		if j.DatabaseSize > 0 && j.FileSize > 0 {
+			item["compression_ratio"] = fmt.Sprintf("%.1fx", float64(j.DatabaseSize)/float64(j.FileSize))
 		}
 
 		if j.Error != nil {
 			item["error"] = fmt.Sprintf("%+v", j.Error)
 		}
 
-		dbs[j.DatabaseName] = item
+		key := j.DatabaseName
+
+		if multipleSources {
+			key = fmt.Sprintf("%v/%v", j.SourceName, j.DatabaseName)
+		}
+
+		if len(j.DatabaseName) == 0 { // source level error
+			key = j.SourceName
+		}
+
+		dbs[key] = item
 	}
 
 	templateParameters["output"] = strconv.FormatBool(d.isSuccess(results))
@@ -161,16 +185,12 @@ Databases:
 	return buf.String(), nil
 }
 
-func (d *DefaultService) byteCountSI(b int64) string {
-	const unit = 1000
-	if b < unit {
-		return fmt.Sprintf("%d B", b)
-	}
-	div, exp := int64(unit), 0
-	for n := b / unit; n >= unit; n /= unit {
-		div *= unit
-		exp++
+func (d *DefaultService) hasMultipleSources(results []common.Job) bool {
+	for _, r := range results {
+		if r.SourceName != results[0].SourceName {
+			return true
+		}
 	}
-	return fmt.Sprintf("%.1f %cB",
-		float64(b)/float64(div), "kMGTPE"[exp])
+
+	return false
 }
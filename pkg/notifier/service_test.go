@@ -0,0 +1,51 @@
+package notifier
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/skynet2/db-backup/pkg/common"
+)
+
+func TestRenderTemplateLockedFiles(t *testing.T) {
+	srv := &DefaultService{}
+	startedAt := time.Date(2024, 5, 10, 12, 0, 0, 0, time.UTC)
+
+	msg, err := srv.renderTemplate("", []common.Job{
+		{
+			DatabaseName: "config",
+			StartedAt:    startedAt,
+			EndAt:        startedAt.Add(time.Minute),
+			FileSize:     2000,
+			LockedFiles:  []string{"config/db-config-1.sql.gzip", "config/db-config-2.sql.gzip"},
+		},
+		{
+			DatabaseName: "events",
+			StartedAt:    startedAt,
+			EndAt:        startedAt.Add(time.Minute),
+		},
+	})
+
+	assert.NoError(t, err)
+	assert.Contains(t, msg, "config: completed in 1m0s. Size 2.0 kB. Locked files kept: 2.")
+	assert.NotContains(t, msg, "events: completed in 1m0s. Locked")
+}
+
+func TestRenderCustomTemplateLockedFiles(t *testing.T) {
+	srv := &DefaultService{}
+
+	msg, err := srv.renderTemplate(
+		`{{ range $key, $value := .databases }}{{ range $value.locked_files }}{{ . }};{{ end }}{{ end }}`,
+		[]common.Job{
+			{
+				DatabaseName: "config",
+				LockedFiles:  []string{"config/db-config-1.sql.gzip", "config/db-config-2.sql.gzip"},
+			},
+		},
+	)
+
+	assert.NoError(t, err)
+	assert.Equal(t, "config/db-config-1.sql.gzip;config/db-config-2.sql.gzip;", msg)
+}
@@ -0,0 +1,142 @@
+package report
+
+import (
+	"os"
+	"time"
+
+	"github.com/skynet2/db-backup/pkg/common"
+)
+
+// SchemaVersion is incremented on incompatible changes of the report format.
+const SchemaVersion = 1
+
+const (
+	StatusSuccess = "success"
+	StatusFailure = "failure"
+)
+
+// Report is a machine-readable result of the run. Field names are part of the stable schema.
+type Report struct {
+	SchemaVersion int         `json:"schema_version"`
+	ToolVersion   string      `json:"tool_version"`
+	Host          string      `json:"host"`
+	Command       string      `json:"command"`
+	DryRun        bool        `json:"dry_run"`
+	Status        string      `json:"status"`
+	StartedAt     time.Time   `json:"started_at"`
+	EndedAt       time.Time   `json:"ended_at"`
+	Jobs          []JobReport `json:"jobs"`
+}
+
+// JobReport describes a single database job, see common.Job.
+type JobReport struct {
+	Source          string           `json:"source"`
+	Database        string           `json:"database"`
+	DatabaseHost    string           `json:"database_host"`
+	Status          string           `json:"status"`
+	StartedAt       time.Time        `json:"started_at"`
+	EndedAt         time.Time        `json:"ended_at"`
+	DurationSeconds float64          `json:"duration_seconds"`
+	DumpStartedAt   *time.Time       `json:"dump_started_at"`
+	DumpEndedAt     *time.Time       `json:"dump_ended_at"`
+	DumpAttempts    int              `json:"dump_attempts"`
+	DumpOutput      string           `json:"dump_output"`
+	LocalFile       string           `json:"local_file"`
+	FileSize        int64            `json:"file_size"`
+	DatabaseSize    int64            `json:"database_size"`        // live database size before dump, 0 if unknown
+	TableRows       map[string]int64 `json:"table_rows,omitempty"` // approximate, with collect_row_counts
+	Checksum        string           `json:"checksum"`
+	StorageType     string           `json:"storage_type"`
+	StorageKey      string           `json:"storage_key"`
+	UploadStartedAt *time.Time       `json:"upload_started_at"`
+	UploadEndedAt   *time.Time       `json:"upload_ended_at"`
+	RemovedFiles    []string         `json:"removed_files"`
+	LockedFiles     []string         `json:"locked_files"` // skipped by retention because of object lock
+	Error           *string          `json:"error"`
+}
+
+// New creates report of the command for job results.
+func New(command string, dryRun bool, startedAt time.Time, jobs []common.Job) Report {
+	hostName, _ := os.Hostname()
+
+	r := Report{
+		SchemaVersion: SchemaVersion,
+		ToolVersion:   common.Version,
+		Host:          hostName,
+		Command:       command,
+		DryRun:        dryRun,
+		Status:        StatusSuccess,
+		StartedAt:     startedAt,
+		EndedAt:       time.Now().UTC(),
+		Jobs:          make([]JobReport, 0, len(jobs)),
+	}
+
+	if len(jobs) == 0 {
+		r.Status = StatusFailure
+	}
+
+	for _, j := range jobs {
+		jobReport := NewJobReport(j)
+
+		if jobReport.Status != StatusSuccess {
+			r.Status = StatusFailure
+		}
+
+		r.Jobs = append(r.Jobs, jobReport)
+	}
+
+	return r
+}
+
+// NewJobReport converts job into serializable form.
+func NewJobReport(j common.Job) JobReport {
+	jobReport := JobReport{
+		Source:          j.SourceName,
+		Database:        j.DatabaseName,
+		DatabaseHost:    j.DatabaseHost,
+		Status:          StatusSuccess,
+		StartedAt:       j.StartedAt,
+		EndedAt:         j.EndAt,
+		DurationSeconds: j.EndAt.Sub(j.StartedAt).Seconds(),
+		DumpStartedAt:   optionalTime(j.DatabaseBackupStartedAt),
+		DumpEndedAt:     optionalTime(j.DatabaseBackupEndedAt),
+		DumpAttempts:    j.DumpAttempts,
+		DumpOutput:      j.Output,
+		LocalFile:       j.FileLocation,
+		FileSize:        j.FileSize,
+		DatabaseSize:    j.DatabaseSize,
+		TableRows:       j.TableRows,
+		Checksum:        j.Checksum,
+		StorageType:     j.StorageProviderType,
+		StorageKey:      j.StorageFileLocation,
+		UploadStartedAt: j.StorageProviderStartedAt,
+		UploadEndedAt:   j.UploadEndedAt,
+		RemovedFiles:    j.RemovedFiles,
+		LockedFiles:     j.LockedFiles,
+	}
+
+	if jobReport.RemovedFiles == nil {
+		jobReport.RemovedFiles = []string{}
+	}
+
+	if jobReport.LockedFiles == nil {
+		jobReport.LockedFiles = []string{}
+	}
+
+	if j.Error != nil {
+		errStr := j.Error.Error()
+
+		jobReport.Status = StatusFailure
+		jobReport.Error = &errStr
+	}
+
+	return jobReport
+}
+
+func optionalTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+
+	return &t
+}
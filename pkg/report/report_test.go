@@ -0,0 +1,50 @@
+package report
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/errors"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/skynet2/db-backup/pkg/common"
+)
+
+func TestNew(t *testing.T) {
+	startedAt := time.Date(2024, 5, 10, 12, 0, 0, 0, time.UTC)
+
+	r := New("backup", false, startedAt, []common.Job{
+		{
+			SourceName:              "cluster-a",
+			DatabaseName:            "config",
+			StartedAt:               startedAt,
+			EndAt:                   startedAt.Add(90 * time.Second),
+			DatabaseBackupStartedAt: startedAt,
+			StorageFileLocation:     "cluster-a/config/db-config-2024_05_10-12_00_00.sql.gzip",
+			FileSize:                1024,
+			DatabaseSize:            4096,
+		},
+		{
+			SourceName:   "cluster-a",
+			DatabaseName: "stats",
+			Error:        errors.New("pg_dump failed"),
+		},
+	})
+
+	assert.Equal(t, StatusFailure, r.Status)
+	assert.Len(t, r.Jobs, 2)
+	assert.Equal(t, StatusSuccess, r.Jobs[0].Status)
+	assert.Equal(t, 90.0, r.Jobs[0].DurationSeconds)
+	assert.NotNil(t, r.Jobs[0].DumpStartedAt)
+	assert.Nil(t, r.Jobs[0].DumpEndedAt)
+	assert.Equal(t, "pg_dump failed", *r.Jobs[1].Error)
+
+	data, err := json.Marshal(r.Jobs[0])
+	assert.NoError(t, err)
+	assert.Contains(t, string(data), `"storage_key":"cluster-a/config/db-config-2024_05_10-12_00_00.sql.gzip"`)
+	assert.Contains(t, string(data), `"error":null`)
+	assert.Contains(t, string(data), `"removed_files":[]`)
+	assert.Contains(t, string(data), `"database_size":4096`)
+	assert.NotContains(t, string(data), `"table_rows"`)
+}
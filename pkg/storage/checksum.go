@@ -0,0 +1,82 @@
+package storage
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"hash"
+	"io"
+
+	"github.com/cockroachdb/errors"
+)
+
+const (
+	ChecksumSha256 = "sha256"
+	ChecksumMd5    = "md5"
+	ChecksumNone   = "none"
+
+	checksumMetadataKey = "Sha256" // x-amz-meta-sha256, canonical header form
+)
+
+// FileChecksum returns hex encoded sha256 of the file and rewinds it.
+func FileChecksum(file UploadFile) (string, error) {
+	sum, err := fileHash(file, sha256.New())
+
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(sum), nil
+}
+
+func fileHash(file UploadFile, h hash.Hash) ([]byte, error) {
+	if err := readFile(file, h); err != nil {
+		return nil, err
+	}
+
+	return h.Sum(nil), nil
+}
+
+// readFile copies the whole file into writer and rewinds it.
+// It is used only for checksums, so upload rate limit is not applied.
+func readFile(file UploadFile, writer io.Writer) error {
+	file = withoutThrottling(file)
+
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return errors.WithStack(err)
+	}
+
+	if _, err := io.Copy(writer, file); err != nil {
+		return errors.WithStack(err)
+	}
+
+	_, err := file.Seek(0, io.SeekStart)
+
+	return errors.WithStack(err)
+}
+
+// partChecksum returns base64 encoded checksum of the data for Content-MD5 or x-amz-checksum-sha256 header.
+func partChecksum(algorithm string, data []byte) string {
+	switch algorithm {
+	case ChecksumMd5:
+		sum := md5.Sum(data)
+
+		return base64.StdEncoding.EncodeToString(sum[:])
+	default:
+		sum := sha256.Sum256(data)
+
+		return base64.StdEncoding.EncodeToString(sum[:])
+	}
+}
+
+// hexToBase64 converts hex encoded checksum into base64 form used by S3 headers.
+func hexToBase64(checksum string) (string, error) {
+	raw, err := hex.DecodeString(checksum)
+
+	if err != nil {
+		return "", errors.Wrap(err, "invalid checksum")
+	}
+
+	return base64.StdEncoding.EncodeToString(raw), nil
+}
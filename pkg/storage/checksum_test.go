@@ -0,0 +1,37 @@
+package storage
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileChecksum(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dump")
+	assert.NoError(t, os.WriteFile(path, []byte("hello"), 0600))
+
+	file, err := os.Open(path)
+	assert.NoError(t, err)
+
+	defer func() {
+		_ = file.Close()
+	}()
+
+	_, err = file.Seek(2, io.SeekStart)
+	assert.NoError(t, err)
+
+	checksum, err := FileChecksum(file)
+	assert.NoError(t, err)
+	assert.Equal(t, "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824", checksum)
+
+	data, err := io.ReadAll(file)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(data))
+
+	b64, err := hexToBase64(checksum)
+	assert.NoError(t, err)
+	assert.Equal(t, partChecksum(ChecksumSha256, []byte("hello")), b64)
+}
@@ -0,0 +1,63 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path"
+
+	"github.com/cockroachdb/errors"
+	"github.com/samber/lo"
+)
+
+// UploadBytes uploads small in-memory data (manifests, locks, reports) to key.
+// Providers upload files, so data is written to a temporary file created in tempDir first.
+func UploadBytes(
+	ctx context.Context,
+	provider Provider,
+	key string,
+	data []byte,
+	tempDir string,
+	opts UploadOptions,
+) error {
+	tmp, err := os.CreateTemp(tempDir, "upload-*"+path.Ext(key))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	defer func() {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+	}()
+
+	if _, err = tmp.Write(data); err != nil {
+		return errors.WithStack(err)
+	}
+
+	if _, err = tmp.Seek(0, io.SeekStart); err != nil {
+		return errors.WithStack(err)
+	}
+
+	return provider.Upload(ctx, key, tmp, opts)
+}
+
+// DownloadIfExists downloads small object into memory, found is false if there is no object with the key.
+func DownloadIfExists(ctx context.Context, provider Provider, key string) ([]byte, bool, error) {
+	files, err := provider.List(ctx, key)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if !lo.ContainsBy(files, func(f File) bool { return f.AbsolutePath == key }) {
+		return nil, false, nil
+	}
+
+	var buf bytes.Buffer
+
+	if err = provider.Download(ctx, key, &buf); err != nil {
+		return nil, false, err
+	}
+
+	return buf.Bytes(), true, nil
+}
@@ -0,0 +1,35 @@
+package storage
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUploadAndDownloadBytes(t *testing.T) {
+	fake, cfg := newFakeS3(t)
+	provider := NewS3Provider(cfg)
+	dir := t.TempDir()
+
+	data, found, err := DownloadIfExists(context.TODO(), provider, "db/manifest-db.json")
+	assert.NoError(t, err)
+	assert.False(t, found)
+	assert.Nil(t, data)
+
+	assert.NoError(t, UploadBytes(context.TODO(), provider, "db/manifest-db.json.old", []byte("old"), dir,
+		UploadOptions{}))
+	assert.NoError(t, UploadBytes(context.TODO(), provider, "db/manifest-db.json", []byte(`{"a":1}`), dir,
+		UploadOptions{}))
+	assert.Equal(t, `{"a":1}`, string(fake.objects["db/manifest-db.json"]))
+
+	data, found, err = DownloadIfExists(context.TODO(), provider, "db/manifest-db.json")
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, `{"a":1}`, string(data))
+
+	entries, err := os.ReadDir(dir)
+	assert.NoError(t, err)
+	assert.Empty(t, entries)
+}
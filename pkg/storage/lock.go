@@ -0,0 +1,255 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/errors"
+	"github.com/rs/zerolog"
+)
+
+const (
+	DefaultLockKey   = "db-backup.lock"
+	DefaultLockLease = 5 * time.Minute
+)
+
+// ErrLockHeld is returned by AcquireLock if the lock belongs to another run and is not stale.
+var ErrLockHeld = errors.New("lock is held by another run")
+
+// lockSettleDelay is the time between writing the lock and reading it back. Storage has no compare-and-swap,
+// so two runs can write the lock at the same time, only the run which reads its own lock back holds it.
+var lockSettleDelay = 2 * time.Second
+
+// LockInfo is the content of the lock object.
+type LockInfo struct {
+	RunId      string    `json:"run_id"`
+	Host       string    `json:"host"`
+	AcquiredAt time.Time `json:"acquired_at"`
+	ExpiresAt  time.Time `json:"expires_at"` // extended by heartbeat, lock is stale after it
+	Released   bool      `json:"released,omitempty"`
+}
+
+type LockOptions struct {
+	Key     string          // DefaultLockKey if empty
+	RunId   string          // owner of the lock
+	Lease   time.Duration   // DefaultLockLease if empty, lock is renewed every third of the lease
+	TempDir string          // directory for the lock file uploaded to storage
+	OnLost  func(err error) // called once if lock is taken over or can not be renewed before it expires
+}
+
+// Lock is a lease based lock object in the storage, held until Release.
+// Lock is best effort: it prevents overlapping runs, but two runs started within lockSettleDelay may
+// both acquire it, in that case heartbeat of one of them notices the other owner and reports the lock lost.
+// Lock object is never removed, Release overwrites it as released, so bucket default object lock retention
+// (which applies to the lock object too) does not prevent releasing it.
+type Lock struct {
+	provider Provider
+	opts     LockOptions
+	info     LockInfo
+
+	stop     chan struct{}
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+// AcquireLock makes a single attempt to acquire the lock, ErrLockHeld is returned if it is held by another run.
+// Stale lock (not renewed within its lease, ex. owner was killed) is taken over.
+func AcquireLock(ctx context.Context, provider Provider, opts LockOptions) (*Lock, error) {
+	if len(opts.Key) == 0 {
+		opts.Key = DefaultLockKey
+	}
+
+	if opts.Lease <= 0 {
+		opts.Lease = DefaultLockLease
+	}
+
+	if len(opts.RunId) == 0 {
+		return nil, errors.New("lock requires run id")
+	}
+
+	current, found, err := readLock(ctx, provider, opts.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+
+	if found && !current.Released && current.RunId != opts.RunId {
+		if now.Before(current.ExpiresAt) {
+			return nil, errors.Mark(errors.New(fmt.Sprintf("lock %v is held by run %v on %v since %v, expires at %v",
+				opts.Key, current.RunId, current.Host, current.AcquiredAt, current.ExpiresAt)), ErrLockHeld)
+		}
+
+		zerolog.Ctx(ctx).Warn().Msgf("taking over stale lock %v of run %v on %v, expired at %v",
+			opts.Key, current.RunId, current.Host, current.ExpiresAt)
+	}
+
+	hostName, _ := os.Hostname()
+
+	l := &Lock{
+		provider: provider,
+		opts:     opts,
+		info: LockInfo{
+			RunId:      opts.RunId,
+			Host:       hostName,
+			AcquiredAt: now,
+			ExpiresAt:  now.Add(opts.Lease),
+		},
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+
+	if err = l.write(ctx, l.info); err != nil {
+		return nil, err
+	}
+
+	select {
+	case <-time.After(lockSettleDelay):
+	case <-ctx.Done():
+		l.releaseIfOwned(context.WithoutCancel(ctx))
+		return nil, errors.WithStack(ctx.Err())
+	}
+
+	owner, err := l.getOwner(ctx)
+	if err != nil {
+		l.releaseIfOwned(context.WithoutCancel(ctx))
+		return nil, err
+	}
+
+	if owner.RunId != opts.RunId {
+		return nil, errors.Mark(errors.New(fmt.Sprintf("lock %v was acquired by run %v on %v at the same time",
+			opts.Key, owner.RunId, owner.Host)), ErrLockHeld)
+	}
+
+	go l.heartbeat(context.WithoutCancel(ctx))
+
+	return l, nil
+}
+
+// Release stops heartbeat and marks the lock released if it still belongs to the run.
+func (l *Lock) Release(ctx context.Context) error {
+	l.stopOnce.Do(func() {
+		close(l.stop)
+	})
+
+	<-l.done
+
+	owner, err := l.getOwner(ctx)
+	if err != nil {
+		return err
+	}
+
+	if owner.RunId != l.opts.RunId {
+		return nil // taken over, OnLost was already called
+	}
+
+	return l.release(ctx)
+}
+
+func (l *Lock) heartbeat(ctx context.Context) {
+	defer close(l.done)
+
+	ticker := time.NewTicker(l.opts.Lease / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+		}
+
+		err := l.renew(ctx)
+		if err == nil {
+			continue
+		}
+
+		if !errors.Is(err, ErrLockHeld) && time.Now().Before(l.info.ExpiresAt) {
+			zerolog.Ctx(ctx).Warn().Err(err).Msgf("can not renew lock %v, will retry", l.opts.Key)
+			continue
+		}
+
+		if l.opts.OnLost != nil {
+			l.opts.OnLost(errors.Wrapf(err, "lock %v is lost", l.opts.Key))
+		}
+
+		return
+	}
+}
+
+func (l *Lock) renew(ctx context.Context) error {
+	owner, err := l.getOwner(ctx)
+	if err != nil {
+		return err
+	}
+
+	if owner.RunId != l.opts.RunId {
+		return errors.Mark(errors.New(fmt.Sprintf("lock was taken over by run %v on %v", owner.RunId,
+			owner.Host)), ErrLockHeld)
+	}
+
+	renewed := l.info
+	renewed.ExpiresAt = time.Now().UTC().Add(l.opts.Lease)
+
+	if err = l.write(ctx, renewed); err != nil {
+		return err
+	}
+
+	l.info = renewed
+
+	return nil
+}
+
+// getOwner returns the current content of the lock, empty if lock does not exist.
+func (l *Lock) getOwner(ctx context.Context) (LockInfo, error) {
+	info, _, err := readLock(ctx, l.provider, l.opts.Key)
+
+	return info, err
+}
+
+func (l *Lock) releaseIfOwned(ctx context.Context) {
+	if owner, err := l.getOwner(ctx); err == nil && owner.RunId == l.opts.RunId {
+		_ = l.release(ctx)
+	}
+}
+
+func (l *Lock) release(ctx context.Context) error {
+	released := l.info
+	released.ExpiresAt = time.Now().UTC()
+	released.Released = true
+
+	return l.write(ctx, released)
+}
+
+func (l *Lock) write(ctx context.Context, info LockInfo) error {
+	data, err := json.Marshal(info)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	return errors.Wrapf(UploadBytes(ctx, l.provider, l.opts.Key, data, l.opts.TempDir, UploadOptions{}),
+		"can not write lock %v", l.opts.Key)
+}
+
+func readLock(ctx context.Context, provider Provider, key string) (LockInfo, bool, error) {
+	var info LockInfo
+
+	data, found, err := DownloadIfExists(ctx, provider, key)
+	if err != nil {
+		return info, false, errors.Wrapf(err, "can not read lock %v", key)
+	}
+
+	if !found {
+		return info, false, nil
+	}
+
+	if err = json.Unmarshal(data, &info); err != nil {
+		return info, false, errors.Wrapf(err, "invalid lock %v", key)
+	}
+
+	return info, true, nil
+}
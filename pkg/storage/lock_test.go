@@ -0,0 +1,120 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func withoutLockSettleDelay(t *testing.T) {
+	prev := lockSettleDelay
+	lockSettleDelay = 0
+
+	t.Cleanup(func() {
+		lockSettleDelay = prev
+	})
+}
+
+func putLock(fake *fakeS3, key string, info LockInfo) {
+	data, _ := json.Marshal(info)
+
+	fake.mut.Lock()
+	fake.objects[key] = data
+	fake.mut.Unlock()
+}
+
+func TestLockAcquireRelease(t *testing.T) {
+	withoutLockSettleDelay(t)
+
+	fake, cfg := newFakeS3(t)
+	provider := NewS3Provider(cfg)
+
+	lock, err := AcquireLock(context.TODO(), provider, LockOptions{RunId: "run-1", TempDir: t.TempDir()})
+	assert.NoError(t, err)
+
+	var info LockInfo
+	assert.NoError(t, json.Unmarshal(fake.objects[DefaultLockKey], &info))
+	assert.Equal(t, "run-1", info.RunId)
+	assert.WithinDuration(t, time.Now().Add(DefaultLockLease), info.ExpiresAt, time.Minute)
+
+	_, err = AcquireLock(context.TODO(), provider, LockOptions{RunId: "run-2", TempDir: t.TempDir()})
+	assert.True(t, errors.Is(err, ErrLockHeld))
+	assert.ErrorContains(t, err, "held by run run-1")
+
+	// bucket default retention applies to the lock object too, it can not be removed
+	fake.mut.Lock()
+	fake.headers[DefaultLockKey].Set("x-amz-object-lock-retain-until-date",
+		time.Now().Add(time.Hour).UTC().Format(time.RFC3339))
+	fake.mut.Unlock()
+
+	assert.NoError(t, lock.Release(context.TODO()))
+	assert.NoError(t, json.Unmarshal(fake.objects[DefaultLockKey], &info))
+	assert.True(t, info.Released)
+
+	lock, err = AcquireLock(context.TODO(), provider, LockOptions{RunId: "run-2", TempDir: t.TempDir()})
+	assert.NoError(t, err)
+	assert.NoError(t, lock.Release(context.TODO()))
+}
+
+func TestLockTakesOverStaleLock(t *testing.T) {
+	withoutLockSettleDelay(t)
+
+	fake, cfg := newFakeS3(t)
+
+	putLock(fake, "locks/backup.lock", LockInfo{
+		RunId:      "crashed",
+		AcquiredAt: time.Now().Add(-time.Hour),
+		ExpiresAt:  time.Now().Add(-time.Minute),
+	})
+
+	lock, err := AcquireLock(context.TODO(), NewS3Provider(cfg), LockOptions{
+		Key:     "locks/backup.lock",
+		RunId:   "run-1",
+		TempDir: t.TempDir(),
+	})
+	assert.NoError(t, err)
+	assert.Contains(t, string(fake.objects["locks/backup.lock"]), "run-1")
+	assert.NoError(t, lock.Release(context.TODO()))
+}
+
+func TestLockHeartbeat(t *testing.T) {
+	withoutLockSettleDelay(t)
+
+	fake, cfg := newFakeS3(t)
+	lost := make(chan error, 1)
+
+	lock, err := AcquireLock(context.TODO(), NewS3Provider(cfg), LockOptions{
+		RunId:   "run-1",
+		Lease:   300 * time.Millisecond,
+		TempDir: t.TempDir(),
+		OnLost: func(err error) {
+			lost <- err
+		},
+	})
+	assert.NoError(t, err)
+
+	time.Sleep(500 * time.Millisecond) // renewed at least once
+
+	fake.mut.Lock()
+	var info LockInfo
+	assert.NoError(t, json.Unmarshal(fake.objects[DefaultLockKey], &info))
+	fake.mut.Unlock()
+
+	assert.True(t, time.Now().Before(info.ExpiresAt))
+
+	putLock(fake, DefaultLockKey, LockInfo{RunId: "run-2", ExpiresAt: time.Now().Add(time.Hour)})
+
+	select {
+	case err = <-lost:
+		assert.ErrorContains(t, err, "taken over by run run-2")
+	case <-time.After(time.Second):
+		assert.Fail(t, "lock is not reported as lost")
+	}
+
+	assert.NoError(t, lock.Release(context.TODO()))
+	assert.Contains(t, string(fake.objects[DefaultLockKey]), "run-2")
+}
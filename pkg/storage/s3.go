@@ -3,14 +3,21 @@ package storage
 import (
 	"bytes"
 	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
 	"io"
 	"os"
 	"strconv"
+	"strings"
+	"sync"
 
 	"github.com/avast/retry-go"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
-	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/cockroachdb/errors"
@@ -20,28 +27,27 @@ import (
 	"github.com/skynet2/db-backup/pkg/configuration"
 )
 
-var (
-	maxPartSize      = int64(1 * 1024 * 1024 * 1024) // 1 GB
-	minMultipartSize = int64(3 * 1024 * 1024 * 1024) // 3 GB
-)
-
 const (
 	maxRetries = 3
+
+	megabyte                  = int64(1024 * 1024)
+	defaultPartSize           = 16 * megabyte
+	defaultMultipartThreshold = 64 * megabyte
+	defaultUploadConcurrency  = 4
+	maxPartsCount             = 10000 // s3 limit
+
+	payloadHashHeader = "X-Amz-Content-Sha256" // signer uses it instead of hashing the body
 )
 
 type S3Provider struct {
-	config *aws.Config
-	s3Cfg  configuration.S3Config
+	config     *aws.Config // s3 client specific configuration, not used for sts
+	session    *session.Session
+	sessionErr error
+	s3Cfg      configuration.S3Config
 }
 
 func NewS3Provider(cfg configuration.S3Config) Provider {
-	config := &aws.Config{
-		MaxRetries: aws.Int(3),
-	}
-
-	if region := cfg.Region; len(region) > 0 {
-		config.Region = aws.String(region)
-	}
+	config := &aws.Config{}
 
 	if endpoint := cfg.Endpoint; len(endpoint) > 0 {
 		config.Endpoint = aws.String(endpoint)
@@ -55,25 +61,59 @@ func NewS3Provider(cfg configuration.S3Config) Provider {
 		config.S3ForcePathStyle = aws.Bool(s3ForcePath)
 	}
 
-	accessKey := cfg.AccessKey
-	secretKey := cfg.SecretKey
-
-	if len(accessKey) > 0 || len(secretKey) > 0 {
-		config.Credentials = credentials.NewStaticCredentials(accessKey, secretKey, "")
-	}
-
 	final := &S3Provider{
 		config: config,
 		s3Cfg:  cfg,
 	}
 
+	// session is shared by all requests, so assumed role credentials are cached and refreshed
+	final.session, final.sessionErr = newAwsSession(cfg)
+
 	return final
 }
 
 func (s S3Provider) Validate(ctx context.Context) error {
-	_, err := s.List(ctx, "./")
+	switch s.getChecksumAlgorithm() {
+	case ChecksumSha256, ChecksumMd5, ChecksumNone:
+	default:
+		return errors.New(fmt.Sprintf("unsupported checksum algorithm %v", s.s3Cfg.ChecksumAlgorithm))
+	}
 
-	return err
+	if err := s.validateObjectOptions(); err != nil {
+		return err
+	}
+
+	if _, err := s.List(ctx, "./"); err != nil {
+		return err
+	}
+
+	if len(s.s3Cfg.ObjectLockMode) > 0 || s.s3Cfg.ObjectLockLegalHold {
+		return s.validateObjectLockEnabled(ctx)
+	}
+
+	return nil
+}
+
+// validateObjectLockEnabled checks that object lock can be used, it can be enabled only for versioned bucket.
+func (s S3Provider) validateObjectLockEnabled(ctx context.Context) error {
+	cl, err := s.getClient()
+	if err != nil {
+		return err
+	}
+
+	resp, err := cl.GetObjectLockConfigurationWithContext(ctx, &s3.GetObjectLockConfigurationInput{
+		Bucket: &s.s3Cfg.Bucket,
+	})
+	if err != nil {
+		return errors.Wrapf(err, "can not get object lock configuration of bucket %v", s.s3Cfg.Bucket)
+	}
+
+	if resp.ObjectLockConfiguration == nil ||
+		aws.StringValue(resp.ObjectLockConfiguration.ObjectLockEnabled) != s3.ObjectLockEnabledEnabled {
+		return errors.New(fmt.Sprintf("object lock is not enabled for bucket %v", s.s3Cfg.Bucket))
+	}
+
+	return nil
 }
 
 func (s S3Provider) GetType() string {
@@ -87,6 +127,15 @@ func (s S3Provider) Remove(ctx context.Context, absolutePath string) error {
 		return errors.WithStack(err)
 	}
 
+	locked, err := s.isLocked(ctx, cl, absolutePath)
+	if err != nil {
+		return err
+	}
+
+	if locked { // delete marker would hide backup which still can not be removed
+		return errors.Mark(errors.New(fmt.Sprintf("%v is protected by object lock", absolutePath)), ErrObjectLocked)
+	}
+
 	_, err = cl.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
 		Bucket: &s.s3Cfg.Bucket,
 		Key:    &absolutePath,
@@ -95,18 +144,53 @@ func (s S3Provider) Remove(ctx context.Context, absolutePath string) error {
 	return err
 }
 
+func (s S3Provider) Download(ctx context.Context, absolutePath string, writer io.Writer) error {
+	cl, err := s.getClient()
+
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	sseKey, err := s.getSseCustomerKey()
+
+	if err != nil {
+		return err
+	}
+
+	resp, err := cl.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket:               &s.s3Cfg.Bucket,
+		Key:                  &absolutePath,
+		SSECustomerAlgorithm: s.getSseCustomerAlgorithm(),
+		SSECustomerKey:       sseKey,
+	})
+
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	_, err = io.Copy(writer, resp.Body)
+
+	return errors.WithStack(err)
+}
+
 func (s S3Provider) Upload(
 	ctx context.Context,
 	finalFilePath string,
-	file *os.File,
+	file UploadFile,
+	opts UploadOptions,
 ) error {
 	fileStat, err := file.Stat()
 	if err != nil {
 		return err
 	}
 
+	checksum := ""
 	attempt := 0
-	return retry.Do(func() error {
+	err = retry.Do(func() error {
 		attempt += 1
 
 		ctx = zerolog.Ctx(ctx).With().Str("file", finalFilePath).
@@ -114,78 +198,331 @@ func (s S3Provider) Upload(
 			Int64("size", fileStat.Size()).
 			Int("attempt", attempt).Logger().WithContext(ctx)
 
-		return s.uploadInternal(ctx, finalFilePath, fileStat, file)
+		if _, seekErr := file.Seek(0, io.SeekStart); seekErr != nil { // previous attempt could read part of the file
+			return errors.WithStack(seekErr)
+		}
+
+		var uploadErr error
+		if checksum, uploadErr = s.uploadInternal(ctx, finalFilePath, fileStat, file, opts); uploadErr != nil {
+			return uploadErr
+		}
+
+		return s.verifyUpload(ctx, finalFilePath, fileStat.Size(), checksum)
 	}, retry.Context(ctx), retry.Attempts(5))
+
+	if err != nil {
+		if _, statErr := os.Stat(getUploadStatePath(file)); statErr == nil && ctx.Err() != nil {
+			// interrupted upload is kept for the next run, which uploads the same file if it is kept by the caller
+			err = errors.Mark(err, ErrUploadInterrupted)
+		} else if abortErr := s.discardMultipartUpload(context.WithoutCancel(ctx), file); abortErr != nil {
+			// upload which failed after all retries is not continued
+			err = errors.Join(err, abortErr)
+		}
+	}
+
+	if err == nil && opts.OnChecksum != nil {
+		opts.OnChecksum(checksum)
+	}
+
+	return err
 }
 
+// uploadInternal returns hex encoded sha256 of the file, it is calculated while uploading if not set in opts.
 func (s S3Provider) uploadInternal(
 	ctx context.Context,
 	finalFilePath string,
 	fileStat os.FileInfo,
-	file *os.File,
-) error {
-	if fileStat.Size() < minMultipartSize {
+	file UploadFile,
+	opts UploadOptions,
+) (string, error) {
+	if fileStat.Size() < s.getMultipartThreshold() {
 		zerolog.Ctx(ctx).Info().Msgf("Uploading file %v using simple upload", finalFilePath)
-		return s.simpleUpload(ctx, finalFilePath, file)
+		return s.simpleUpload(ctx, finalFilePath, file, opts)
 	}
 
 	zerolog.Ctx(ctx).Info().Msgf("Uploading file %s using multipart upload", finalFilePath)
-	return s.multiPartUpload(ctx, finalFilePath, file)
+	return s.multiPartUpload(ctx, finalFilePath, file, fileStat.Size(), opts)
+}
+
+// verifyUpload compares size and checksum of uploaded object with local file.
+func (s S3Provider) verifyUpload(ctx context.Context, finalFilePath string, size int64, checksum string) error {
+	if s.s3Cfg.DisableUploadVerification {
+		return nil
+	}
+
+	cl, err := s.getClient()
+	if err != nil {
+		return err
+	}
+
+	sseKey, _ := s.getSseCustomerKey()
+	head, err := cl.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket:               &s.s3Cfg.Bucket,
+		Key:                  &finalFilePath,
+		ChecksumMode:         lo.ToPtr(s3.ChecksumModeEnabled),
+		SSECustomerAlgorithm: s.getSseCustomerAlgorithm(),
+		SSECustomerKey:       sseKey,
+	})
+	if err != nil {
+		return errors.Wrap(err, "can not verify upload")
+	}
+
+	if uploadedSize := aws.Int64Value(head.ContentLength); uploadedSize != size {
+		return errors.New(fmt.Sprintf("uploaded object %v has size %v, expected %v", finalFilePath, uploadedSize, size))
+	}
+
+	if len(checksum) == 0 {
+		return nil
+	}
+
+	metadataChecksum := ""
+
+	for k, v := range head.Metadata {
+		if strings.EqualFold(k, checksumMetadataKey) {
+			metadataChecksum = aws.StringValue(v)
+		}
+	}
+
+	if s.getChecksumAlgorithm() != ChecksumNone && metadataChecksum != checksum {
+		return errors.New(fmt.Sprintf("uploaded object %v has checksum metadata %q, expected %v",
+			finalFilePath, metadataChecksum, checksum))
+	}
+
+	// checksum of multipart upload is a checksum of part checksums (ends with -N) and is validated by S3 on completion
+	if serverChecksum := aws.StringValue(head.ChecksumSHA256); len(serverChecksum) > 0 &&
+		!strings.Contains(serverChecksum, "-") {
+		expected, convertErr := hexToBase64(checksum)
+		if convertErr != nil {
+			return convertErr
+		}
+
+		if serverChecksum != expected {
+			return errors.New(fmt.Sprintf("uploaded object %v has sha256 %v, expected %v",
+				finalFilePath, serverChecksum, expected))
+		}
+	}
+
+	zerolog.Ctx(ctx).Debug().Msgf("upload of %v verified", finalFilePath)
+
+	return nil
 }
 
+func (s S3Provider) getChecksumAlgorithm() string {
+	algorithm := strings.TrimSpace(strings.ToLower(s.s3Cfg.ChecksumAlgorithm))
+
+	if len(algorithm) == 0 {
+		return ChecksumSha256
+	}
+
+	return algorithm
+}
+
+func (s S3Provider) getMetadata(opts UploadOptions) map[string]*string {
+	if len(opts.Checksum) == 0 {
+		return nil
+	}
+
+	return map[string]*string{
+		checksumMetadataKey: aws.String(opts.Checksum),
+	}
+}
+
+// multiPartUpload uploads upload_concurrency parts in parallel.
+// Memory usage is limited to upload_concurrency * part size, parts are read with ReadAt into reused buffers.
+// sha256 for metadata is known before the upload is created (see startMultipartUpload), parts are read in
+// order and hashed again to make sure the uploaded content matches it, parts uploaded by the previous attempt
+// are read only for this check.
 func (s S3Provider) multiPartUpload(
 	ctx context.Context,
 	finalFilePath string,
-	reader *os.File,
-) error {
+	reader UploadFile,
+	size int64,
+	opts UploadOptions,
+) (string, error) {
 	cl, err := s.getClient()
 	if err != nil {
-		return err
+		return "", err
+	}
+
+	objOpts, err := s.getObjectOptions(opts)
+	if err != nil {
+		return "", err
 	}
 
 	input := &s3.CreateMultipartUploadInput{
-		Bucket:      &s.s3Cfg.Bucket,
-		Key:         lo.ToPtr(finalFilePath),
-		ContentType: lo.ToPtr("application/binary"),
+		Bucket:               &s.s3Cfg.Bucket,
+		Key:                  lo.ToPtr(finalFilePath),
+		ContentType:          lo.ToPtr("application/binary"),
+		ServerSideEncryption: objOpts.serverSideEncryption,
+		SSEKMSKeyId:          objOpts.kmsKeyId,
+		SSECustomerAlgorithm: objOpts.sseCustomerAlgorithm,
+		SSECustomerKey:       objOpts.sseCustomerKey,
+		StorageClass:         objOpts.storageClass,
+		Tagging:              objOpts.tagging,
+
+		ObjectLockMode:            objOpts.objectLockMode,
+		ObjectLockRetainUntilDate: objOpts.retainUntil,
+		ObjectLockLegalHoldStatus: objOpts.legalHold,
 	}
 
-	resp, err := cl.CreateMultipartUpload(input)
+	if s.getChecksumAlgorithm() == ChecksumSha256 {
+		input.ChecksumAlgorithm = lo.ToPtr(s3.ChecksumAlgorithmSha256)
+	}
+
+	partSize := s.getPartSize(size)
+	partsCount := int((size + partSize - 1) / partSize)
+	concurrency := s.getPartConcurrency(partSize)
+
+	state, completedParts, err := s.startMultipartUpload(ctx, cl, input, reader, partSize, opts.Checksum)
 	if err != nil {
-		return err
+		return "", err
 	}
 
-	buffer := make([]byte, maxPartSize)
-	partNumber := 1
-	completedParts := make([]*s3.CompletedPart, 0)
-	for {
-		n, readErr := reader.Read(buffer)
-		if readErr != nil {
-			if errors.Is(readErr, io.EOF) {
-				break
-			}
+	resp := state.multipartUpload()
+
+	zerolog.Ctx(ctx).Info().Msgf("uploading %v parts of %v bytes, %v in parallel", partsCount, partSize, concurrency)
+
+	uploadCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	buffers := make(chan []byte, concurrency)
+	for i := 0; i < concurrency; i++ {
+		buffers <- make([]byte, partSize)
+	}
+
+	var wg sync.WaitGroup
+	var mut sync.Mutex
+	var uploadErr error
+
+	setErr := func(err error) {
+		mut.Lock()
+		defer mut.Unlock()
+
+		if uploadErr == nil {
+			uploadErr = err
+		}
+
+		cancel()
+	}
+
+	fileHash := sha256.New()
 
-			return readErr
+	for i := 0; i < partsCount && uploadCtx.Err() == nil; i++ {
+		var buffer []byte
+
+		select {
+		case buffer = <-buffers:
+		case <-uploadCtx.Done():
+			continue
 		}
 
-		toUpload := buffer
-		if int64(n) < maxPartSize {
-			toUpload = buffer[:n]
+		partReader := reader
+		if completedParts[i] != nil {
+			partReader = withoutThrottling(reader) // read only for the checksum
 		}
 
-		part, uploadPartErr := s.uploadPart(ctx, cl, resp, toUpload, partNumber)
-		if uploadPartErr != nil {
-			err = s.abortMultipartUpload(ctx, cl, resp)
-			if err != nil {
-				uploadPartErr = errors.Join(uploadPartErr, errors.WithStack(err))
-			}
+		n, readErr := partReader.ReadAt(buffer, int64(i)*partSize)
+		if readErr != nil && !errors.Is(readErr, io.EOF) {
+			setErr(errors.WithStack(readErr))
+			break
+		}
 
-			return uploadPartErr
+		fileHash.Write(buffer[:n])
+
+		if completedParts[i] != nil {
+			buffers <- buffer
+			continue // uploaded by previous attempt
 		}
-		completedParts = append(completedParts, part)
-		partNumber += 1
+
+		wg.Add(1)
+		go func(partNumber int, buffer []byte, n int) {
+			defer func() {
+				buffers <- buffer
+				wg.Done()
+			}()
+
+			part, partErr := s.uploadPart(uploadCtx, cl, resp, buffer[:n], partNumber)
+			if partErr != nil {
+				setErr(partErr)
+				return
+			}
+
+			completedParts[partNumber-1] = part
+
+			if stateErr := state.addPart(part); stateErr != nil {
+				zerolog.Ctx(ctx).Warn().Err(stateErr).Msg("can not save upload state")
+			}
+		}(i+1, buffer, n)
+	}
+
+	wg.Wait()
+
+	if uploadErr == nil {
+		uploadErr = ctx.Err()
+	}
+
+	if uploadErr != nil {
+		return "", uploadErr // upload is kept for the next attempt, see discardMultipartUpload
+	}
+
+	checksum := hex.EncodeToString(fileHash.Sum(nil))
+	if len(state.Checksum) > 0 && checksum != state.Checksum {
+		return "", errors.New(fmt.Sprintf("file %v has checksum %v, expected %v, file was changed during upload",
+			reader.Name(), checksum, state.Checksum))
+	}
+
+	if err = s.completeMultipartUpload(ctx, cl, resp, completedParts); err != nil {
+		return "", err
+	}
+
+	state.remove()
+
+	return checksum, nil
+}
+
+// getPartSize returns configured part size increased to fit file into max parts count.
+func (s S3Provider) getPartSize(size int64) int64 {
+	partSize := int64(s.s3Cfg.PartSizeMb) * megabyte
+
+	if partSize <= 0 {
+		partSize = defaultPartSize
+	}
+
+	if minSize := (size + maxPartsCount - 1) / maxPartsCount; partSize < minSize {
+		partSize = (minSize + megabyte - 1) / megabyte * megabyte
 	}
 
-	return s.completeMultipartUpload(ctx, cl, resp, completedParts)
+	return partSize
+}
+
+// getPartConcurrency returns number of parts uploaded in parallel. Part buffers are limited to
+// upload_concurrency * part_size_mb, so concurrency is lowered if part size was increased for a big file.
+func (s S3Provider) getPartConcurrency(partSize int64) int {
+	configuredPartSize := int64(s.s3Cfg.PartSizeMb) * megabyte
+
+	if configuredPartSize <= 0 {
+		configuredPartSize = defaultPartSize
+	}
+
+	budget := int64(s.getUploadConcurrency()) * configuredPartSize
+
+	return int(max(1, min(int64(s.getUploadConcurrency()), budget/partSize)))
+}
+
+func (s S3Provider) getMultipartThreshold() int64 {
+	if s.s3Cfg.MultipartThresholdMb > 0 {
+		return int64(s.s3Cfg.MultipartThresholdMb) * megabyte
+	}
+
+	return defaultMultipartThreshold
+}
+
+func (s S3Provider) getUploadConcurrency() int {
+	if s.s3Cfg.UploadConcurrency > 0 {
+		return s.s3Cfg.UploadConcurrency
+	}
+
+	return defaultUploadConcurrency
 }
 
 func (s S3Provider) completeMultipartUpload(
@@ -194,6 +531,7 @@ func (s S3Provider) completeMultipartUpload(
 	resp *s3.CreateMultipartUploadOutput,
 	completedParts []*s3.CompletedPart,
 ) error {
+	sseKey, _ := s.getSseCustomerKey()
 	completeInput := &s3.CompleteMultipartUploadInput{
 		Bucket:   resp.Bucket,
 		Key:      resp.Key,
@@ -201,6 +539,8 @@ func (s S3Provider) completeMultipartUpload(
 		MultipartUpload: &s3.CompletedMultipartUpload{
 			Parts: completedParts,
 		},
+		SSECustomerAlgorithm: s.getSseCustomerAlgorithm(),
+		SSECustomerKey:       sseKey,
 	}
 
 	_, err := svc.CompleteMultipartUploadWithContext(ctx, completeInput)
@@ -231,13 +571,23 @@ func (s S3Provider) uploadPart(
 	partNumber int,
 ) (*s3.CompletedPart, error) {
 	tryNum := 1
+	sseKey, _ := s.getSseCustomerKey() // validated before upload
 	partInput := &s3.UploadPartInput{
-		Body:          bytes.NewReader(fileBytes),
-		Bucket:        resp.Bucket,
-		Key:           resp.Key,
-		PartNumber:    aws.Int64(int64(partNumber)),
-		UploadId:      resp.UploadId,
-		ContentLength: aws.Int64(int64(len(fileBytes))),
+		Body:                 bytes.NewReader(fileBytes),
+		Bucket:               resp.Bucket,
+		Key:                  resp.Key,
+		PartNumber:           aws.Int64(int64(partNumber)),
+		UploadId:             resp.UploadId,
+		ContentLength:        aws.Int64(int64(len(fileBytes))),
+		SSECustomerAlgorithm: s.getSseCustomerAlgorithm(),
+		SSECustomerKey:       sseKey,
+	}
+
+	switch s.getChecksumAlgorithm() {
+	case ChecksumSha256:
+		partInput.ChecksumSHA256 = aws.String(partChecksum(ChecksumSha256, fileBytes))
+	case ChecksumMd5:
+		partInput.ContentMD5 = aws.String(partChecksum(ChecksumMd5, fileBytes))
 	}
 
 	for tryNum <= maxRetries {
@@ -257,8 +607,9 @@ func (s S3Provider) uploadPart(
 			zerolog.Ctx(ctx).Debug().Msgf("Uploaded part %v for %v", partNumber, *resp.Key)
 
 			return &s3.CompletedPart{
-				ETag:       uploadResult.ETag,
-				PartNumber: aws.Int64(int64(partNumber)),
+				ETag:           uploadResult.ETag,
+				ChecksumSHA256: uploadResult.ChecksumSHA256,
+				PartNumber:     aws.Int64(int64(partNumber)),
 			}, nil
 		}
 	}
@@ -266,24 +617,83 @@ func (s S3Provider) uploadPart(
 	return nil, nil
 }
 
+// simpleUpload sends the file with a single request. Request signature and checksum headers require sha256
+// (and md5) of the body before sending, they are calculated in a single read, sha256 is passed to the signer
+// as payload hash, so the sdk does not read the body once more.
 func (s S3Provider) simpleUpload(
 	ctx context.Context,
 	finalFilePath string,
-	reader io.ReadSeeker,
-) error {
+	reader UploadFile,
+	opts UploadOptions,
+) (string, error) {
 	cl, err := s.getClient()
 	if err != nil {
-		return err
+		return "", err
+	}
+
+	objOpts, err := s.getObjectOptions(opts)
+	if err != nil {
+		return "", err
 	}
 
-	_, err = cl.PutObjectWithContext(ctx, &s3.PutObjectInput{
-		Key:         &finalFilePath,
-		Bucket:      &s.s3Cfg.Bucket,
-		Body:        reader,
-		ContentType: lo.ToPtr("application/binary"),
+	checksum := opts.Checksum
+	contentMd5 := ""
+
+	if len(checksum) == 0 || s.getChecksumAlgorithm() == ChecksumMd5 {
+		sha256Hash, md5Hash := sha256.New(), md5.New()
+		if err = readFile(reader, io.MultiWriter(sha256Hash, md5Hash)); err != nil {
+			return "", err
+		}
+
+		checksum = hex.EncodeToString(sha256Hash.Sum(nil))
+		contentMd5 = base64.StdEncoding.EncodeToString(md5Hash.Sum(nil))
+	}
+
+	if s.getChecksumAlgorithm() != ChecksumNone {
+		opts.Checksum = checksum // stored as metadata
+	}
+
+	input := &s3.PutObjectInput{
+		Key:                  &finalFilePath,
+		Bucket:               &s.s3Cfg.Bucket,
+		Body:                 reader,
+		ContentType:          lo.ToPtr("application/binary"),
+		Metadata:             s.getMetadata(opts),
+		ServerSideEncryption: objOpts.serverSideEncryption,
+		SSEKMSKeyId:          objOpts.kmsKeyId,
+		SSECustomerAlgorithm: objOpts.sseCustomerAlgorithm,
+		SSECustomerKey:       objOpts.sseCustomerKey,
+		StorageClass:         objOpts.storageClass,
+		Tagging:              objOpts.tagging,
+
+		ObjectLockMode:            objOpts.objectLockMode,
+		ObjectLockRetainUntilDate: objOpts.retainUntil,
+		ObjectLockLegalHoldStatus: objOpts.legalHold,
+	}
+
+	switch s.getChecksumAlgorithm() {
+	case ChecksumSha256:
+		b64, convertErr := hexToBase64(checksum)
+		if convertErr != nil {
+			return "", convertErr
+		}
+
+		input.ChecksumSHA256 = aws.String(b64)
+	case ChecksumMd5:
+		input.ContentMD5 = aws.String(contentMd5)
+	}
+
+	_, err = cl.PutObjectWithContext(ctx, input, request.WithSetRequestHeaders(map[string]string{
+		payloadHashHeader: checksum,
+	}), func(r *request.Request) {
+		// checksum headers are set above, otherwise sdk reads the body once more for Content-MD5
+		r.Config.S3DisableContentMD5Validation = aws.Bool(true)
 	})
+	if err != nil {
+		return "", err
+	}
 
-	return err
+	return checksum, nil
 }
 
 func (s S3Provider) getClient() (*s3.S3, error) {
@@ -291,13 +701,11 @@ func (s S3Provider) getClient() (*s3.S3, error) {
 		return nil, errors.New("S3_BUCKET is empty")
 	}
 
-	ses, err := session.NewSession(s.config)
-
-	if err != nil {
-		return nil, errors.WithStack(err)
+	if s.sessionErr != nil {
+		return nil, s.sessionErr
 	}
 
-	return s3.New(ses), nil
+	return s3.New(s.session, s.config), nil
 }
 
 func (s S3Provider) List(ctx context.Context, prefix string) ([]File, error) {
@@ -307,27 +715,31 @@ func (s S3Provider) List(ctx context.Context, prefix string) ([]File, error) {
 		return nil, errors.WithStack(err)
 	}
 
-	resp, err := cl.ListObjectsWithContext(ctx, &s3.ListObjectsInput{
+	var finalFiles []File
+
+	// single response is limited to 1000 keys
+	err = cl.ListObjectsPagesWithContext(ctx, &s3.ListObjectsInput{
 		Bucket: &s.s3Cfg.Bucket,
 		Prefix: &prefix,
+	}, func(page *s3.ListObjectsOutput, _ bool) bool {
+		for _, c := range page.Contents {
+			if c.Key == nil || c.LastModified == nil {
+				continue
+			}
+
+			finalFiles = append(finalFiles, File{
+				AbsolutePath: *c.Key,
+				CreatedAt:    *c.LastModified,
+				Size:         aws.Int64Value(c.Size),
+			})
+		}
+
+		return true
 	})
 
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
 
-	var finalFiles []File
-
-	for _, c := range resp.Contents {
-		if c.Key == nil || c.LastModified == nil {
-			continue
-		}
-
-		finalFiles = append(finalFiles, File{
-			AbsolutePath: *c.Key,
-			CreatedAt:    *c.LastModified,
-		})
-	}
-
 	return sortFiles(finalFiles), nil
 }
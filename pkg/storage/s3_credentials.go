@@ -0,0 +1,107 @@
+package storage
+
+import (
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/cockroachdb/errors"
+
+	"github.com/skynet2/db-backup/pkg/configuration"
+)
+
+const (
+	defaultRoleSessionName    = "db-backup"
+	defaultAssumeRoleDuration = time.Hour
+	credentialsExpiryWindow   = 5 * time.Minute // refresh before expiration, so long upload does not fail mid-request
+)
+
+// newAwsSession creates session with credentials resolved in order:
+// static keys, shared config profile, sdk default chain (env, shared config, web identity env, instance role).
+// With role_arn the role is assumed on top of them, or with web_identity_token_file instead of them.
+// Credentials are cached by the session and refreshed when they are about to expire.
+func newAwsSession(cfg configuration.S3Config) (*session.Session, error) {
+	if err := validateCredentials(cfg); err != nil {
+		return nil, err
+	}
+
+	awsCfg := aws.NewConfig().WithMaxRetries(maxRetries)
+
+	if len(cfg.Region) > 0 {
+		awsCfg = awsCfg.WithRegion(cfg.Region)
+	}
+
+	if len(cfg.AccessKey) > 0 || len(cfg.SecretKey) > 0 {
+		awsCfg = awsCfg.WithCredentials(credentials.NewStaticCredentials(cfg.AccessKey, cfg.SecretKey, ""))
+	}
+
+	opts := session.Options{
+		Config:  *awsCfg,
+		Profile: cfg.Profile,
+	}
+
+	if len(cfg.Profile) > 0 {
+		opts.SharedConfigState = session.SharedConfigEnable
+	}
+
+	ses, err := session.NewSessionWithOptions(opts)
+	if err != nil {
+		return nil, errors.Wrap(err, "can not create aws session")
+	}
+
+	if len(cfg.RoleArn) == 0 {
+		return ses, nil
+	}
+
+	return ses.Copy(aws.NewConfig().WithCredentials(getRoleCredentials(ses, cfg))), nil
+}
+
+func getRoleCredentials(ses *session.Session, cfg configuration.S3Config) *credentials.Credentials {
+	sessionName := cfg.RoleSessionName
+	if len(sessionName) == 0 {
+		sessionName = defaultRoleSessionName
+	}
+
+	duration := cfg.AssumeRoleDuration
+	if duration == 0 {
+		duration = defaultAssumeRoleDuration
+	}
+
+	if len(cfg.WebIdentityTokenFile) > 0 {
+		return credentials.NewCredentials(stscreds.NewWebIdentityRoleProviderWithOptions(sts.New(ses), cfg.RoleArn,
+			sessionName, stscreds.FetchTokenPath(cfg.WebIdentityTokenFile),
+			func(p *stscreds.WebIdentityRoleProvider) {
+				p.Duration = duration
+				p.ExpiryWindow = credentialsExpiryWindow
+			}))
+	}
+
+	return stscreds.NewCredentials(ses, cfg.RoleArn, func(p *stscreds.AssumeRoleProvider) {
+		p.RoleSessionName = sessionName
+		p.Duration = duration
+		p.ExpiryWindow = credentialsExpiryWindow
+
+		if len(cfg.ExternalId) > 0 {
+			p.ExternalID = aws.String(cfg.ExternalId)
+		}
+	})
+}
+
+func validateCredentials(cfg configuration.S3Config) error {
+	if len(cfg.RoleArn) == 0 && (len(cfg.WebIdentityTokenFile) > 0 || len(cfg.ExternalId) > 0) {
+		return errors.New("web_identity_token_file and external_id require role_arn")
+	}
+
+	if len(cfg.WebIdentityTokenFile) > 0 && len(cfg.ExternalId) > 0 {
+		return errors.New("external_id is not supported with web_identity_token_file")
+	}
+
+	if len(cfg.Profile) > 0 && (len(cfg.AccessKey) > 0 || len(cfg.SecretKey) > 0) {
+		return errors.New("profile can not be used with access_key and secret_key")
+	}
+
+	return nil
+}
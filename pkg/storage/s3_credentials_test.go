@@ -0,0 +1,62 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/skynet2/db-backup/pkg/configuration"
+)
+
+func TestNewAwsSessionProfile(t *testing.T) {
+	dir := t.TempDir()
+	credentialsFile := filepath.Join(dir, "credentials")
+	configFile := filepath.Join(dir, "config")
+
+	assert.NoError(t, os.WriteFile(credentialsFile, []byte("[backup]\naws_access_key_id = profile-key\n"+
+		"aws_secret_access_key = profile-secret\n"), 0600))
+	assert.NoError(t, os.WriteFile(configFile, []byte("[profile backup]\nregion = eu-west-1\n"), 0600))
+
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", credentialsFile)
+	t.Setenv("AWS_CONFIG_FILE", configFile)
+	t.Setenv("AWS_ACCESS_KEY_ID", "")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "")
+
+	ses, err := newAwsSession(configuration.S3Config{Profile: "backup"})
+	assert.NoError(t, err)
+
+	creds, err := ses.Config.Credentials.Get()
+	assert.NoError(t, err)
+	assert.Equal(t, "profile-key", creds.AccessKeyID)
+	assert.Equal(t, "eu-west-1", *ses.Config.Region)
+
+	ses, err = newAwsSession(configuration.S3Config{Profile: "missing"})
+	if err == nil {
+		_, err = ses.Config.Credentials.Get()
+	}
+	assert.Error(t, err)
+}
+
+func TestNewAwsSessionWebIdentity(t *testing.T) {
+	ses, err := newAwsSession(configuration.S3Config{
+		Region:               "us-east-1",
+		RoleArn:              "arn:aws:iam::123456789012:role/backup",
+		WebIdentityTokenFile: filepath.Join(t.TempDir(), "missing-token"),
+	})
+	assert.NoError(t, err)
+
+	_, err = ses.Config.Credentials.Get() // token is read before sts call
+	assert.ErrorContains(t, err, "missing-token")
+}
+
+func TestValidateCredentials(t *testing.T) {
+	assert.NoError(t, validateCredentials(configuration.S3Config{
+		RoleArn:    "arn:aws:iam::123456789012:role/backup",
+		ExternalId: "external",
+	}))
+	assert.Error(t, validateCredentials(configuration.S3Config{ExternalId: "external"}))
+	assert.Error(t, validateCredentials(configuration.S3Config{WebIdentityTokenFile: "/var/run/token"}))
+	assert.Error(t, validateCredentials(configuration.S3Config{Profile: "backup", AccessKey: "key"}))
+}
@@ -0,0 +1,278 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/skynet2/db-backup/pkg/configuration"
+)
+
+// fakeS3 is a minimal path style s3 api for tests.
+type fakeS3 struct {
+	mut      sync.Mutex
+	objects  map[string][]byte
+	metadata map[string]string      // key -> x-amz-meta-sha256
+	headers  map[string]http.Header // key -> headers of put object or create multipart upload request
+	uploads  map[string]map[int][]byte
+	uploadId int
+
+	uploadKeys map[string]string    // upload id -> key
+	initiated  map[string]time.Time // upload id -> initiation time
+	partCalls  map[int]int          // part number -> upload requests
+
+	inFlight    int
+	maxInFlight int
+	failPart    func(partNumber int) bool
+	listCalls   int
+	maxKeys     int // page size of list objects, 1000 if empty
+}
+
+func newFakeS3(t *testing.T) (*fakeS3, configuration.S3Config) {
+	f := &fakeS3{
+		objects:  map[string][]byte{},
+		metadata: map[string]string{},
+		headers:  map[string]http.Header{},
+		uploads:  map[string]map[int][]byte{},
+
+		uploadKeys: map[string]string{},
+		initiated:  map[string]time.Time{},
+		partCalls:  map[int]int{},
+	}
+
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+
+	return f, configuration.S3Config{
+		Region:         "us-east-1",
+		Endpoint:       srv.URL,
+		Bucket:         "bucket",
+		AccessKey:      "key",
+		SecretKey:      "secret",
+		DisableSsl:     true,
+		ForcePathStyle: true,
+	}
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(r.URL.Path, "/bucket/")
+	query := r.URL.Query()
+	body, _ := io.ReadAll(r.Body)
+
+	switch {
+	case r.Method == http.MethodPost && query.Has("uploads"):
+		f.mut.Lock()
+		f.uploadId += 1
+		id := strconv.Itoa(f.uploadId)
+		f.uploads[id] = map[int][]byte{}
+		f.headers[key] = r.Header.Clone()
+		f.uploadKeys[id] = key
+		f.initiated[id] = time.Now().UTC()
+		f.mut.Unlock()
+
+		f.writeXML(w, fmt.Sprintf("<InitiateMultipartUploadResult><Bucket>bucket</Bucket><Key>%v</Key>"+
+			"<UploadId>%v</UploadId></InitiateMultipartUploadResult>", key, id))
+	case r.Method == http.MethodPut && query.Has("partNumber"):
+		partNumber, _ := strconv.Atoi(query.Get("partNumber"))
+
+		f.mut.Lock()
+		f.inFlight += 1
+		f.maxInFlight = max(f.maxInFlight, f.inFlight)
+		f.partCalls[partNumber] += 1
+		fail := f.failPart != nil && f.failPart(partNumber)
+		f.mut.Unlock()
+
+		defer func() {
+			f.mut.Lock()
+			f.inFlight -= 1
+			f.mut.Unlock()
+		}()
+
+		if fail {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		f.mut.Lock()
+		f.uploads[query.Get("uploadId")][partNumber] = body
+		f.mut.Unlock()
+
+		w.Header().Set("ETag", fmt.Sprintf(`"etag-%v"`, partNumber))
+		w.Header().Set("x-amz-checksum-sha256", r.Header.Get("x-amz-checksum-sha256"))
+	case r.Method == http.MethodGet && query.Has("uploadId"):
+		f.mut.Lock()
+		parts, ok := f.uploads[query.Get("uploadId")]
+		var list strings.Builder
+
+		for n, data := range parts {
+			list.WriteString(fmt.Sprintf(`<Part><PartNumber>%v</PartNumber><ETag>"etag-%v"</ETag>`+
+				"<Size>%v</Size></Part>", n, n, len(data)))
+		}
+		f.mut.Unlock()
+
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		f.writeXML(w, fmt.Sprintf("<ListPartsResult><Bucket>bucket</Bucket><Key>%v</Key><UploadId>%v</UploadId>"+
+			"<IsTruncated>false</IsTruncated>%v</ListPartsResult>", key, query.Get("uploadId"), list.String()))
+	case r.Method == http.MethodGet && query.Has("uploads"):
+		f.mut.Lock()
+		var list strings.Builder
+
+		for id, uploadKey := range f.uploadKeys {
+			if _, ok := f.uploads[id]; ok && strings.HasPrefix(uploadKey, query.Get("prefix")) {
+				list.WriteString(fmt.Sprintf("<Upload><Key>%v</Key><UploadId>%v</UploadId>"+
+					"<Initiated>%v</Initiated></Upload>", uploadKey, id, f.initiated[id].Format(time.RFC3339)))
+			}
+		}
+		f.mut.Unlock()
+
+		f.writeXML(w, fmt.Sprintf("<ListMultipartUploadsResult><Bucket>bucket</Bucket>"+
+			"<IsTruncated>false</IsTruncated>%v</ListMultipartUploadsResult>", list.String()))
+	case r.Method == http.MethodPost && query.Has("uploadId"):
+		f.mut.Lock()
+		parts := f.uploads[query.Get("uploadId")]
+		numbers := make([]int, 0, len(parts))
+
+		for n := range parts {
+			numbers = append(numbers, n)
+		}
+
+		sort.Ints(numbers)
+
+		var data bytes.Buffer
+
+		for _, n := range numbers {
+			data.Write(parts[n])
+		}
+
+		f.objects[key] = data.Bytes()
+		delete(f.uploads, query.Get("uploadId"))
+		f.mut.Unlock()
+
+		f.writeXML(w, fmt.Sprintf("<CompleteMultipartUploadResult><Bucket>bucket</Bucket><Key>%v</Key>"+
+			"</CompleteMultipartUploadResult>", key))
+	case r.Method == http.MethodDelete && query.Has("uploadId"):
+		f.mut.Lock()
+		delete(f.uploads, query.Get("uploadId"))
+		f.mut.Unlock()
+
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodGet && query.Has("prefix"):
+		f.mut.Lock()
+		keys := make([]string, 0, len(f.objects))
+
+		for k := range f.objects {
+			if strings.HasPrefix(k, query.Get("prefix")) {
+				keys = append(keys, k)
+			}
+		}
+
+		sort.Strings(keys)
+
+		maxKeys := f.maxKeys
+
+		if maxKeys <= 0 {
+			maxKeys = 1000
+		}
+
+		f.listCalls++
+
+		var list strings.Builder
+
+		listed := 0
+		truncated := false
+
+		for i, k := range keys {
+			if k <= query.Get("marker") {
+				continue
+			}
+
+			if listed == maxKeys {
+				truncated = true
+				break
+			}
+
+			listed++
+			modified := time.Date(2024, 1, 1, 0, 0, i, 0, time.UTC) // listing order
+			list.WriteString(fmt.Sprintf("<Contents><Key>%v</Key><LastModified>%v</LastModified><Size>%v</Size></Contents>",
+				k, modified.Format(time.RFC3339), len(f.objects[k])))
+		}
+		f.mut.Unlock()
+
+		f.writeXML(w, fmt.Sprintf("<ListBucketResult><Name>bucket</Name><IsTruncated>%v</IsTruncated>%v"+
+			"</ListBucketResult>", truncated, list.String()))
+	case r.Method == http.MethodGet:
+		f.mut.Lock()
+		data, ok := f.objects[key]
+		f.mut.Unlock()
+
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		_, _ = w.Write(data)
+	case r.Method == http.MethodDelete:
+		f.mut.Lock()
+		delete(f.objects, key)
+		f.mut.Unlock()
+
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodPut:
+		f.mut.Lock()
+		f.objects[key] = body
+		f.headers[key] = r.Header.Clone()
+		delete(f.metadata, key)
+		f.mut.Unlock()
+
+		w.Header().Set("ETag", `"etag"`)
+	case r.Method == http.MethodHead:
+		f.mut.Lock()
+		data, ok := f.objects[key]
+		headers := f.headers[key]
+		sum := f.metadata[key]
+		f.mut.Unlock()
+
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		for _, h := range []string{"x-amz-object-lock-retain-until-date", "x-amz-object-lock-legal-hold"} {
+			if v := headers.Get(h); len(v) > 0 {
+				w.Header().Set(h, v)
+			}
+		}
+
+		if len(sum) > 0 {
+			w.Header().Set("x-amz-meta-sha256", sum)
+		}
+
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+	}
+
+	if sum := r.Header.Get("x-amz-meta-sha256"); len(sum) > 0 {
+		f.mut.Lock()
+		f.metadata[key] = sum
+		f.mut.Unlock()
+	}
+}
+
+func (f *fakeS3) writeXML(w http.ResponseWriter, body string) {
+	w.Header().Set("Content-Type", "application/xml")
+	_, _ = w.Write([]byte(xml.Header + body))
+}
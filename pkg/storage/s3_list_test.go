@@ -0,0 +1,27 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestS3ListPaginates(t *testing.T) {
+	fake, cfg := newFakeS3(t)
+	fake.maxKeys = 2
+
+	for i := 0; i < 5; i++ {
+		fake.objects[fmt.Sprintf("db/backup_%v.sql.gzip", i)] = []byte("data")
+	}
+
+	fake.objects["other/backup.sql.gzip"] = []byte("data")
+
+	files, err := NewS3Provider(cfg).List(context.TODO(), "db/")
+	assert.NoError(t, err)
+	assert.Len(t, files, 5)
+	assert.Equal(t, "db/backup_0.sql.gzip", files[0].AbsolutePath)
+	assert.Equal(t, "db/backup_4.sql.gzip", files[4].AbsolutePath)
+	assert.Equal(t, 3, fake.listCalls)
+}
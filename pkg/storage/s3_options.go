@@ -0,0 +1,182 @@
+package storage
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/cockroachdb/errors"
+	"github.com/samber/lo"
+)
+
+const (
+	sseCustomerAlgorithm = "AES256" // the only algorithm supported for customer provided keys
+	sseCustomerKeySize   = 32
+	maxTagsCount         = 10 // s3 limit per object
+)
+
+// objectOptions are encryption, storage class, tags and object lock of uploaded object.
+type objectOptions struct {
+	serverSideEncryption *string
+	kmsKeyId             *string
+	sseCustomerAlgorithm *string
+	sseCustomerKey       *string
+	storageClass         *string
+	tagging              *string
+	objectLockMode       *string
+	retainUntil          *time.Time
+	legalHold            *string
+}
+
+func (s S3Provider) validateObjectOptions() error {
+	cfg := s.s3Cfg
+
+	if len(cfg.ServerSideEncryption) > 0 && !lo.Contains(s3.ServerSideEncryption_Values(), cfg.ServerSideEncryption) {
+		return errors.New(fmt.Sprintf("unsupported server side encryption %v", cfg.ServerSideEncryption))
+	}
+
+	if len(cfg.KmsKeyId) > 0 && cfg.ServerSideEncryption != s3.ServerSideEncryptionAwsKms &&
+		cfg.ServerSideEncryption != s3.ServerSideEncryptionAwsKmsDsse {
+		return errors.New("kms_key_id requires aws:kms server side encryption")
+	}
+
+	if len(cfg.SseCustomerKey) > 0 {
+		if len(cfg.ServerSideEncryption) > 0 {
+			return errors.New("sse_customer_key can not be used with server_side_encryption")
+		}
+
+		if _, err := s.getSseCustomerKey(); err != nil {
+			return err
+		}
+	}
+
+	if len(cfg.StorageClass) > 0 && !lo.Contains(s3.StorageClass_Values(), cfg.StorageClass) {
+		return errors.New(fmt.Sprintf("unsupported storage class %v", cfg.StorageClass))
+	}
+
+	if len(cfg.Tags) > maxTagsCount {
+		return errors.New(fmt.Sprintf("s3 supports up to %v tags, got %v", maxTagsCount, len(cfg.Tags)))
+	}
+
+	if len(cfg.ObjectLockMode) > 0 && !lo.Contains(s3.ObjectLockMode_Values(), cfg.ObjectLockMode) {
+		return errors.New(fmt.Sprintf("unsupported object lock mode %v", cfg.ObjectLockMode))
+	}
+
+	if (len(cfg.ObjectLockMode) > 0) != (cfg.ObjectLockRetainDays > 0) {
+		return errors.New("object_lock_mode and object_lock_retain_days should be set together")
+	}
+
+	if (len(cfg.ObjectLockMode) > 0 || cfg.ObjectLockLegalHold) && s.getChecksumAlgorithm() == ChecksumNone {
+		return errors.New("object lock requires checksum_algorithm sha256 or md5")
+	}
+
+	return nil
+}
+
+func (s S3Provider) getObjectOptions(opts UploadOptions) (objectOptions, error) {
+	if err := s.validateObjectOptions(); err != nil {
+		return objectOptions{}, err
+	}
+
+	sseKey, _ := s.getSseCustomerKey()
+
+	final := objectOptions{
+		sseCustomerKey: sseKey,
+	}
+
+	if sseKey != nil {
+		final.sseCustomerAlgorithm = aws.String(sseCustomerAlgorithm)
+	}
+
+	if len(s.s3Cfg.ServerSideEncryption) > 0 {
+		final.serverSideEncryption = aws.String(s.s3Cfg.ServerSideEncryption)
+	}
+
+	if len(s.s3Cfg.KmsKeyId) > 0 {
+		final.kmsKeyId = aws.String(s.s3Cfg.KmsKeyId)
+	}
+
+	if len(s.s3Cfg.StorageClass) > 0 {
+		final.storageClass = aws.String(s.s3Cfg.StorageClass)
+	}
+
+	if opts.Lock && len(s.s3Cfg.ObjectLockMode) > 0 {
+		final.objectLockMode = aws.String(s.s3Cfg.ObjectLockMode)
+		final.retainUntil = aws.Time(time.Now().UTC().AddDate(0, 0, s.s3Cfg.ObjectLockRetainDays))
+	}
+
+	if opts.Lock && s.s3Cfg.ObjectLockLegalHold {
+		final.legalHold = aws.String(s3.ObjectLockLegalHoldStatusOn)
+	}
+
+	if len(opts.Tags) > 0 {
+		tags := url.Values{}
+
+		for k, v := range opts.Tags {
+			tags.Set(k, v)
+		}
+
+		final.tagging = aws.String(tags.Encode())
+	}
+
+	return final, nil
+}
+
+// isLocked reports whether object can not be removed because of retention or legal hold.
+// Object which does not exist is not locked.
+func (s S3Provider) isLocked(ctx context.Context, svc *s3.S3, absolutePath string) (bool, error) {
+	sseKey, _ := s.getSseCustomerKey()
+	head, err := svc.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket:               &s.s3Cfg.Bucket,
+		Key:                  &absolutePath,
+		SSECustomerAlgorithm: s.getSseCustomerAlgorithm(),
+		SSECustomerKey:       sseKey,
+	})
+	if err != nil {
+		var awsErr awserr.Error
+		if errors.As(err, &awsErr) && awsErr.Code() == "NotFound" {
+			return false, nil
+		}
+
+		return false, errors.WithStack(err)
+	}
+
+	if aws.StringValue(head.ObjectLockLegalHoldStatus) == s3.ObjectLockLegalHoldStatusOn {
+		return true, nil
+	}
+
+	return head.ObjectLockRetainUntilDate != nil && head.ObjectLockRetainUntilDate.After(time.Now()), nil
+}
+
+// getSseCustomerKey returns raw SSE-C key, sdk sends it base64 encoded together with its md5.
+// nil if SSE-C is not configured.
+func (s S3Provider) getSseCustomerKey() (*string, error) {
+	if len(s.s3Cfg.SseCustomerKey) == 0 {
+		return nil, nil
+	}
+
+	key, err := base64.StdEncoding.DecodeString(s.s3Cfg.SseCustomerKey)
+	if err != nil {
+		return nil, errors.Wrap(err, "sse_customer_key should be base64 encoded")
+	}
+
+	if len(key) != sseCustomerKeySize {
+		return nil, errors.New(fmt.Sprintf("sse_customer_key should be %v bytes, got %v", sseCustomerKeySize, len(key)))
+	}
+
+	return aws.String(string(key)), nil
+}
+
+// getSseCustomerAlgorithm returns algorithm header required by every request to SSE-C object.
+func (s S3Provider) getSseCustomerAlgorithm() *string {
+	if len(s.s3Cfg.SseCustomerKey) == 0 {
+		return nil
+	}
+
+	return aws.String(sseCustomerAlgorithm)
+}
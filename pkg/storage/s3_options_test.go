@@ -0,0 +1,126 @@
+package storage
+
+import (
+	"context"
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"github.com/cockroachdb/errors"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/skynet2/db-backup/pkg/configuration"
+)
+
+func TestS3ValidateObjectOptions(t *testing.T) {
+	validKey := base64.StdEncoding.EncodeToString([]byte(strings.Repeat("k", 32)))
+
+	cases := []struct {
+		name  string
+		cfg   configuration.S3Config
+		error string
+	}{
+		{name: "empty"},
+		{name: "kms", cfg: configuration.S3Config{ServerSideEncryption: "aws:kms", KmsKeyId: "key-id"}},
+		{name: "sse-c", cfg: configuration.S3Config{SseCustomerKey: validKey}},
+		{name: "storage class", cfg: configuration.S3Config{StorageClass: "DEEP_ARCHIVE"}},
+		{
+			name:  "unknown encryption",
+			cfg:   configuration.S3Config{ServerSideEncryption: "aes"},
+			error: "unsupported server side encryption",
+		},
+		{
+			name:  "kms key without kms",
+			cfg:   configuration.S3Config{ServerSideEncryption: "AES256", KmsKeyId: "key-id"},
+			error: "kms_key_id requires",
+		},
+		{
+			name:  "sse-c with sse",
+			cfg:   configuration.S3Config{ServerSideEncryption: "AES256", SseCustomerKey: validKey},
+			error: "can not be used",
+		},
+		{
+			name:  "short sse-c key",
+			cfg:   configuration.S3Config{SseCustomerKey: base64.StdEncoding.EncodeToString([]byte("short"))},
+			error: "should be 32 bytes",
+		},
+		{
+			name:  "lock without retention",
+			cfg:   configuration.S3Config{ObjectLockMode: "GOVERNANCE"},
+			error: "should be set together",
+		},
+		{
+			name:  "lock without checksum",
+			cfg:   configuration.S3Config{ObjectLockLegalHold: true, ChecksumAlgorithm: "none"},
+			error: "requires checksum_algorithm",
+		},
+		{
+			name:  "unknown storage class",
+			cfg:   configuration.S3Config{StorageClass: "COLD"},
+			error: "unsupported storage class",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			err := S3Provider{s3Cfg: c.cfg}.validateObjectOptions()
+
+			if len(c.error) == 0 {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorContains(t, err, c.error)
+			}
+		})
+	}
+}
+
+func TestS3UploadObjectOptions(t *testing.T) {
+	fake, cfg := newFakeS3(t)
+	cfg.ServerSideEncryption = "aws:kms"
+	cfg.KmsKeyId = "key-id"
+	cfg.StorageClass = "STANDARD_IA"
+	cfg.PartSizeMb = 1
+	cfg.MultipartThresholdMb = 1
+
+	opts := UploadOptions{
+		Tags: map[string]string{"database": "config", "run": "20240102T030405Z-1a2b3c4d"},
+	}
+
+	provider := NewS3Provider(cfg)
+
+	assert.NoError(t, provider.Upload(context.TODO(), "db/small.sql.gzip", writeTestFile(t, 100), opts))
+	assert.NoError(t, provider.Upload(context.TODO(), "db/big.sql.gzip", writeTestFile(t, int(2*megabyte)), opts))
+
+	for _, key := range []string{"db/small.sql.gzip", "db/big.sql.gzip"} {
+		headers := fake.headers[key]
+
+		assert.Equal(t, "aws:kms", headers.Get("x-amz-server-side-encryption"), key)
+		assert.Equal(t, "key-id", headers.Get("x-amz-server-side-encryption-aws-kms-key-id"), key)
+		assert.Equal(t, "STANDARD_IA", headers.Get("x-amz-storage-class"), key)
+		assert.Equal(t, "database=config&run=20240102T030405Z-1a2b3c4d", headers.Get("x-amz-tagging"), key)
+	}
+}
+
+func TestS3RemoveLockedObject(t *testing.T) {
+	fake, cfg := newFakeS3(t)
+	cfg.ObjectLockMode = "COMPLIANCE"
+	cfg.ObjectLockRetainDays = 30
+
+	provider := NewS3Provider(cfg)
+
+	assert.NoError(t, provider.Upload(context.TODO(), "db/locked.sql.gzip", writeTestFile(t, 100), UploadOptions{
+		Lock: true,
+	}))
+	assert.NoError(t, provider.Upload(context.TODO(), "db/manifest.json", writeTestFile(t, 100), UploadOptions{}))
+
+	assert.Equal(t, "COMPLIANCE", fake.headers["db/locked.sql.gzip"].Get("x-amz-object-lock-mode"))
+	assert.Empty(t, fake.headers["db/manifest.json"].Get("x-amz-object-lock-mode"))
+
+	err := provider.Remove(context.TODO(), "db/locked.sql.gzip")
+	assert.True(t, errors.Is(err, ErrObjectLocked))
+	assert.Contains(t, fake.objects, "db/locked.sql.gzip")
+
+	assert.NoError(t, provider.Remove(context.TODO(), "db/manifest.json"))
+	assert.NotContains(t, fake.objects, "db/manifest.json")
+	assert.NoError(t, provider.Remove(context.TODO(), "db/missing.json"))
+}
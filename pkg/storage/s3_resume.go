@@ -0,0 +1,352 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/cockroachdb/errors"
+	"github.com/hashicorp/go-multierror"
+	"github.com/rs/zerolog"
+)
+
+const (
+	uploadStateSuffix = ".upload.json"
+	// DefaultAbortIncompleteUploadsAfter is used if abort_incomplete_uploads_after is not set.
+	DefaultAbortIncompleteUploadsAfter = 24 * time.Hour
+)
+
+// uploadState of multipart upload is kept next to the uploaded file while Upload retries, so the next
+// attempt continues the upload instead of sending all parts again. State is removed when Upload returns,
+// unless the upload was interrupted, then Upload of the same file by the next run continues it.
+type uploadState struct {
+	Bucket   string            `json:"bucket"`
+	Key      string            `json:"key"`
+	UploadId string            `json:"upload_id"`
+	Size     int64             `json:"size"`
+	ModTime  time.Time         `json:"mod_time"`
+	PartSize int64             `json:"part_size"`
+	Checksum string            `json:"checksum"` // sha256 stored as metadata, empty if checksum_algorithm is none
+	Parts    []uploadStatePart `json:"parts"`
+
+	path string
+	mut  sync.Mutex
+}
+
+type uploadStatePart struct {
+	PartNumber     int64  `json:"part_number"`
+	ETag           string `json:"etag"`
+	ChecksumSha256 string `json:"checksum_sha256,omitempty"`
+}
+
+func getUploadStatePath(file UploadFile) string {
+	return file.Name() + uploadStateSuffix
+}
+
+// HasUploadState reports whether interrupted upload of the local file or of its volumes can be continued.
+func HasUploadState(fileName string) bool {
+	return len(findUploadStates(fileName)) > 0
+}
+
+// RemoveUploadState removes upload states of the local file and its volumes, the uploads are aborted
+// by CleanupIncompleteUploads.
+func RemoveUploadState(fileName string) error {
+	var finalErr error
+
+	for _, statePath := range findUploadStates(fileName) {
+		if err := os.Remove(statePath); err != nil && !errors.Is(err, os.ErrNotExist) {
+			finalErr = multierror.Append(finalErr, errors.WithStack(err))
+		}
+	}
+
+	return finalErr
+}
+
+// findUploadStates returns state files of the file and its volumes (<file>.part0001.upload.json).
+func findUploadStates(fileName string) []string {
+	entries, err := os.ReadDir(filepath.Dir(fileName))
+	if err != nil {
+		return nil
+	}
+
+	var states []string
+
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), filepath.Base(fileName)) && strings.HasSuffix(e.Name(), uploadStateSuffix) {
+			states = append(states, filepath.Join(filepath.Dir(fileName), e.Name()))
+		}
+	}
+
+	return states
+}
+
+// loadUploadState returns nil state if file does not exist.
+func loadUploadState(path string) (*uploadState, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	state := &uploadState{path: path}
+	if err = json.Unmarshal(data, state); err != nil {
+		return nil, errors.Wrapf(err, "invalid upload state %v", path)
+	}
+
+	return state, nil
+}
+
+// matches reports whether state belongs to the same upload of unchanged file.
+func (u *uploadState) matches(
+	bucket string,
+	key string,
+	fileStat os.FileInfo,
+	partSize int64,
+	checksum string,
+) bool {
+	return u.Bucket == bucket && u.Key == key && u.Size == fileStat.Size() &&
+		u.ModTime.Equal(fileStat.ModTime()) && u.PartSize == partSize && len(u.UploadId) > 0 &&
+		(len(checksum) == 0 || checksum == u.Checksum)
+}
+
+func (u *uploadState) addPart(part *s3.CompletedPart) error {
+	u.mut.Lock()
+	defer u.mut.Unlock()
+
+	u.Parts = append(u.Parts, uploadStatePart{
+		PartNumber:     aws.Int64Value(part.PartNumber),
+		ETag:           aws.StringValue(part.ETag),
+		ChecksumSha256: aws.StringValue(part.ChecksumSHA256),
+	})
+
+	return u.save()
+}
+
+func (u *uploadState) save() error {
+	data, err := json.Marshal(u)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	tmp := u.path + ".tmp"
+	if err = os.WriteFile(tmp, data, 0600); err != nil {
+		return errors.WithStack(err)
+	}
+
+	return errors.WithStack(os.Rename(tmp, u.path))
+}
+
+func (u *uploadState) remove() {
+	_ = os.Remove(u.path)
+}
+
+func (u *uploadState) multipartUpload() *s3.CreateMultipartUploadOutput {
+	return &s3.CreateMultipartUploadOutput{
+		Bucket:   aws.String(u.Bucket),
+		Key:      aws.String(u.Key),
+		UploadId: aws.String(u.UploadId),
+	}
+}
+
+// startMultipartUpload continues upload from the state file if it matches the file, otherwise creates new upload.
+// Metadata of the object is set on creation, so sha256 of the file is calculated before it if checksum is empty.
+// Returned slice contains parts which are already uploaded.
+func (s S3Provider) startMultipartUpload(
+	ctx context.Context,
+	svc *s3.S3,
+	input *s3.CreateMultipartUploadInput,
+	file UploadFile,
+	partSize int64,
+	checksum string,
+) (*uploadState, []*s3.CompletedPart, error) {
+	fileStat, err := file.Stat()
+	if err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
+
+	partsCount := int((fileStat.Size() + partSize - 1) / partSize)
+	statePath := getUploadStatePath(file)
+
+	state, err := loadUploadState(statePath)
+	if err != nil {
+		zerolog.Ctx(ctx).Warn().Err(err).Msg("ignoring upload state")
+	}
+
+	if state != nil && state.matches(s.s3Cfg.Bucket, *input.Key, fileStat, partSize, checksum) {
+		parts, listErr := s.listUploadedParts(ctx, svc, state, fileStat.Size(), partsCount)
+		if listErr == nil {
+			zerolog.Ctx(ctx).Info().Msgf("resuming multipart upload %v, %v of %v parts already uploaded",
+				state.UploadId, len(state.Parts), partsCount)
+
+			return state, parts, nil
+		}
+
+		zerolog.Ctx(ctx).Warn().Err(listErr).Msgf("can not resume multipart upload %v, starting new one",
+			state.UploadId)
+	}
+
+	if s.getChecksumAlgorithm() != ChecksumNone {
+		if len(checksum) == 0 {
+			if checksum, err = FileChecksum(file); err != nil {
+				return nil, nil, err
+			}
+		}
+
+		input.Metadata = s.getMetadata(UploadOptions{Checksum: checksum})
+	}
+
+	resp, err := svc.CreateMultipartUploadWithContext(ctx, input)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	state = &uploadState{
+		Bucket:   s.s3Cfg.Bucket,
+		Key:      *input.Key,
+		UploadId: aws.StringValue(resp.UploadId),
+		Size:     fileStat.Size(),
+		ModTime:  fileStat.ModTime(),
+		PartSize: partSize,
+		Checksum: aws.StringValue(input.Metadata[checksumMetadataKey]),
+		path:     statePath,
+	}
+
+	if err = state.save(); err != nil {
+		zerolog.Ctx(ctx).Warn().Err(err).Msg("can not save upload state, upload will not be resumable")
+	}
+
+	return state, make([]*s3.CompletedPart, partsCount), nil
+}
+
+// listUploadedParts asks s3 for parts of the upload, parts with unexpected size are uploaded again.
+func (s S3Provider) listUploadedParts(
+	ctx context.Context,
+	svc *s3.S3,
+	state *uploadState,
+	size int64,
+	partsCount int,
+) ([]*s3.CompletedPart, error) {
+	completedParts := make([]*s3.CompletedPart, partsCount)
+	var listed []uploadStatePart
+
+	sseKey, _ := s.getSseCustomerKey()
+
+	err := svc.ListPartsPagesWithContext(ctx, &s3.ListPartsInput{
+		Bucket:               aws.String(state.Bucket),
+		Key:                  aws.String(state.Key),
+		UploadId:             aws.String(state.UploadId),
+		SSECustomerAlgorithm: s.getSseCustomerAlgorithm(),
+		SSECustomerKey:       sseKey,
+	}, func(page *s3.ListPartsOutput, _ bool) bool {
+		for _, p := range page.Parts {
+			number := aws.Int64Value(p.PartNumber)
+			if number < 1 || number > int64(partsCount) {
+				continue
+			}
+
+			if aws.Int64Value(p.Size) != min(state.PartSize, size-(number-1)*state.PartSize) {
+				continue
+			}
+
+			completedParts[number-1] = &s3.CompletedPart{
+				ETag:           p.ETag,
+				ChecksumSHA256: p.ChecksumSHA256,
+				PartNumber:     p.PartNumber,
+			}
+			listed = append(listed, uploadStatePart{
+				PartNumber:     number,
+				ETag:           aws.StringValue(p.ETag),
+				ChecksumSha256: aws.StringValue(p.ChecksumSHA256),
+			})
+		}
+
+		return true
+	})
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	state.Parts = listed
+
+	return completedParts, nil
+}
+
+// discardMultipartUpload aborts upload from the state file of the file and removes the state.
+// State is removed even if abort fails, such upload is aborted later by CleanupIncompleteUploads.
+func (s S3Provider) discardMultipartUpload(ctx context.Context, file UploadFile) error {
+	state, err := loadUploadState(getUploadStatePath(file))
+	if err != nil || state == nil {
+		_ = os.Remove(getUploadStatePath(file))
+		return err
+	}
+
+	defer state.remove()
+
+	cl, err := s.getClient()
+	if err != nil {
+		return err
+	}
+
+	return errors.WithStack(s.abortMultipartUpload(ctx, cl, state.multipartUpload()))
+}
+
+// CleanupIncompleteUploads aborts multipart uploads under prefix which were started
+// more than abort_incomplete_uploads_after ago, for example by crashed process.
+func (s S3Provider) CleanupIncompleteUploads(ctx context.Context, prefix string) ([]string, error) {
+	olderThan := s.s3Cfg.AbortIncompleteUploadsAfter
+	if olderThan == 0 {
+		olderThan = DefaultAbortIncompleteUploadsAfter
+	}
+	if olderThan < 0 {
+		return nil, nil
+	}
+
+	cl, err := s.getClient()
+	if err != nil {
+		return nil, err
+	}
+
+	var stale []*s3.MultipartUpload
+
+	err = cl.ListMultipartUploadsPagesWithContext(ctx, &s3.ListMultipartUploadsInput{
+		Bucket: aws.String(s.s3Cfg.Bucket),
+		Prefix: aws.String(prefix),
+	}, func(page *s3.ListMultipartUploadsOutput, _ bool) bool {
+		for _, u := range page.Uploads {
+			if u.Initiated != nil && time.Since(*u.Initiated) > olderThan {
+				stale = append(stale, u)
+			}
+		}
+
+		return true
+	})
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	var aborted []string
+	var finalErr error
+
+	for _, u := range stale {
+		if err = s.abortMultipartUpload(ctx, cl, &s3.CreateMultipartUploadOutput{
+			Bucket:   aws.String(s.s3Cfg.Bucket),
+			Key:      u.Key,
+			UploadId: u.UploadId,
+		}); err != nil {
+			finalErr = multierror.Append(finalErr, errors.WithStack(err))
+			continue
+		}
+
+		aborted = append(aborted, aws.StringValue(u.Key))
+	}
+
+	return aborted, finalErr
+}
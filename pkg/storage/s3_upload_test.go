@@ -0,0 +1,264 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func writeTestFile(t *testing.T, size int) *os.File {
+	data := bytes.Repeat([]byte("0123456789abcdef"), size/16+1)[:size]
+	path := filepath.Join(t.TempDir(), "dump")
+	assert.NoError(t, os.WriteFile(path, data, 0600))
+
+	file, err := os.Open(path)
+	assert.NoError(t, err)
+
+	t.Cleanup(func() {
+		_ = file.Close()
+	})
+
+	return file
+}
+
+func TestS3ConcurrentMultipartUpload(t *testing.T) {
+	fake, cfg := newFakeS3(t)
+	cfg.PartSizeMb = 1
+	cfg.MultipartThresholdMb = 1
+	cfg.UploadConcurrency = 3
+
+	file := writeTestFile(t, int(5*megabyte+123))
+	uploadedChecksum := ""
+
+	assert.NoError(t, NewS3Provider(cfg).Upload(context.TODO(), "db/dump.sql.gzip", file, UploadOptions{
+		OnChecksum: func(checksum string) {
+			uploadedChecksum = checksum
+		},
+	}))
+
+	expected, err := os.ReadFile(file.Name())
+	assert.NoError(t, err)
+	assert.Equal(t, expected, fake.objects["db/dump.sql.gzip"])
+	assert.LessOrEqual(t, fake.maxInFlight, 3)
+	assert.Empty(t, fake.uploads)
+
+	// calculated before the upload is created, so it is stored as metadata and verified with HEAD
+	checksum, err := FileChecksum(file)
+	assert.NoError(t, err)
+	assert.Equal(t, checksum, uploadedChecksum)
+	assert.Equal(t, checksum, fake.metadata["db/dump.sql.gzip"])
+
+	provider := NewS3Provider(cfg).(*S3Provider)
+	assert.NoError(t, provider.verifyUpload(context.TODO(), "db/dump.sql.gzip", 5*megabyte+123, checksum))
+
+	fake.mut.Lock()
+	delete(fake.metadata, "db/dump.sql.gzip")
+	fake.mut.Unlock()
+
+	assert.ErrorContains(t, provider.verifyUpload(context.TODO(), "db/dump.sql.gzip", 5*megabyte+123, checksum),
+		"has checksum metadata")
+}
+
+func TestS3MultipartUploadKeepsProvidedChecksum(t *testing.T) {
+	fake, cfg := newFakeS3(t)
+	cfg.PartSizeMb = 1
+	cfg.MultipartThresholdMb = 1
+
+	file := writeTestFile(t, int(3*megabyte))
+	checksum, err := FileChecksum(file)
+	assert.NoError(t, err)
+
+	assert.NoError(t, NewS3Provider(cfg).Upload(context.TODO(), "db/dump.sql.gzip", file, UploadOptions{
+		Checksum: checksum,
+	}))
+	assert.Equal(t, checksum, fake.metadata["db/dump.sql.gzip"])
+
+	assert.ErrorContains(t, NewS3Provider(cfg).Upload(context.TODO(), "db/other.sql.gzip", file, UploadOptions{
+		Checksum: strings.Repeat("0", 64),
+	}), "changed during upload")
+}
+
+func TestS3SimpleUploadChecksum(t *testing.T) {
+	fake, cfg := newFakeS3(t)
+	file := writeTestFile(t, 1000)
+	uploadedChecksum := ""
+
+	assert.NoError(t, NewS3Provider(cfg).Upload(context.TODO(), "db/dump.sql.gzip", file, UploadOptions{
+		OnChecksum: func(checksum string) {
+			uploadedChecksum = checksum
+		},
+	}))
+
+	checksum, err := FileChecksum(file)
+	assert.NoError(t, err)
+	assert.Equal(t, checksum, uploadedChecksum)
+	assert.Equal(t, checksum, fake.metadata["db/dump.sql.gzip"])
+	assert.Equal(t, checksum, fake.headers["db/dump.sql.gzip"].Get(payloadHashHeader)) // signed payload hash
+}
+
+func TestS3MultipartUploadAbortsOnFailedPart(t *testing.T) {
+	fake, cfg := newFakeS3(t)
+	cfg.PartSizeMb = 1
+	cfg.MultipartThresholdMb = 1
+	fake.failPart = func(partNumber int) bool {
+		return partNumber == 2
+	}
+
+	file := writeTestFile(t, int(3*megabyte))
+
+	assert.Error(t, NewS3Provider(cfg).Upload(context.TODO(), "db/dump.sql.gzip", file, UploadOptions{}))
+	assert.Empty(t, fake.uploads) // aborted
+	assert.NotContains(t, fake.objects, "db/dump.sql.gzip")
+	assert.NoFileExists(t, getUploadStatePath(file))
+}
+
+func TestS3MultipartUploadResumesFromState(t *testing.T) {
+	fake, cfg := newFakeS3(t)
+	cfg.PartSizeMb = 1
+	cfg.MultipartThresholdMb = 1
+	cfg.UploadConcurrency = 1
+	fake.failPart = func(partNumber int) bool {
+		return partNumber == 2
+	}
+
+	file := writeTestFile(t, int(3*megabyte+10))
+
+	// failed attempt leaves upload and its state for the next attempt of Upload
+	provider := NewS3Provider(cfg).(*S3Provider)
+	_, err := provider.multiPartUpload(context.TODO(), "db/dump.sql.gzip", file, 3*megabyte+10, UploadOptions{})
+	assert.Error(t, err)
+	assert.FileExists(t, getUploadStatePath(file))
+	assert.Len(t, fake.uploads, 1)
+
+	fake.failPart = nil
+
+	uploadedChecksum := ""
+
+	assert.NoError(t, NewS3Provider(cfg).Upload(context.TODO(), "db/dump.sql.gzip", file, UploadOptions{
+		OnChecksum: func(checksum string) {
+			uploadedChecksum = checksum
+		},
+	}))
+
+	expected, err := os.ReadFile(file.Name())
+	assert.NoError(t, err)
+	assert.Equal(t, expected, fake.objects["db/dump.sql.gzip"])
+	assert.Equal(t, 1, fake.partCalls[1]) // not uploaded again
+	assert.Equal(t, 1, fake.partCalls[4])
+	assert.Equal(t, 1, fake.uploadId)
+	assert.NoFileExists(t, getUploadStatePath(file))
+
+	sum := sha256.Sum256(expected)
+	assert.Equal(t, hex.EncodeToString(sum[:]), uploadedChecksum) // includes parts of the previous attempt
+	assert.Equal(t, uploadedChecksum, fake.metadata["db/dump.sql.gzip"])
+}
+
+func TestS3InterruptedUploadIsContinuedByNextRun(t *testing.T) {
+	fake, cfg := newFakeS3(t)
+	cfg.PartSizeMb = 1
+	cfg.MultipartThresholdMb = 1
+	cfg.UploadConcurrency = 1
+
+	ctx, cancel := context.WithCancel(context.TODO())
+	fake.failPart = func(partNumber int) bool {
+		if partNumber == 2 {
+			cancel() // process is stopping
+		}
+
+		return false
+	}
+
+	file := writeTestFile(t, int(3*megabyte+10))
+
+	err := NewS3Provider(cfg).Upload(ctx, "db/dump.sql.gzip", file, UploadOptions{})
+	assert.True(t, errors.Is(err, ErrUploadInterrupted))
+	assert.Len(t, fake.uploads, 1) // kept with its state for the next run
+	assert.True(t, HasUploadState(file.Name()))
+
+	fake.failPart = nil
+
+	reopened, err := os.Open(file.Name()) // next run opens the kept dump
+	assert.NoError(t, err)
+
+	t.Cleanup(func() {
+		_ = reopened.Close()
+	})
+
+	assert.NoError(t, NewS3Provider(cfg).Upload(context.TODO(), "db/dump.sql.gzip", reopened, UploadOptions{}))
+	assert.Equal(t, 1, fake.partCalls[1]) // not uploaded again
+	assert.Equal(t, 1, fake.uploadId)
+	assert.Empty(t, fake.uploads)
+	assert.False(t, HasUploadState(file.Name()))
+
+	expected, err := os.ReadFile(file.Name())
+	assert.NoError(t, err)
+	assert.Equal(t, expected, fake.objects["db/dump.sql.gzip"])
+}
+
+func TestRemoveUploadState(t *testing.T) {
+	dir := t.TempDir()
+	dump := filepath.Join(dir, "db-config-2024_01_01-00_00_00.sql.gzip")
+
+	for _, name := range []string{
+		dump + uploadStateSuffix,
+		dump + ".part0002" + uploadStateSuffix,
+		filepath.Join(dir, "db-config-2024_01_02-00_00_00.sql.gzip"+uploadStateSuffix),
+	} {
+		assert.NoError(t, os.WriteFile(name, []byte("{}"), 0600))
+	}
+
+	assert.True(t, HasUploadState(dump))
+	assert.NoError(t, RemoveUploadState(dump))
+	assert.False(t, HasUploadState(dump))
+	assert.True(t, HasUploadState(filepath.Join(dir, "db-config-2024_01_02-00_00_00.sql.gzip")))
+}
+
+func TestS3CleanupIncompleteUploads(t *testing.T) {
+	fake, cfg := newFakeS3(t)
+	cfg.AbortIncompleteUploadsAfter = time.Hour
+
+	fake.uploads = map[string]map[int][]byte{"1": {}, "2": {}, "3": {}}
+	fake.uploadKeys = map[string]string{"1": "db/old.sql.gzip", "2": "db/new.sql.gzip", "3": "other/old.sql.gzip"}
+	fake.initiated = map[string]time.Time{
+		"1": time.Now().Add(-2 * time.Hour),
+		"2": time.Now(),
+		"3": time.Now().Add(-2 * time.Hour),
+	}
+
+	aborted, err := NewS3Provider(cfg).(*S3Provider).CleanupIncompleteUploads(context.TODO(), "db/")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"db/old.sql.gzip"}, aborted)
+	assert.NotContains(t, fake.uploads, "1")
+	assert.Contains(t, fake.uploads, "2")
+	assert.Contains(t, fake.uploads, "3")
+}
+
+func TestS3GetPartSize(t *testing.T) {
+	provider := S3Provider{}
+
+	assert.Equal(t, defaultPartSize, provider.getPartSize(100*megabyte))
+	assert.Equal(t, 20*megabyte, provider.getPartSize(maxPartsCount*20*megabyte-1))
+}
+
+func TestS3GetPartConcurrency(t *testing.T) {
+	provider := S3Provider{}
+
+	assert.Equal(t, defaultUploadConcurrency, provider.getPartConcurrency(defaultPartSize))
+	assert.Equal(t, 2, provider.getPartConcurrency(32*megabyte))
+	assert.Equal(t, 1, provider.getPartConcurrency(210*megabyte)) // 2 TB file
+
+	provider.s3Cfg.PartSizeMb = 100
+	provider.s3Cfg.UploadConcurrency = 8
+
+	assert.Equal(t, 8, provider.getPartConcurrency(100*megabyte))
+	assert.Equal(t, 3, provider.getPartConcurrency(210*megabyte))
+}
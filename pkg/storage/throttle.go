@@ -0,0 +1,266 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/errors"
+
+	"github.com/skynet2/db-backup/pkg/common"
+	"github.com/skynet2/db-backup/pkg/configuration"
+)
+
+const unlimitedRate = "unlimited"
+
+// NewThrottledProvider limits upload rate of the provider by max_upload_rate and upload_rate_schedule.
+// All uploads of the provider, including parallel multipart parts, share the limit.
+// Provider is returned as is if no limit is configured.
+func NewThrottledProvider(provider Provider, cfg configuration.StorageConfiguration) (Provider, error) {
+	schedule, err := newRateSchedule(cfg.MaxUploadRate, cfg.UploadRateSchedule)
+	if err != nil {
+		return nil, err
+	}
+
+	if schedule.isUnlimited() {
+		return provider, nil
+	}
+
+	return &throttledProvider{
+		Provider: provider,
+		limiter:  &rateLimiter{rate: schedule.getRate},
+	}, nil
+}
+
+type throttledProvider struct {
+	Provider
+	limiter *rateLimiter
+}
+
+func (p *throttledProvider) Upload(ctx context.Context, finalFilePath string, file UploadFile, opts UploadOptions) error {
+	return p.Provider.Upload(ctx, finalFilePath, &throttledFile{
+		UploadFile: file,
+		ctx:        ctx,
+		limiter:    p.limiter,
+	}, opts)
+}
+
+func (p *throttledProvider) CleanupIncompleteUploads(ctx context.Context, prefix string) ([]string, error) {
+	if cleaner, ok := p.Provider.(UploadCleaner); ok {
+		return cleaner.CleanupIncompleteUploads(ctx, prefix)
+	}
+
+	return nil, nil
+}
+
+// throttledFile waits for the limiter after each read, so provider reads the file not faster than the rate.
+// Reads which do not send data (checksum) use unthrottled file, see withoutThrottling.
+type throttledFile struct {
+	UploadFile
+	ctx     context.Context
+	limiter *rateLimiter
+}
+
+// unthrottledFile is implemented by files which limit the rate of reads.
+type unthrottledFile interface {
+	unthrottled() UploadFile
+}
+
+func (f *throttledFile) unthrottled() UploadFile {
+	return f.UploadFile
+}
+
+// withoutThrottling returns file which reads are not limited, for reads which do not send data.
+func withoutThrottling(file UploadFile) UploadFile {
+	if throttled, ok := file.(unthrottledFile); ok {
+		return throttled.unthrottled()
+	}
+
+	return file
+}
+
+func (f *throttledFile) Read(p []byte) (int, error) {
+	n, err := f.UploadFile.Read(p)
+	if waitErr := f.limiter.wait(f.ctx, n); waitErr != nil {
+		return n, waitErr
+	}
+
+	return n, err
+}
+
+func (f *throttledFile) ReadAt(p []byte, off int64) (int, error) {
+	n, err := f.UploadFile.ReadAt(p, off)
+	if waitErr := f.limiter.wait(f.ctx, n); waitErr != nil {
+		return n, waitErr
+	}
+
+	return n, err
+}
+
+// rateLimiter is a token bucket with burst of one second of the current rate.
+// Debt of the bucket is paid by waiting, so concurrent readers are serialized fairly.
+type rateLimiter struct {
+	rate func(now time.Time) int64 // bytes per second, 0 - unlimited
+
+	mut       sync.Mutex
+	available float64
+	last      time.Time
+}
+
+func (l *rateLimiter) wait(ctx context.Context, n int) error {
+	if n <= 0 {
+		return nil
+	}
+
+	if err := ctx.Err(); err != nil {
+		return errors.WithStack(err)
+	}
+
+	l.mut.Lock()
+
+	now := time.Now()
+	rate := float64(l.rate(now))
+
+	if rate <= 0 {
+		l.mut.Unlock()
+		return nil
+	}
+
+	if !l.last.IsZero() {
+		l.available = min(l.available+now.Sub(l.last).Seconds()*rate, rate)
+	}
+
+	l.last = now
+	l.available -= float64(n)
+	delay := time.Duration(-l.available / rate * float64(time.Second))
+
+	l.mut.Unlock()
+
+	if delay <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return errors.WithStack(ctx.Err())
+	}
+}
+
+type rateWindow struct {
+	from time.Duration // since midnight
+	to   time.Duration
+	rate int64
+}
+
+type rateSchedule struct {
+	defaultRate int64
+	windows     []rateWindow
+}
+
+// newRateSchedule parses rate like 50MiB/s and schedule entries like 08:00-20:00=10MiB/s.
+// Window may cross midnight (22:00-06:00), the first matching window wins.
+func newRateSchedule(defaultRate string, schedule []string) (rateSchedule, error) {
+	var final rateSchedule
+	var err error
+
+	if final.defaultRate, err = parseRate(defaultRate); err != nil {
+		return final, errors.Wrap(err, "invalid max_upload_rate")
+	}
+
+	for _, entry := range schedule {
+		window, windowErr := parseRateWindow(entry)
+		if windowErr != nil {
+			return final, errors.Wrapf(windowErr, "invalid upload_rate_schedule entry %v", entry)
+		}
+
+		final.windows = append(final.windows, window)
+	}
+
+	return final, nil
+}
+
+func (r rateSchedule) isUnlimited() bool {
+	if r.defaultRate > 0 {
+		return false
+	}
+
+	for _, w := range r.windows {
+		if w.rate > 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// getRate returns rate at the local time of day.
+func (r rateSchedule) getRate(now time.Time) int64 {
+	sinceMidnight := time.Duration(now.Hour())*time.Hour + time.Duration(now.Minute())*time.Minute +
+		time.Duration(now.Second())*time.Second
+
+	for _, w := range r.windows {
+		if w.from <= w.to && sinceMidnight >= w.from && sinceMidnight < w.to {
+			return w.rate
+		}
+
+		if w.from > w.to && (sinceMidnight >= w.from || sinceMidnight < w.to) {
+			return w.rate
+		}
+	}
+
+	return r.defaultRate
+}
+
+func parseRateWindow(entry string) (rateWindow, error) {
+	times, rate, ok := strings.Cut(entry, "=")
+	if !ok {
+		return rateWindow{}, errors.New("expected HH:MM-HH:MM=rate")
+	}
+
+	from, to, ok := strings.Cut(times, "-")
+	if !ok {
+		return rateWindow{}, errors.New("expected HH:MM-HH:MM=rate")
+	}
+
+	var window rateWindow
+	var err error
+
+	if window.from, err = parseTimeOfDay(from); err != nil {
+		return window, err
+	}
+
+	if window.to, err = parseTimeOfDay(to); err != nil {
+		return window, err
+	}
+
+	window.rate, err = parseRate(rate)
+
+	return window, err
+}
+
+func parseTimeOfDay(value string) (time.Duration, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(value))
+	if err != nil {
+		return 0, errors.New(fmt.Sprintf("invalid time %v, expected HH:MM", value))
+	}
+
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// parseRate parses bytes per second, empty value or unlimited means no limit.
+func parseRate(value string) (int64, error) {
+	value = strings.TrimSpace(value)
+
+	if len(value) == 0 || strings.EqualFold(value, unlimitedRate) {
+		return 0, nil
+	}
+
+	return common.ParseSize(strings.TrimSuffix(value, "/s"))
+}
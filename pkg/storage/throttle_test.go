@@ -0,0 +1,151 @@
+package storage
+
+import (
+	"context"
+	"io"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/skynet2/db-backup/pkg/configuration"
+)
+
+func TestRateSchedule(t *testing.T) {
+	schedule, err := newRateSchedule("50MiB/s", []string{"08:00-20:00=10MB/s", "22:00-06:00=unlimited"})
+	assert.NoError(t, err)
+
+	at := func(clock string) time.Time {
+		parsed, parseErr := time.Parse("15:04", clock)
+		assert.NoError(t, parseErr)
+
+		return parsed
+	}
+
+	assert.Equal(t, int64(10*1000*1000), schedule.getRate(at("08:00")))
+	assert.Equal(t, int64(10*1000*1000), schedule.getRate(at("19:59")))
+	assert.Equal(t, int64(50*1024*1024), schedule.getRate(at("20:00")))
+	assert.Equal(t, int64(0), schedule.getRate(at("23:30")))
+	assert.Equal(t, int64(0), schedule.getRate(at("05:59")))
+	assert.Equal(t, int64(50*1024*1024), schedule.getRate(at("06:00")))
+	assert.False(t, schedule.isUnlimited())
+}
+
+func TestRateScheduleInvalid(t *testing.T) {
+	_, err := newRateSchedule("50 parrots/s", nil)
+	assert.ErrorContains(t, err, "max_upload_rate")
+
+	_, err = newRateSchedule("", []string{"08:00=1MB/s"})
+	assert.ErrorContains(t, err, "HH:MM-HH:MM=rate")
+
+	_, err = newRateSchedule("", []string{"8am-20:00=1MB/s"})
+	assert.ErrorContains(t, err, "invalid time")
+}
+
+func TestNewThrottledProviderUnlimited(t *testing.T) {
+	provider := NewS3Provider(configuration.S3Config{})
+
+	throttled, err := NewThrottledProvider(provider, configuration.StorageConfiguration{
+		UploadRateSchedule: []string{"08:00-20:00=unlimited"},
+	})
+	assert.NoError(t, err)
+	assert.Same(t, provider, throttled)
+}
+
+func TestThrottledFileRead(t *testing.T) {
+	file := &throttledFile{
+		UploadFile: writeTestFile(t, 300*1000),
+		ctx:        context.TODO(),
+		limiter: &rateLimiter{rate: func(_ time.Time) int64 {
+			return 1000 * 1000
+		}},
+	}
+
+	startedAt := time.Now()
+	data, err := io.ReadAll(file)
+	assert.NoError(t, err)
+	assert.Len(t, data, 300*1000)
+	assert.GreaterOrEqual(t, time.Since(startedAt), 250*time.Millisecond)
+
+	ctx, cancel := context.WithCancel(context.TODO())
+	cancel()
+
+	file.ctx = ctx
+	_, err = file.ReadAt(make([]byte, 1000), 0)
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+func TestThrottledProviderUpload(t *testing.T) {
+	fake, cfg := newFakeS3(t)
+
+	provider, err := NewThrottledProvider(NewS3Provider(cfg), configuration.StorageConfiguration{
+		MaxUploadRate: "100MB/s",
+	})
+	assert.NoError(t, err)
+
+	_, ok := provider.(UploadCleaner)
+	assert.True(t, ok)
+
+	assert.NoError(t, provider.Upload(context.TODO(), "db/dump.sql.gzip", writeTestFile(t, 1000), UploadOptions{}))
+	assert.Len(t, fake.objects["db/dump.sql.gzip"], 1000)
+	assert.Empty(t, fake.headers["db/dump.sql.gzip"].Get("Content-Md5")) // body is not read by sdk for md5
+}
+
+func TestThrottledFileChecksumIsNotThrottled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.TODO())
+	cancel() // any throttled read fails
+
+	raw := writeTestFile(t, 1000)
+	file := &throttledFile{
+		UploadFile: raw,
+		ctx:        ctx,
+		limiter: &rateLimiter{rate: func(_ time.Time) int64 {
+			return 1
+		}},
+	}
+
+	_, err := file.Read(make([]byte, 10))
+	assert.Error(t, err)
+
+	checksum, err := FileChecksum(file)
+	assert.NoError(t, err)
+
+	expected, err := FileChecksum(raw)
+	assert.NoError(t, err)
+	assert.Equal(t, expected, checksum)
+}
+
+func TestThrottledResumedUploadDoesNotLimitUploadedParts(t *testing.T) {
+	fake, cfg := newFakeS3(t)
+	cfg.PartSizeMb = 1
+	cfg.MultipartThresholdMb = 1
+	cfg.UploadConcurrency = 1
+	fake.failPart = func(partNumber int) bool {
+		return partNumber == 2
+	}
+
+	raw := writeTestFile(t, int(3*megabyte+10))
+	provider := NewS3Provider(cfg).(*S3Provider)
+
+	_, err := provider.multiPartUpload(context.TODO(), "db/dump.sql.gzip", raw, 3*megabyte+10, UploadOptions{})
+	assert.Error(t, err)
+
+	fake.failPart = nil
+
+	var throttledReads atomic.Int32
+
+	file := &throttledFile{
+		UploadFile: raw,
+		ctx:        context.TODO(),
+		limiter: &rateLimiter{rate: func(_ time.Time) int64 {
+			throttledReads.Add(1) // called once for each read of sent data
+
+			return 1000 * megabyte
+		}},
+	}
+
+	_, err = provider.multiPartUpload(context.TODO(), "db/dump.sql.gzip", file, 3*megabyte+10, UploadOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, int32(3), throttledReads.Load()) // part 1 was uploaded by the first attempt
+}
@@ -2,19 +2,55 @@ package storage
 
 import (
 	"context"
+	"io"
 	"os"
 	"time"
+
+	"github.com/cockroachdb/errors"
 )
 
+// ErrObjectLocked is returned by Remove for objects protected by retention or legal hold.
+var ErrObjectLocked = errors.New("object is locked")
+
+// ErrUploadInterrupted is returned by Upload which was cancelled or timed out after the upload state was saved.
+// The upload is kept, Upload of the same file continues it, see HasUploadState.
+var ErrUploadInterrupted = errors.New("upload was interrupted")
+
 type Provider interface {
 	Validate(ctx context.Context) error
 	List(ctx context.Context, prefix string) ([]File, error)
 	Remove(ctx context.Context, absolutePath string) error
-	Upload(ctx context.Context, finalFilePath string, reader *os.File) error
+	Upload(ctx context.Context, finalFilePath string, reader UploadFile, opts UploadOptions) error
+	Download(ctx context.Context, absolutePath string, writer io.Writer) error
 	GetType() string
 }
 
+// UploadCleaner is implemented by providers which can leave incomplete uploads behind, e.g. after crash.
+type UploadCleaner interface {
+	// CleanupIncompleteUploads aborts stale incomplete uploads under prefix and returns their keys.
+	CleanupIncompleteUploads(ctx context.Context, prefix string) ([]string, error)
+}
+
+// UploadFile is a local file passed to Upload, *os.File or its wrapper (e.g. throttled).
+type UploadFile interface {
+	io.Reader
+	io.ReaderAt
+	io.Seeker
+	Name() string
+	Stat() (os.FileInfo, error)
+}
+
+// UploadOptions describes uploaded object. Zero value -> provider defaults.
+type UploadOptions struct {
+	Checksum string            // hex encoded sha256 of the file, calculated by provider while uploading if empty
+	Tags     map[string]string // object tags, if supported by provider
+	Lock     bool              // apply configured object lock (immutable backups), if supported by provider
+
+	OnChecksum func(checksum string) // called after successful upload with hex encoded sha256 of the file
+}
+
 type File struct {
 	AbsolutePath string
 	CreatedAt    time.Time
+	Size         int64
 }
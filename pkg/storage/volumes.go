@@ -0,0 +1,404 @@
+package storage
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/cockroachdb/errors"
+	"github.com/hashicorp/go-multierror"
+	"github.com/rs/zerolog"
+	"github.com/samber/lo"
+
+	"github.com/skynet2/db-backup/pkg/common"
+	"github.com/skynet2/db-backup/pkg/configuration"
+)
+
+const (
+	volumesManifestSuffix = ".volumes.json"
+	volumeSchemaVersion   = 1
+)
+
+var volumeSuffixRegex = regexp.MustCompile(`\.part\d{4,}$`)
+
+// VolumeSet describes backup split into volumes, it is uploaded after all volumes as <key>.volumes.json.
+type VolumeSet struct {
+	SchemaVersion int       `json:"schema_version"`
+	Key           string    `json:"key"`
+	CreatedAt     time.Time `json:"created_at"`
+	Size          int64     `json:"size"`
+	Checksum      string    `json:"checksum"` // sha256 of the whole backup, hex encoded
+	Volumes       []Volume  `json:"volumes"`  // in order of concatenation
+}
+
+type Volume struct {
+	Key      string `json:"key"`
+	Size     int64  `json:"size"`
+	Checksum string `json:"checksum"` // sha256 of the volume, hex encoded
+}
+
+// NewVolumeProvider splits uploads bigger than volume_size into <key>.part0001, <key>.part0002, ... volumes.
+// List returns volume set as a single file with the key of the backup, Remove and Download handle all volumes,
+// so retention and restore work with volume sets as with regular backups.
+// Provider is returned as is if volume_size is not configured.
+func NewVolumeProvider(provider Provider, cfg configuration.StorageConfiguration) (Provider, error) {
+	if len(strings.TrimSpace(cfg.VolumeSize)) == 0 {
+		return provider, nil
+	}
+
+	volumeSize, err := common.ParseSize(cfg.VolumeSize)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid volume_size")
+	}
+
+	if volumeSize <= 0 {
+		return nil, errors.New("volume_size should be positive")
+	}
+
+	orphanedAfter := cfg.S3.AbortIncompleteUploadsAfter
+	if orphanedAfter == 0 {
+		orphanedAfter = DefaultAbortIncompleteUploadsAfter
+	}
+
+	return &volumeProvider{
+		Provider:      provider,
+		volumeSize:    volumeSize,
+		orphanedAfter: orphanedAfter,
+	}, nil
+}
+
+type volumeProvider struct {
+	Provider
+	volumeSize    int64
+	orphanedAfter time.Duration // volumes without volume set manifest are removed after it, negative - never
+}
+
+func getVolumeKey(key string, number int) string {
+	return fmt.Sprintf("%v.part%04d", key, number)
+}
+
+func (p *volumeProvider) Upload(ctx context.Context, finalFilePath string, file UploadFile, opts UploadOptions) error {
+	fileStat, err := file.Stat()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	if fileStat.Size() <= p.volumeSize {
+		return p.Provider.Upload(ctx, finalFilePath, file, opts)
+	}
+
+	set := VolumeSet{
+		SchemaVersion: volumeSchemaVersion,
+		Key:           finalFilePath,
+		CreatedAt:     time.Now().UTC(),
+		Size:          fileStat.Size(),
+		Checksum:      opts.Checksum,
+	}
+
+	count := int((fileStat.Size() + p.volumeSize - 1) / p.volumeSize)
+
+	total, volumeChecksums, err := p.getChecksums(file, fileStat, count)
+	if err != nil {
+		return err
+	}
+
+	if len(set.Checksum) == 0 {
+		set.Checksum = total
+	}
+
+	zerolog.Ctx(ctx).Info().Msgf("uploading %v as %v volumes of %v", finalFilePath, count,
+		common.ByteCountSI(p.volumeSize))
+
+	for i := 0; i < count; i++ {
+		volume := newVolumeFile(file, fileStat, getVolumeKey("", i+1), int64(i)*p.volumeSize,
+			min(p.volumeSize, fileStat.Size()-int64(i)*p.volumeSize))
+
+		volumeOpts := opts
+		volumeOpts.Checksum = volumeChecksums[i]
+		volumeOpts.OnChecksum = nil
+
+		if err = p.Provider.Upload(ctx, getVolumeKey(finalFilePath, i+1), volume, volumeOpts); err != nil {
+			return p.abortUpload(ctx, set, errors.Wrapf(err, "can not upload volume %v", i+1))
+		}
+
+		set.Volumes = append(set.Volumes, Volume{
+			Key:      getVolumeKey(finalFilePath, i+1),
+			Size:     volume.size,
+			Checksum: volumeOpts.Checksum,
+		})
+	}
+
+	data, err := json.MarshalIndent(set, "", "  ")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	// temporary file of the volume set manifest is created in the directory of the uploaded file
+	err = UploadBytes(ctx, p.Provider, finalFilePath+volumesManifestSuffix, data, filepath.Dir(file.Name()),
+		UploadOptions{
+			Tags: opts.Tags,
+			Lock: opts.Lock,
+		})
+	if err != nil {
+		return p.abortUpload(ctx, set, err)
+	}
+
+	if opts.OnChecksum != nil {
+		opts.OnChecksum(set.Checksum)
+	}
+
+	return nil
+}
+
+// getChecksums returns sha256 of the file and of each volume calculated in a single read of the file.
+func (p *volumeProvider) getChecksums(file UploadFile, fileStat os.FileInfo, count int) (string, []string, error) {
+	total := sha256.New()
+	volumes := make([]string, 0, count)
+
+	for i := 0; i < count; i++ {
+		volume := newVolumeFile(file, fileStat, "", int64(i)*p.volumeSize,
+			min(p.volumeSize, fileStat.Size()-int64(i)*p.volumeSize))
+
+		volumeHash := sha256.New()
+		if _, err := io.Copy(io.MultiWriter(total, volumeHash), volume); err != nil {
+			return "", nil, errors.WithStack(err)
+		}
+
+		volumes = append(volumes, hex.EncodeToString(volumeHash.Sum(nil)))
+	}
+
+	return hex.EncodeToString(total.Sum(nil)), volumes, nil
+}
+
+// abortUpload removes already uploaded volumes of failed upload.
+func (p *volumeProvider) abortUpload(ctx context.Context, set VolumeSet, uploadErr error) error {
+	for _, v := range set.Volumes {
+		if err := p.Provider.Remove(context.WithoutCancel(ctx), v.Key); err != nil {
+			zerolog.Ctx(ctx).Warn().Err(err).Msgf("can not remove volume %v of failed upload", v.Key)
+		}
+	}
+
+	return uploadErr
+}
+
+// List returns complete volume sets as single files. Volumes without volume set manifest
+// (upload is in progress or failed) are skipped, they are removed by CleanupIncompleteUploads.
+func (p *volumeProvider) List(ctx context.Context, prefix string) ([]File, error) {
+	files, err := p.Provider.List(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	sizes := map[string]int64{}
+
+	for _, f := range files {
+		if volumeSuffixRegex.MatchString(f.AbsolutePath) {
+			sizes[volumeSuffixRegex.ReplaceAllString(f.AbsolutePath, "")] += f.Size
+		}
+	}
+
+	var final []File
+
+	for _, f := range files {
+		switch {
+		case volumeSuffixRegex.MatchString(f.AbsolutePath):
+			continue
+		case strings.HasSuffix(f.AbsolutePath, volumesManifestSuffix):
+			key := strings.TrimSuffix(f.AbsolutePath, volumesManifestSuffix)
+
+			final = append(final, File{
+				AbsolutePath: key,
+				CreatedAt:    f.CreatedAt, // uploaded after all volumes
+				Size:         sizes[key],
+			})
+		default:
+			final = append(final, f)
+		}
+	}
+
+	return sortFiles(final), nil
+}
+
+// Remove removes volumes before volume set manifest, so partially removed set is still listed
+// and removal is retried by the next retention.
+func (p *volumeProvider) Remove(ctx context.Context, absolutePath string) error {
+	set, found, err := p.loadVolumeSet(ctx, absolutePath)
+	if err != nil {
+		return err
+	}
+
+	if !found {
+		return p.Provider.Remove(ctx, absolutePath)
+	}
+
+	var finalErr error
+
+	for _, v := range set.Volumes {
+		if removeErr := p.Provider.Remove(ctx, v.Key); removeErr != nil {
+			if errors.Is(removeErr, ErrObjectLocked) {
+				return removeErr
+			}
+
+			finalErr = multierror.Append(finalErr, removeErr)
+		}
+	}
+
+	if finalErr != nil {
+		return finalErr
+	}
+
+	return p.Provider.Remove(ctx, absolutePath+volumesManifestSuffix)
+}
+
+// Download concatenates volumes into writer, checksums of volumes and of the whole backup are verified.
+func (p *volumeProvider) Download(ctx context.Context, absolutePath string, writer io.Writer) error {
+	set, found, err := p.loadVolumeSet(ctx, absolutePath)
+	if err != nil {
+		return err
+	}
+
+	if !found {
+		return p.Provider.Download(ctx, absolutePath, writer)
+	}
+
+	total := sha256.New()
+
+	for _, v := range set.Volumes {
+		volumeHash := sha256.New()
+
+		if err = p.Provider.Download(ctx, v.Key, io.MultiWriter(writer, total, volumeHash)); err != nil {
+			return errors.Wrapf(err, "can not download volume %v", v.Key)
+		}
+
+		if sum := hex.EncodeToString(volumeHash.Sum(nil)); sum != v.Checksum {
+			return errors.New(fmt.Sprintf("volume %v has checksum %v, expected %v", v.Key, sum, v.Checksum))
+		}
+	}
+
+	if sum := hex.EncodeToString(total.Sum(nil)); len(set.Checksum) > 0 && sum != set.Checksum {
+		return errors.New(fmt.Sprintf("backup %v has checksum %v, expected %v", absolutePath, sum, set.Checksum))
+	}
+
+	return nil
+}
+
+func (p *volumeProvider) loadVolumeSet(ctx context.Context, key string) (VolumeSet, bool, error) {
+	var set VolumeSet
+
+	manifestKey := key + volumesManifestSuffix
+
+	data, found, err := DownloadIfExists(ctx, p.Provider, manifestKey)
+	if err != nil {
+		return set, false, err
+	}
+
+	if !found {
+		return set, false, nil
+	}
+
+	if err = json.Unmarshal(data, &set); err != nil {
+		return set, false, errors.Wrapf(err, "invalid volume set %v", manifestKey)
+	}
+
+	return set, true, nil
+}
+
+// CleanupIncompleteUploads aborts incomplete uploads of the provider and removes volumes of sets without
+// volume set manifest (upload of volumes was interrupted) if the newest volume is older than orphanedAfter.
+func (p *volumeProvider) CleanupIncompleteUploads(ctx context.Context, prefix string) ([]string, error) {
+	var aborted []string
+	var finalErr error
+
+	if cleaner, ok := p.Provider.(UploadCleaner); ok {
+		aborted, finalErr = cleaner.CleanupIncompleteUploads(ctx, prefix)
+	}
+
+	if p.orphanedAfter < 0 {
+		return aborted, finalErr
+	}
+
+	files, err := p.Provider.List(ctx, prefix)
+	if err != nil {
+		return aborted, multierror.Append(finalErr, err)
+	}
+
+	complete := map[string]bool{}
+	orphaned := map[string][]File{}
+
+	for _, f := range files {
+		switch {
+		case strings.HasSuffix(f.AbsolutePath, volumesManifestSuffix):
+			complete[strings.TrimSuffix(f.AbsolutePath, volumesManifestSuffix)] = true
+		case volumeSuffixRegex.MatchString(f.AbsolutePath):
+			key := volumeSuffixRegex.ReplaceAllString(f.AbsolutePath, "")
+			orphaned[key] = append(orphaned[key], f)
+		}
+	}
+
+	for key, volumes := range orphaned {
+		if complete[key] || lo.ContainsBy(volumes, func(f File) bool {
+			return time.Since(f.CreatedAt) <= p.orphanedAfter // upload can be in progress
+		}) {
+			continue
+		}
+
+		var removeErr error
+
+		for _, v := range volumes {
+			if err = p.Provider.Remove(ctx, v.AbsolutePath); err != nil {
+				removeErr = multierror.Append(removeErr, errors.Wrapf(err, "can not remove orphaned volume %v", v.AbsolutePath))
+			}
+		}
+
+		if removeErr != nil {
+			finalErr = multierror.Append(finalErr, removeErr)
+			continue
+		}
+
+		aborted = append(aborted, key)
+	}
+
+	return aborted, finalErr
+}
+
+// volumeFile is a section of the uploaded file.
+type volumeFile struct {
+	*io.SectionReader
+	name string
+	size int64
+	stat os.FileInfo
+}
+
+func newVolumeFile(file UploadFile, stat os.FileInfo, suffix string, offset int64, size int64) *volumeFile {
+	return &volumeFile{
+		SectionReader: io.NewSectionReader(file, offset, size),
+		name:          file.Name() + suffix, // different name per volume, e.g. for multipart upload state
+		size:          size,
+		stat:          stat,
+	}
+}
+
+func (f *volumeFile) Name() string {
+	return f.name
+}
+
+func (f *volumeFile) Stat() (os.FileInfo, error) {
+	return volumeFileInfo{FileInfo: f.stat, size: f.size}, nil
+}
+
+type volumeFileInfo struct {
+	os.FileInfo
+	size int64
+}
+
+func (i volumeFileInfo) Size() int64 {
+	return i.size
+}
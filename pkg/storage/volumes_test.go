@@ -0,0 +1,98 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/skynet2/db-backup/pkg/configuration"
+)
+
+func TestVolumeProviderRoundTrip(t *testing.T) {
+	fake, cfg := newFakeS3(t)
+
+	provider, err := NewVolumeProvider(NewS3Provider(cfg), configuration.StorageConfiguration{
+		VolumeSize: "1KiB",
+	})
+	assert.NoError(t, err)
+
+	file := writeTestFile(t, 2500)
+	small := writeTestFile(t, 100)
+
+	assert.NoError(t, provider.Upload(context.TODO(), "db/big.sql.gzip", file, UploadOptions{}))
+	assert.NoError(t, provider.Upload(context.TODO(), "db/small.sql.gzip", small, UploadOptions{}))
+
+	assert.Len(t, fake.objects["db/big.sql.gzip.part0001"], 1024)
+	assert.Len(t, fake.objects["db/big.sql.gzip.part0003"], 2500-2048)
+	assert.Contains(t, fake.objects, "db/big.sql.gzip.volumes.json")
+	assert.NotContains(t, fake.objects, "db/big.sql.gzip")
+	assert.Contains(t, fake.objects, "db/small.sql.gzip")
+
+	fake.objects["db/orphan.sql.gzip.part0001"] = []byte("incomplete upload")
+
+	files, err := provider.List(context.TODO(), "db/")
+	assert.NoError(t, err)
+	assert.Len(t, files, 2)
+	assert.Equal(t, "db/big.sql.gzip", files[0].AbsolutePath)
+	assert.Equal(t, int64(2500), files[0].Size)
+	assert.Equal(t, "db/small.sql.gzip", files[1].AbsolutePath)
+
+	var buf bytes.Buffer
+	assert.NoError(t, provider.Download(context.TODO(), "db/big.sql.gzip", &buf))
+
+	expected, err := os.ReadFile(file.Name())
+	assert.NoError(t, err)
+	assert.Equal(t, expected, buf.Bytes())
+
+	fake.objects["db/big.sql.gzip.part0002"][0] ^= 1
+	assert.ErrorContains(t, provider.Download(context.TODO(), "db/big.sql.gzip", &bytes.Buffer{}), "checksum")
+
+	assert.NoError(t, provider.Remove(context.TODO(), "db/big.sql.gzip"))
+
+	for key := range fake.objects {
+		assert.NotContains(t, key, "db/big.sql.gzip")
+	}
+}
+
+func TestVolumeProviderCleanupOrphanedVolumes(t *testing.T) {
+	fake, cfg := newFakeS3(t)
+
+	provider, err := NewVolumeProvider(NewS3Provider(cfg), configuration.StorageConfiguration{
+		VolumeSize: "1KiB",
+		S3: configuration.S3Config{
+			AbortIncompleteUploadsAfter: 100000 * time.Hour, // fake objects are created in 2024
+		},
+	})
+	assert.NoError(t, err)
+
+	assert.NoError(t, provider.Upload(context.TODO(), "db/big.sql.gzip", writeTestFile(t, 2500), UploadOptions{}))
+
+	fake.objects["db/orphan.sql.gzip.part0001"] = []byte("incomplete upload")
+	fake.objects["db/orphan.sql.gzip.part0002"] = []byte("incomplete upload")
+
+	aborted, err := provider.(UploadCleaner).CleanupIncompleteUploads(context.TODO(), "db/")
+	assert.NoError(t, err)
+	assert.Empty(t, aborted) // can be in progress
+	assert.Contains(t, fake.objects, "db/orphan.sql.gzip.part0001")
+
+	provider, err = NewVolumeProvider(NewS3Provider(cfg), configuration.StorageConfiguration{
+		VolumeSize: "1KiB",
+	})
+	assert.NoError(t, err)
+
+	aborted, err = provider.(UploadCleaner).CleanupIncompleteUploads(context.TODO(), "db/")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"db/orphan.sql.gzip"}, aborted)
+	assert.NotContains(t, fake.objects, "db/orphan.sql.gzip.part0001")
+	assert.NotContains(t, fake.objects, "db/orphan.sql.gzip.part0002")
+	assert.Contains(t, fake.objects, "db/big.sql.gzip.part0001") // complete set is kept
+}
+
+func TestNewVolumeProviderInvalidSize(t *testing.T) {
+	_, err := NewVolumeProvider(nil, configuration.StorageConfiguration{VolumeSize: "lots"})
+	assert.ErrorContains(t, err, "volume_size")
+}